@@ -1,11 +1,19 @@
 package cluster
 
 import (
+	"github.com/lizhen1412/eegos/network"
 	"github.com/lizhen1412/eegos/rpc"
 
+	"context"
+	"errors"
+	"fmt"
+	"net"
 	"strings"
 )
 
+// ErrUnknownServer 表示没有通过 Connect 连接指定名称的服务器
+var ErrUnknownServer = errors.New("cluster: unknown server")
+
 // ServerInfo 结构用于保存服务器信息和端口号
 type ServerInfo struct {
 	server *rpc.Server // rpc.Server 类型的服务器
@@ -14,9 +22,37 @@ type ServerInfo struct {
 
 var cServer *ServerInfo
 
-// Open 函数用于初始化服务器
+// connWrapper 之后创建的服务器和客户端使用的连接包装函数
+var connWrapper func(net.Conn) net.Conn
+
+// SetConnWrapper 设置之后 Open 和 Connect 创建的连接使用的包装函数，
+// 例如使用 network.FaultNetwork 在测试中注入网络故障
+func SetConnWrapper(wrap func(net.Conn) net.Conn) {
+	connWrapper = wrap
+}
+
+// transports 之后创建的服务器和客户端使用的传输方式，以 scheme 作为键
+var transports = make(map[string]network.Transport)
+
+// SetTransport 设置之后 Open 和 Connect 对 scheme 使用的传输方式，例如为 "tls" 设置带证书的 network.TLSTransport，
+// transport 为 nil 时取消设置，恢复使用全局注册的传输方式
+func SetTransport(scheme string, transport network.Transport) {
+	if transport == nil {
+		delete(transports, scheme)
+		return
+	}
+	transports[scheme] = transport
+}
+
+// Open 函数用于初始化服务器，addr 可以是 "scheme://地址" 形式的其他传输方式
 func Open(addr string) {
 	server := rpc.NewServer(addr) // 创建一个新的rpc服务器
+	if connWrapper != nil {
+		server.SetConnWrapper(connWrapper)
+	}
+	for scheme, transport := range transports {
+		server.SetTransport(scheme, transport)
+	}
 	//server.Open(addr)
 	indx := strings.LastIndex(addr, ":")
 	cServer = &ServerInfo{server: server, port: addr[indx+1:]} // 初始化 cServer 变量
@@ -34,16 +70,26 @@ func Start() {
 
 var cClient map[string]*rpc.Client
 
-// Connect 函数用于连接到服务器
-func Connect(serverName string, addr string) {
+// Connect 函数用于连接到服务器，连接失败时返回错误且不会缓存该客户端，addr 可以是 "scheme://地址" 形式的其他传输方式
+func Connect(serverName string, addr string) error {
 	if cClient == nil {
 		cClient = make(map[string]*rpc.Client) // 如果 cClient 为空，创建一个新的map
 	}
 	if cClient[serverName] == nil {
-		client := rpc.NewClient()    // 创建一个新的rpc客户端
-		client.Dial(addr)            // 连接到指定地址的服务器
+		client := rpc.NewClient() // 创建一个新的rpc客户端
+		if connWrapper != nil {
+			client.SetConnWrapper(connWrapper)
+		}
+		for scheme, transport := range transports {
+			client.SetTransport(scheme, transport)
+		}
+		// 连接到指定地址的服务器
+		if err := client.Dial(addr); err != nil {
+			return err
+		}
 		cClient[serverName] = client // 将客户端存储在 cClient 中
 	}
+	return nil
 }
 
 // Call 函数用于调用远程服务器的方法
@@ -55,12 +101,23 @@ func Call(serverName string, v ...interface{}) []interface{} {
 	return client.Call(v) // 使用客户端向服务器发起调用请求，并返回服务器的响应
 }
 
-// Send 函数用于发送数据到远程服务器
-func Send(serverName string, v ...interface{}) {
+// CallContext 调用远程服务器的方法并在 ctx 的控制下等待结果。
+// 没有连接该服务器时返回 ErrUnknownServer，其他错误与 rpc.Client.CallContext 相同，
+// 例如超时返回 rpc.ErrTimeout，可以与服务器返回的空结果区分开。
+func CallContext(ctx context.Context, serverName string, v ...interface{}) ([]interface{}, error) {
+	client := cClient[serverName]
+	if client == nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownServer, serverName)
+	}
+	return client.CallContext(ctx, v)
+}
+
+// Send 函数用于发送数据到远程服务器，发送失败时返回错误
+func Send(serverName string, v ...interface{}) error {
 	client := cClient[serverName] // 获取指定服务器的客户端
 	if client == nil {
 		panic("cannot find server:" + serverName)
 	} // 如果找不到客户端，触发 panic，报告无法找到服务器
 	// 使用客户端向服务器发送数据
-	client.Send(v)
+	return client.Send(v)
 }
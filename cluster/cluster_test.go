@@ -0,0 +1,45 @@
+package cluster
+
+import (
+	"github.com/lizhen1412/eegos/rpc"
+
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// Echo 测试使用的 RPC 服务
+type Echo struct{}
+
+func (this *Echo) Hello(name string) string { return "hello " + name }
+
+func (this *Echo) Slow() string {
+	time.Sleep(300 * time.Millisecond)
+	return "late"
+}
+
+func TestCallContext(t *testing.T) {
+	Open("mem://cluster-test")
+	Register(new(Echo))
+	go Start()
+	time.Sleep(50 * time.Millisecond)
+	if err := Connect("echo", "mem://cluster-test"); err != nil {
+		t.Fatal(err)
+	}
+
+	ret, err := CallContext(context.Background(), "echo", "Echo.Hello", "eegos")
+	if err != nil || len(ret) != 1 || ret[0] != "hello eegos" {
+		t.Fatalf("Hello = %v, %v", ret, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := CallContext(ctx, "echo", "Echo.Slow"); !errors.Is(err, rpc.ErrTimeout) {
+		t.Fatalf("Slow err = %v, want rpc.ErrTimeout", err)
+	}
+
+	if _, err := CallContext(context.Background(), "missing", "Echo.Hello", "x"); !errors.Is(err, ErrUnknownServer) {
+		t.Fatalf("unknown server err = %v, want ErrUnknownServer", err)
+	}
+}
@@ -0,0 +1,148 @@
+package gate
+
+import (
+	"github.com/lizhen1412/eegos/log"
+	"github.com/lizhen1412/eegos/network"
+
+	"sync"
+)
+
+// ClientID 在后端唯一标识一个经由网关接入的客户端，
+// 高 16 位是网关连接的会话标识，低 16 位是客户端在网关上的会话标识
+type ClientID uint32
+
+// newClientID 组合网关会话标识和客户端会话标识
+func newClientID(gateFd uint16, clientFd uint16) ClientID {
+	return ClientID(uint32(gateFd)<<16 | uint32(clientFd))
+}
+
+// gateFd 返回客户端所在的网关会话标识
+func (this ClientID) gateFd() uint16 {
+	return uint16(this >> 16)
+}
+
+// clientFd 返回客户端在网关上的会话标识
+func (this ClientID) clientFd() uint16 {
+	return uint16(this)
+}
+
+// BackendHandler 处理网关转发到后端的客户端事件和消息。
+// 同一个网关连接上的事件按网关发送的顺序依次调用，处理函数阻塞会推迟该网关上所有客户端的后续消息。
+// Message 的消息体只在本次调用期间有效，返回后缓冲区会被复用，需要保留时应复制。
+type BackendHandler interface {
+	Attach(ClientID, string)          // 客户端接入，第二个参数是客户端身份
+	Message(ClientID, uint16, []byte) // 客户端消息，参数为客户端、消息ID和消息体
+	Detach(ClientID)                  // 客户端断开或迁移到其他后端
+}
+
+// Backend 是接受网关连接的转发后端，把网关转发的客户端消息交给 BackendHandler，
+// 并可以向客户端推送消息或要求网关踢出客户端
+type Backend struct {
+	tcpServer *network.TcpServer
+	handler   BackendHandler
+	lock      sync.RWMutex
+	gates     map[uint16]*network.Session // 网关会话，以会话标识作为键
+	clients   map[ClientID]bool           // 已接入的客户端
+}
+
+// NewBackend 创建一个监听指定地址的转发后端
+func NewBackend(handler BackendHandler, addrs ...string) *Backend {
+	newBackend := &Backend{
+		handler: handler,
+		gates:   make(map[uint16]*network.Session),
+		clients: make(map[ClientID]bool),
+	}
+	newBackend.tcpServer = network.NewTcpServer(newBackend, addrs...)
+	return newBackend
+}
+
+// Start 启动后端，阻塞直到监听器停止
+func (this *Backend) Start() {
+	this.tcpServer.Start()
+}
+
+// Push 向客户端推送消息
+func (this *Backend) Push(client ClientID, msgID uint16, body []byte) error {
+	this.lock.RLock()
+	s, ok := this.gates[client.gateFd()]
+	this.lock.RUnlock()
+	if !ok {
+		return ErrNoClient
+	}
+	return this.tcpServer.Write(s, msgID, packRelay(OP_PUSH, client.clientFd(), body))
+}
+
+// Kick 要求网关踢出客户端，reason 会作为踢出原因记录在网关
+func (this *Backend) Kick(client ClientID, reason string) error {
+	this.lock.RLock()
+	s, ok := this.gates[client.gateFd()]
+	this.lock.RUnlock()
+	if !ok {
+		return ErrNoClient
+	}
+	return this.tcpServer.Write(s, 0, packRelay(OP_KICK, client.clientFd(), []byte(reason)))
+}
+
+// Connect 处理网关的新连接
+func (this *Backend) Connect(fd uint16, s *network.Session) {
+	log.Debug("backend new gate", fd)
+	// 接入、消息和离开需要按顺序处理
+	s.SetOrdered(true)
+	this.lock.Lock()
+	this.gates[fd] = s
+	this.lock.Unlock()
+}
+
+// Message 处理网关转发的消息
+func (this *Backend) Message(fd uint16, msgID uint16, body []byte) {
+	op, clientFd, payload, err := unpackRelay(body)
+	if err != nil {
+		log.Warn("backend relay message", fd, err)
+		return
+	}
+	client := newClientID(fd, clientFd)
+	switch op {
+	case OP_ATTACH:
+		this.lock.Lock()
+		this.clients[client] = true
+		this.lock.Unlock()
+		this.handler.Attach(client, string(payload))
+	case OP_DETACH:
+		this.detach(client)
+	case OP_MESSAGE:
+		this.handler.Message(client, msgID, payload)
+	}
+}
+
+// Heartbeat 处理网关的心跳
+func (this *Backend) Heartbeat(fd uint16, sessionID uint16) {
+}
+
+// Close 网关断开后，该网关上的所有客户端都视为离开
+func (this *Backend) Close(fd uint16, info network.CloseInfo) {
+	log.Warn("backend gate closed", fd, info)
+	this.lock.Lock()
+	delete(this.gates, fd)
+	clients := make([]ClientID, 0)
+	for client := range this.clients {
+		if client.gateFd() == fd {
+			clients = append(clients, client)
+		}
+	}
+	this.lock.Unlock()
+
+	for _, client := range clients {
+		this.detach(client)
+	}
+}
+
+// detach 移除客户端并通知处理器
+func (this *Backend) detach(client ClientID) {
+	this.lock.Lock()
+	_, ok := this.clients[client]
+	delete(this.clients, client)
+	this.lock.Unlock()
+	if ok {
+		this.handler.Detach(client)
+	}
+}
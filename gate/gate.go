@@ -0,0 +1,430 @@
+package gate
+
+import (
+	"github.com/lizhen1412/eegos/log"
+	"github.com/lizhen1412/eegos/network"
+	"github.com/lizhen1412/eegos/rpc"
+
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 网关相关的错误
+var (
+	ErrNoRoute       = errors.New("gate: no route for message") // 消息没有匹配的路由
+	ErrNoBackend     = errors.New("gate: backend not found")    // 后端不存在
+	ErrNoClient      = errors.New("gate: client not found")     // 客户端不存在或已断开
+	ErrNotRelay      = errors.New("gate: backend is not a relay backend")
+	ErrBadRpcMessage = errors.New("gate: malformed rpc message")
+)
+
+// msgRoute 将一段消息ID映射到转发后端
+type msgRoute struct {
+	first, last uint16 // 消息ID区间，包含两端
+	backend     string // 后端名称
+}
+
+// backend 表示网关连接的一个后端节点
+type backend struct {
+	name      string             // 后端名称
+	tcpClient *network.TcpClient // 转发后端的连接
+	session   *network.Session   // 转发后端的会话
+	rpcClient *rpc.Client        // rpc 后端的客户端
+}
+
+// client 表示一个接入网关的客户端
+type client struct {
+	relay    sync.Mutex        // 串行化消息转发和迁移，迁移开始后不会再有消息发往旧后端
+	session  *network.Session  // 客户端会话
+	identity string            // 认证后的身份
+	migrated map[string]string // 迁移记录，原后端名称到新后端名称
+	attached map[string]bool   // 已经接入的转发后端
+}
+
+// Gate 是面向客户端的网关。
+// 它接受客户端连接并在会话启动前认证，然后按消息ID把消息转发到转发后端（Backend），
+// 或者按服务名把 rpc 形式的消息调用到 rpc 后端，并把后端的推送送回对应的客户端。
+type Gate struct {
+	tcpServer *network.TcpServer
+	lock      sync.RWMutex        // 保护以下字段
+	backends  map[string]*backend // 后端，以名称作为键
+	msgRoutes []msgRoute          // 消息ID路由
+	services  map[string]string   // 服务名到 rpc 后端名称的路由
+	clients   map[uint16]*client  // 客户端，以会话标识作为键
+}
+
+// NewGate 创建一个网关，客户端在会话启动前由 auth 认证，认证失败或超过 timeout 时连接被关闭，
+// 参见 network.TcpConn.SetAuthenticator。认证器返回的身份转换为字符串后随 OP_ATTACH 发给后端，
+// auth 为 nil 时不认证，客户端身份为空。
+func NewGate(auth network.Authenticator, timeout time.Duration, addrs ...string) *Gate {
+	newGate := &Gate{
+		backends: make(map[string]*backend),
+		services: make(map[string]string),
+		clients:  make(map[uint16]*client),
+	}
+	newGate.tcpServer = network.NewTcpServer(newGate, addrs...)
+	if auth != nil {
+		newGate.tcpServer.SetAuthenticator(auth, timeout)
+	}
+	return newGate
+}
+
+// identityString 把认证器返回的身份转换为字符串
+func identityString(identity interface{}) string {
+	switch v := identity.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	}
+	return fmt.Sprint(identity)
+}
+
+// Start 启动网关，阻塞直到监听器停止
+func (this *Gate) Start() {
+	this.tcpServer.Start()
+}
+
+// AddBackend 连接一个转发后端，后端使用 NewBackend 创建
+func (this *Gate) AddBackend(name string, addr string) error {
+	b := &backend{name: name}
+	b.tcpClient = network.NewTcpClient(&backendHandler{gate: this, backend: b})
+	if err := b.tcpClient.Dial(addr); err != nil {
+		return err
+	}
+	this.lock.Lock()
+	this.backends[name] = b
+	this.lock.Unlock()
+	return nil
+}
+
+// AddRpcBackend 连接一个 rpc 后端（rpc.Server 或 cluster 节点）
+func (this *Gate) AddRpcBackend(name string, addr string) error {
+	b := &backend{name: name, rpcClient: rpc.NewClient()}
+	if err := b.rpcClient.Dial(addr); err != nil {
+		return err
+	}
+	this.lock.Lock()
+	this.backends[name] = b
+	this.lock.Unlock()
+	return nil
+}
+
+// RouteMessage 把消息ID在 [first, last] 区间内的客户端消息转发到转发后端
+func (this *Gate) RouteMessage(first, last uint16, backendName string) {
+	this.lock.Lock()
+	this.msgRoutes = append(this.msgRoutes, msgRoute{first, last, backendName})
+	this.lock.Unlock()
+}
+
+// RouteService 把调用 service 服务的 rpc 形式消息（["Service.Method", args...]）调用到 rpc 后端，
+// 调用结果以相同的消息头返回给客户端
+func (this *Gate) RouteService(service string, backendName string) {
+	this.lock.Lock()
+	this.services[service] = backendName
+	this.lock.Unlock()
+}
+
+// Migrate 把客户端在转发后端 from 上的消息改为发往 to，客户端连接保持不变。
+// from 会收到 OP_DETACH，to 会收到带客户端身份的 OP_ATTACH。
+// 迁移和该客户端的消息转发互斥：迁移前已经转发的消息都在 OP_DETACH 之前到达 from，之后的消息发往 to。
+// OP_DETACH 发送失败时只记录日志，迁移仍然生效。
+func (this *Gate) Migrate(clientFd uint16, from string, to string) error {
+	this.lock.RLock()
+	c, ok := this.clients[clientFd]
+	this.lock.RUnlock()
+	if !ok {
+		return ErrNoClient
+	}
+	c.relay.Lock()
+	defer c.relay.Unlock()
+
+	this.lock.Lock()
+	if _, ok := this.clients[clientFd]; !ok {
+		this.lock.Unlock()
+		return ErrNoClient
+	}
+	target, ok := this.backends[to]
+	if !ok {
+		this.lock.Unlock()
+		return ErrNoBackend
+	}
+	if target.session == nil {
+		this.lock.Unlock()
+		return ErrNotRelay
+	}
+	// 找到客户端当前实际使用的后端，所有指向它的迁移记录都改为指向 to，
+	// 这样多次迁移（A→B，B→C）后原来发往 A 的消息也直接发往 C
+	current := from
+	if m, ok := c.migrated[from]; ok {
+		current = m
+	}
+	c.migrated[from] = to
+	for origin, dest := range c.migrated {
+		if dest == current {
+			c.migrated[origin] = to
+		}
+		if c.migrated[origin] == origin {
+			delete(c.migrated, origin)
+		}
+	}
+	var oldSession *network.Session
+	old := this.backends[current]
+	if c.attached[current] && old != nil {
+		oldSession = old.session
+	}
+	delete(c.attached, current)
+	c.attached[to] = true
+	targetSession := target.session
+	identity := c.identity
+	this.lock.Unlock()
+
+	if oldSession != nil {
+		if err := old.tcpClient.Write(oldSession, 0, packRelay(OP_DETACH, clientFd, nil)); err != nil {
+			log.Warn("gate detach failed", clientFd, old.name, err)
+		}
+	}
+	return target.tcpClient.Write(targetSession, 0, packRelay(OP_ATTACH, clientFd, []byte(identity)))
+}
+
+// Kick 踢出客户端
+func (this *Gate) Kick(clientFd uint16, err error) error {
+	this.lock.RLock()
+	c, ok := this.clients[clientFd]
+	this.lock.RUnlock()
+	if !ok {
+		return ErrNoClient
+	}
+	c.session.Kick(err)
+	return nil
+}
+
+// Identity 返回客户端认证后的身份
+func (this *Gate) Identity(clientFd uint16) (string, bool) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	c, ok := this.clients[clientFd]
+	if !ok {
+		return "", false
+	}
+	return c.identity, true
+}
+
+// Connect 处理客户端新连接，会话已经通过认证
+func (this *Gate) Connect(fd uint16, s *network.Session) {
+	log.Debug("gate new client", fd, s.Listener())
+	// 按顺序转发，保证后端先收到 OP_ATTACH，且同一客户端的消息不会乱序
+	s.SetOrdered(true)
+	this.lock.Lock()
+	this.clients[fd] = &client{
+		session:  s,
+		identity: identityString(s.Identity()),
+		migrated: make(map[string]string),
+		attached: make(map[string]bool),
+	}
+	this.lock.Unlock()
+}
+
+// Heartbeat 处理客户端心跳
+func (this *Gate) Heartbeat(fd uint16, sessionID uint16) {
+}
+
+// Close 处理客户端断开，通知已接入的转发后端
+func (this *Gate) Close(fd uint16, info network.CloseInfo) {
+	this.lock.Lock()
+	c, ok := this.clients[fd]
+	delete(this.clients, fd)
+	detach := make(map[*network.Session]*backend)
+	if ok {
+		for name := range c.attached {
+			if b, ok := this.backends[name]; ok && b.session != nil {
+				detach[b.session] = b
+			}
+		}
+	}
+	this.lock.Unlock()
+
+	log.Debug("gate client closed", fd, info)
+	for s, b := range detach {
+		b.tcpClient.Write(s, 0, packRelay(OP_DETACH, fd, nil))
+	}
+}
+
+// Message 处理客户端消息，按服务名或消息ID路由到后端
+func (this *Gate) Message(fd uint16, msgID uint16, body []byte) {
+	this.lock.RLock()
+	c, ok := this.clients[fd]
+	this.lock.RUnlock()
+	if !ok {
+		return
+	}
+
+	if service, ok := this.rpcService(body); ok {
+		// rpc 调用需要等待结果，不阻塞客户端后续的消息；body 只在本次调用期间有效
+		go this.callService(c, service, msgID, append([]byte{}, body...))
+		return
+	}
+
+	// 选择后端和发送在转发锁内完成，迁移不会插在两者之间
+	c.relay.Lock()
+	defer c.relay.Unlock()
+	b, s, attach, err := this.pickBackend(c, msgID)
+	if err != nil {
+		log.Warn("gate relay failed", fd, msgID, err)
+		return
+	}
+	if attach {
+		b.tcpClient.Write(s, 0, packRelay(OP_ATTACH, fd, []byte(c.identity)))
+	}
+	if err := b.tcpClient.Write(s, msgID, packRelay(OP_MESSAGE, fd, body)); err != nil {
+		log.Warn("gate relay failed", fd, msgID, b.name, err)
+	}
+}
+
+// rpcService 如果消息是路由到 rpc 后端的服务调用，返回服务名
+func (this *Gate) rpcService(body []byte) (string, bool) {
+	this.lock.RLock()
+	hasService := len(this.services) > 0
+	this.lock.RUnlock()
+	if !hasService || len(body) == 0 || body[0] != '[' {
+		return "", false
+	}
+
+	args := []json.RawMessage{}
+	if err := json.Unmarshal(body, &args); err != nil || len(args) == 0 {
+		return "", false
+	}
+	info := ""
+	if err := json.Unmarshal(args[0], &info); err != nil {
+		return "", false
+	}
+	dot := strings.LastIndex(info, ".")
+	if dot < 0 {
+		return "", false
+	}
+
+	this.lock.RLock()
+	_, ok := this.services[info[:dot]]
+	this.lock.RUnlock()
+	return info[:dot], ok
+}
+
+// callService 调用 rpc 后端，并把结果以相同的消息头返回给客户端
+func (this *Gate) callService(c *client, service string, msgID uint16, body []byte) {
+	this.lock.RLock()
+	b, ok := this.backends[this.services[service]]
+	this.lock.RUnlock()
+	if !ok || b.rpcClient == nil {
+		log.Warn("gate service backend not found", service)
+		return
+	}
+
+	args := []interface{}{}
+	if err := json.Unmarshal(body, &args); err != nil {
+		log.Warn("gate rpc message", ErrBadRpcMessage, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), rpc.DefaultCallTimeout)
+	defer cancel()
+	ret, err := b.rpcClient.CallContext(ctx, args)
+	if err != nil {
+		log.Warn("gate rpc call failed", service, err)
+		return
+	}
+	retBody, err := json.Marshal(ret)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	this.tcpServer.Write(c.session, msgID, retBody)
+}
+
+// pickBackend 按消息ID选择转发后端及其会话，考虑客户端的迁移记录；
+// 第三个返回值表示是否需要先向后端发送 OP_ATTACH
+func (this *Gate) pickBackend(c *client, msgID uint16) (*backend, *network.Session, bool, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	name := ""
+	for _, r := range this.msgRoutes {
+		if msgID >= r.first && msgID <= r.last {
+			name = r.backend
+			break
+		}
+	}
+	if name == "" {
+		return nil, nil, false, ErrNoRoute
+	}
+	if m, ok := c.migrated[name]; ok {
+		name = m
+	}
+	b, ok := this.backends[name]
+	if !ok || b.session == nil {
+		return nil, nil, false, ErrNoBackend
+	}
+	attach := !c.attached[name]
+	c.attached[name] = true
+	return b, b.session, attach, nil
+}
+
+// push 把后端的推送送回客户端
+func (this *Gate) push(clientFd uint16, msgID uint16, payload []byte) {
+	this.lock.RLock()
+	c, ok := this.clients[clientFd]
+	this.lock.RUnlock()
+	if !ok {
+		return
+	}
+	if err := this.tcpServer.Write(c.session, msgID, payload); err != nil {
+		log.Warn("gate push failed", clientFd, msgID, err)
+	}
+}
+
+// backendHandler 处理网关与转发后端之间的连接
+type backendHandler struct {
+	gate    *Gate
+	backend *backend
+}
+
+// Connect 记录与转发后端的会话
+func (this *backendHandler) Connect(fd uint16, s *network.Session) {
+	s.SetOrdered(true)
+	this.gate.lock.Lock()
+	this.backend.session = s
+	this.gate.lock.Unlock()
+}
+
+// Message 处理转发后端发来的推送和踢出请求
+func (this *backendHandler) Message(fd uint16, msgID uint16, body []byte) {
+	op, clientFd, payload, err := unpackRelay(body)
+	if err != nil {
+		log.Warn("gate backend message", this.backend.name, err)
+		return
+	}
+	switch op {
+	case OP_PUSH:
+		this.gate.push(clientFd, msgID, payload)
+	case OP_KICK:
+		this.gate.Kick(clientFd, errors.New(string(payload)))
+	}
+}
+
+// Heartbeat 处理转发后端的心跳
+func (this *backendHandler) Heartbeat(fd uint16, sessionID uint16) {
+}
+
+// Close 转发后端断开后，发往该后端的消息会失败直到重新添加
+func (this *backendHandler) Close(fd uint16, info network.CloseInfo) {
+	log.Warn("gate backend closed", this.backend.name, info)
+	this.gate.lock.Lock()
+	this.backend.session = nil
+	this.gate.lock.Unlock()
+}
@@ -0,0 +1,352 @@
+package gate
+
+import (
+	"github.com/lizhen1412/eegos/network"
+	"github.com/lizhen1412/eegos/rpc"
+
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 测试中等待事件的超时时间
+const testTimeout = 5 * time.Second
+
+// backendEvent 转发后端收到的一个事件
+type backendEvent struct {
+	kind    string // "attach"、"message" 或 "detach"
+	client  ClientID
+	msgID   uint16
+	payload string
+}
+
+// testBackend 把后端事件转发到通道的 BackendHandler
+type testBackend struct {
+	*Backend
+	events chan backendEvent
+}
+
+func (this *testBackend) Attach(client ClientID, identity string) {
+	this.events <- backendEvent{kind: "attach", client: client, payload: identity}
+}
+
+func (this *testBackend) Message(client ClientID, msgID uint16, body []byte) {
+	this.events <- backendEvent{kind: "message", client: client, msgID: msgID, payload: string(body)}
+}
+
+func (this *testBackend) Detach(client ClientID) {
+	this.events <- backendEvent{kind: "detach", client: client}
+}
+
+// wait 等待下一个事件并检查类型
+func (this *testBackend) wait(t *testing.T, kind string) backendEvent {
+	t.Helper()
+	select {
+	case e := <-this.events:
+		if e.kind != kind {
+			t.Fatalf("backend event = %+v, want %s", e, kind)
+		}
+		return e
+	case <-time.After(testTimeout):
+		t.Fatalf("timed out waiting for %s", kind)
+		return backendEvent{}
+	}
+}
+
+// testClient 客户端的处理器
+type testClient struct {
+	session  *network.Session
+	messages chan string
+	closed   chan network.CloseInfo
+}
+
+func (this *testClient) Connect(fd uint16, s *network.Session) { this.session = s }
+func (this *testClient) Message(fd, msgID uint16, body []byte) {
+	this.messages <- string(body)
+}
+func (this *testClient) Heartbeat(fd, msgID uint16)              {}
+func (this *testClient) Close(fd uint16, info network.CloseInfo) { this.closed <- info }
+
+// memAddress 返回测试专用的进程内地址
+func memAddress(t *testing.T, name string) string {
+	return "mem://" + strings.ReplaceAll(t.Name(), "/", "-") + "-" + name
+}
+
+// waitListening 等待服务器开始监听，测试结束时停止接受连接
+func waitListening(t *testing.T, srv *network.TcpServer) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for len(srv.Addrs()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("server did not start")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Cleanup(srv.StopAccept)
+}
+
+// startBackend 启动一个转发后端并让网关以 name 连接它
+func startBackend(t *testing.T, g *Gate, name string) *testBackend {
+	t.Helper()
+	handler := &testBackend{events: make(chan backendEvent, 64)}
+	handler.Backend = NewBackend(handler, memAddress(t, name))
+	go handler.Start()
+	waitListening(t, handler.tcpServer)
+	if err := g.AddBackend(name, memAddress(t, name)); err != nil {
+		t.Fatal(err)
+	}
+	return handler
+}
+
+// tokenAuth 接受除 "bad" 以外的令牌，令牌本身作为身份
+var tokenAuth = network.TokenAuthenticator(func(token []byte) (interface{}, error) {
+	if string(token) == "bad" {
+		return nil, errors.New("bad token")
+	}
+	return string(token), nil
+})
+
+// startGate 启动使用令牌认证的网关
+func startGate(t *testing.T) *Gate {
+	t.Helper()
+	g := NewGate(tokenAuth, time.Second, memAddress(t, "gate"))
+	go g.Start()
+	waitListening(t, g.tcpServer)
+	return g
+}
+
+// dialGate 用令牌连接网关
+func dialGate(t *testing.T, token string) (*network.TcpClient, *testClient, error) {
+	h := &testClient{messages: make(chan string, 64), closed: make(chan network.CloseInfo, 4)}
+	c := network.NewTcpClient(h)
+	c.SetAuthenticator(network.TokenCredential([]byte(token)), time.Second)
+	if err := c.Dial(memAddress(t, "gate")); err != nil {
+		return nil, nil, err
+	}
+	t.Cleanup(c.Close)
+	return c, h, nil
+}
+
+// send 向网关发送一个消息
+func send(t *testing.T, c *network.TcpClient, h *testClient, msgID uint16, body string) {
+	t.Helper()
+	if err := c.Write(h.session, msgID, []byte(body)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRouteAndPush(t *testing.T) {
+	g := startGate(t)
+	a := startBackend(t, g, "a")
+	g.RouteMessage(1, 99, "a")
+
+	c, h, err := dialGate(t, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	send(t, c, h, 5, "hi")
+	attach := a.wait(t, "attach")
+	if attach.payload != "alice" {
+		t.Fatalf("attach identity = %q, want alice", attach.payload)
+	}
+	if m := a.wait(t, "message"); m.msgID != 5 || m.payload != "hi" || m.client != attach.client {
+		t.Fatalf("message = %+v", m)
+	}
+	if id, ok := g.Identity(attach.client.clientFd()); !ok || id != "alice" {
+		t.Fatalf("Identity = %q, %v", id, ok)
+	}
+
+	// 没有路由的消息被丢弃
+	send(t, c, h, 200, "lost")
+
+	if err := a.Push(attach.client, 7, []byte("yo")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case body := <-h.messages:
+		if body != "yo" {
+			t.Fatalf("push = %q, want yo", body)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("push not delivered")
+	}
+}
+
+// Lobby 测试使用的 rpc 服务
+type Lobby struct{}
+
+func (this *Lobby) Join(name string) string { return "welcome " + name }
+
+func TestRouteService(t *testing.T) {
+	g := startGate(t)
+	server := rpc.NewServer(memAddress(t, "rpc"))
+	server.Register(new(Lobby))
+	go server.Start()
+	deadline := time.Now().Add(testTimeout)
+	for g.AddRpcBackend("lobby", memAddress(t, "rpc")) != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("rpc backend did not start")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	g.RouteService("Lobby", "lobby")
+
+	c, h, err := dialGate(t, "dave")
+	if err != nil {
+		t.Fatal(err)
+	}
+	send(t, c, h, 9, `["Lobby.Join","dave"]`)
+	select {
+	case body := <-h.messages:
+		if body != `["welcome dave"]` {
+			t.Fatalf("rpc reply = %s", body)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("rpc reply not delivered")
+	}
+}
+
+func TestAuthRejected(t *testing.T) {
+	startGate(t)
+	if _, _, err := dialGate(t, "bad"); !errors.Is(err, network.ErrAuthFailed) {
+		t.Fatalf("Dial with bad token = %v, want ErrAuthFailed", err)
+	}
+}
+
+func TestMigrateChain(t *testing.T) {
+	g := startGate(t)
+	a := startBackend(t, g, "a")
+	b := startBackend(t, g, "b")
+	cc := startBackend(t, g, "c")
+	g.RouteMessage(1, 99, "a")
+
+	c, h, err := dialGate(t, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	send(t, c, h, 1, "first")
+	client := a.wait(t, "attach").client
+	a.wait(t, "message")
+
+	fd := client.clientFd()
+	if err := g.Migrate(fd, "a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	a.wait(t, "detach")
+	b.wait(t, "attach")
+
+	// 第二次迁移以 b 作为来源，原来路由到 a 的消息也要跟随到 c
+	if err := g.Migrate(fd, "b", "c"); err != nil {
+		t.Fatal(err)
+	}
+	b.wait(t, "detach")
+	if e := cc.wait(t, "attach"); e.payload != "bob" {
+		t.Fatalf("attach identity = %q, want bob", e.payload)
+	}
+
+	send(t, c, h, 2, "second")
+	if m := cc.wait(t, "message"); m.payload != "second" {
+		t.Fatalf("message = %+v", m)
+	}
+	for _, h := range []*testBackend{a, b} {
+		select {
+		case e := <-h.events:
+			t.Fatalf("stale backend got %+v", e)
+		default:
+		}
+	}
+
+	if err := g.Migrate(fd, "a", "missing"); err != ErrNoBackend {
+		t.Fatalf("Migrate to unknown backend = %v, want ErrNoBackend", err)
+	}
+}
+
+// TestMigrateDuringRelay 迁移和消息转发同时进行时，旧后端在 OP_DETACH 之后不再收到消息，
+// 两个后端收到的消息合起来不重复、不丢失并保持顺序
+func TestMigrateDuringRelay(t *testing.T) {
+	g := startGate(t)
+	a := startBackend(t, g, "a")
+	b := startBackend(t, g, "b")
+	g.RouteMessage(1, 1, "a")
+
+	c, h, err := dialGate(t, "carol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const count = 200
+	go func() {
+		for i := 0; i < count; i++ {
+			if err := c.Write(h.session, 1, []byte(fmt.Sprint(i))); err != nil {
+				return
+			}
+		}
+	}()
+	client := a.wait(t, "attach").client
+
+	got := []string{a.wait(t, "message").payload}
+	if err := g.Migrate(client.clientFd(), "a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	for detached := false; !detached; {
+		select {
+		case e := <-a.events:
+			switch e.kind {
+			case "message":
+				got = append(got, e.payload)
+			case "detach":
+				detached = true
+			default:
+				t.Fatalf("old backend got %+v", e)
+			}
+		case <-time.After(testTimeout):
+			t.Fatal("timed out waiting for detach")
+		}
+	}
+	b.wait(t, "attach")
+	for len(got) < count {
+		got = append(got, b.wait(t, "message").payload)
+	}
+	for i, m := range got {
+		if m != fmt.Sprint(i) {
+			t.Fatalf("message %d = %s, want %d", i, m, i)
+		}
+	}
+	select {
+	case e := <-a.events:
+		t.Fatalf("old backend got %+v after detach", e)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestBackendKick(t *testing.T) {
+	g := startGate(t)
+	a := startBackend(t, g, "a")
+	g.RouteMessage(1, 99, "a")
+
+	c, h, err := dialGate(t, "carol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	send(t, c, h, 1, "hello")
+	client := a.wait(t, "attach").client
+	a.wait(t, "message")
+
+	if err := a.Kick(client, "cheating"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-h.closed:
+	case <-time.After(testTimeout):
+		t.Fatal("client not kicked")
+	}
+	// 网关通知后端客户端离开，并且不再记录该客户端
+	a.wait(t, "detach")
+	if _, ok := g.Identity(client.clientFd()); ok {
+		t.Fatal("kicked client still registered")
+	}
+	if err := g.Kick(client.clientFd(), nil); err != ErrNoClient {
+		t.Fatalf("Kick after close = %v, want ErrNoClient", err)
+	}
+}
@@ -0,0 +1,37 @@
+package gate
+
+import (
+	"errors"
+)
+
+// 网关与后端之间的转发操作类型
+const (
+	OP_ATTACH  = iota + 1 // 客户端接入后端，负载为客户端身份
+	OP_DETACH             // 客户端离开后端（断开或迁移）
+	OP_MESSAGE            // 客户端发往后端的消息
+	OP_PUSH               // 后端推送给客户端的消息
+	OP_KICK               // 后端要求网关踢出客户端
+)
+
+// 转发头的长度：操作类型 1 字节，客户端标识 2 字节
+const relayHeadSize = 3
+
+// ErrBadRelay 表示收到了无法解析的转发消息
+var ErrBadRelay = errors.New("gate: malformed relay message")
+
+// packRelay 打包转发消息，消息ID放在会话消息头中，这里只打包操作类型、客户端标识和负载
+func packRelay(op uint8, client uint16, payload []byte) []byte {
+	body := make([]byte, 0, relayHeadSize+len(payload))
+	body = append(body, op, uint8(client), uint8(client>>8))
+	return append(body, payload...)
+}
+
+// unpackRelay 解析转发消息，返回的负载引用 body 的内存
+func unpackRelay(body []byte) (op uint8, client uint16, payload []byte, err error) {
+	if len(body) < relayHeadSize {
+		return 0, 0, nil, ErrBadRelay
+	}
+	op = body[0]
+	client = uint16(body[1]) + uint16(body[2])<<8
+	return op, client, body[relayHeadSize:], nil
+}
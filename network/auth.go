@@ -0,0 +1,246 @@
+package network
+
+import (
+	"github.com/lizhen1412/eegos/log"
+
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// 认证的错误
+var (
+	ErrAuthFailed  = errors.New("network: authentication failed")
+	ErrAuthTimeout = errors.New("network: authentication timed out")
+)
+
+// 默认的认证超时时间
+const DefaultAuthTimeout = 10 * time.Second
+
+// AuthConn 认证期间收发认证消息的连接，消息以 AUTH 类型的消息包传输
+type AuthConn interface {
+	// Send 向对端发送一个认证消息
+	Send(body []byte) error
+	// Recv 接收对端的下一个认证消息，收到非认证消息时返回 ErrAuthFailed
+	Recv() ([]byte, error)
+	// RemoteAddr 返回对端地址，连接不是 net.Conn 时返回 nil
+	RemoteAddr() net.Addr
+}
+
+// Authenticator 在会话启动之前运行认证交换，例如令牌校验或挑战应答。
+// 服务端返回的身份会附加到会话上，通过 Session.Identity 获取；客户端返回的身份被忽略。
+// 服务端返回错误时，错误描述会作为失败原因发给对端，不应包含敏感信息。
+type Authenticator interface {
+	Authenticate(conn AuthConn) (identity interface{}, err error)
+}
+
+// AuthFunc 让普通函数满足 Authenticator 接口
+type AuthFunc func(conn AuthConn) (interface{}, error)
+
+// Authenticate 调用函数本身
+func (this AuthFunc) Authenticate(conn AuthConn) (interface{}, error) {
+	return this(conn)
+}
+
+// TokenAuthenticator 返回服务端的令牌认证器，接收对端发来的一个令牌并用 verify 校验，
+// verify 返回的身份附加到会话上
+func TokenAuthenticator(verify func(token []byte) (interface{}, error)) Authenticator {
+	return AuthFunc(func(conn AuthConn) (interface{}, error) {
+		token, err := conn.Recv()
+		if err != nil {
+			return nil, err
+		}
+		return verify(token)
+	})
+}
+
+// TokenCredential 返回客户端的令牌认证器，向服务端发送 token
+func TokenCredential(token []byte) Authenticator {
+	token = append([]byte{}, token...)
+	return AuthFunc(func(conn AuthConn) (interface{}, error) {
+		return nil, conn.Send(token)
+	})
+}
+
+// authConfig 认证设置
+type authConfig struct {
+	auth    Authenticator
+	timeout time.Duration
+}
+
+// SetAuthenticator 设置之后建立的连接在会话启动之前运行的认证器，两端需要同时设置。
+// 服务端在认证通过之后才通知 Handler.Connect，认证失败或超过 timeout 时关闭连接，
+// 不通知处理器，统计到 "session.abort.auth_failed"；客户端认证失败时 Dial 返回错误。
+// timeout 小于等于 0 时使用 DefaultAuthTimeout，auth 为 nil 时取消认证。
+func (this *TcpConn) SetAuthenticator(auth Authenticator, timeout time.Duration) {
+	if auth == nil {
+		this.auth = nil
+		return
+	}
+	if timeout <= 0 {
+		timeout = DefaultAuthTimeout
+	}
+	this.auth = &authConfig{auth: auth, timeout: timeout}
+}
+
+// Identity 返回服务端认证时附加到会话上的身份，没有认证时返回 nil。
+// 恢复的会话保留第一次认证的身份。
+func (this *Session) Identity() interface{} {
+	return this.identity
+}
+
+// authConn 在会话启动前直接读写连接，每次只读取一个完整的消息包，不会多读后续数据
+type authConn struct {
+	conn   io.ReadWriter
+	header [5]byte
+	result []byte // 客户端提前收到的认证结果
+	done   bool   // 是否已收到认证结果
+}
+
+// Send 向对端发送一个认证消息
+func (this *authConn) Send(body []byte) error {
+	if len(body) > maxBodySize {
+		return ErrTooLarge
+	}
+	_, err := this.conn.Write(packFrame(0, AUTH, body))
+	return err
+}
+
+// Recv 接收对端的下一个认证消息
+func (this *authConn) Recv() ([]byte, error) {
+	if this.done {
+		return nil, authResultError(this.result)
+	}
+	dType, body, err := this.read()
+	if err != nil {
+		return nil, err
+	}
+	switch dType {
+	case AUTH:
+		return body, nil
+	case AUTH_RET:
+		// 服务端提前给出了结果，通过时对端不会再发送认证消息
+		this.result, this.done = body, true
+		return nil, authResultError(body)
+	}
+	return nil, fmt.Errorf("%w: unexpected message type %d", ErrAuthFailed, dType)
+}
+
+// RemoteAddr 返回对端地址
+func (this *authConn) RemoteAddr() net.Addr {
+	if conn, ok := this.conn.(net.Conn); ok {
+		return conn.RemoteAddr()
+	}
+	return nil
+}
+
+// read 读取一个完整的消息包
+func (this *authConn) read() (uint8, []byte, error) {
+	if _, err := io.ReadFull(this.conn, this.header[:]); err != nil {
+		return 0, nil, err
+	}
+	body := make([]byte, int(this.header[0])+int(this.header[1])<<8)
+	if _, err := io.ReadFull(this.conn, body); err != nil {
+		return 0, nil, err
+	}
+	return this.header[2], body, nil
+}
+
+// authResultError 将认证结果转换为错误，结果为空表示通过
+func authResultError(result []byte) error {
+	if len(result) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrAuthFailed, result)
+}
+
+// authAccept 服务端在会话启动前运行认证器并把结果发给对端，返回对端的身份
+func (this *TcpConn) authAccept(conn io.ReadWriter) (interface{}, error) {
+	ac := &authConn{conn: conn}
+	var identity interface{}
+	err := this.withAuthDeadline(conn, func() error {
+		var err error
+		identity, err = this.auth.auth.Authenticate(ac)
+		if err != nil {
+			// 连接已经出错时不再发送结果
+			if !errors.Is(err, ErrAuthTimeout) && !isNetError(err) {
+				msg := []byte(err.Error())
+				if len(msg) > maxBodySize {
+					msg = msg[:maxBodySize]
+				}
+				if len(msg) == 0 {
+					msg = []byte(ErrAuthFailed.Error())
+				}
+				conn.Write(packFrame(0, AUTH_RET, msg))
+			}
+			return err
+		}
+		_, err = conn.Write(packFrame(0, AUTH_RET, nil))
+		return err
+	})
+	return identity, err
+}
+
+// authDial 客户端在会话启动前运行认证器并等待服务端的认证结果
+func (this *TcpConn) authDial(conn io.ReadWriter) error {
+	ac := &authConn{conn: conn}
+	return this.withAuthDeadline(conn, func() error {
+		if _, err := this.auth.auth.Authenticate(ac); err != nil {
+			return err
+		}
+		if ac.done {
+			return authResultError(ac.result)
+		}
+		dType, body, err := ac.read()
+		if err != nil {
+			return err
+		}
+		if dType != AUTH_RET {
+			return fmt.Errorf("%w: unexpected message type %d", ErrAuthFailed, dType)
+		}
+		return authResultError(body)
+	})
+}
+
+// withAuthDeadline 在认证超时时间内运行 fn，超时的错误转换为 ErrAuthTimeout
+func (this *TcpConn) withAuthDeadline(conn io.ReadWriter, fn func() error) error {
+	if deadline, ok := conn.(interface{ SetDeadline(time.Time) error }); ok {
+		deadline.SetDeadline(time.Now().Add(this.auth.timeout))
+		defer deadline.SetDeadline(time.Time{})
+	}
+	err := fn()
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return ErrAuthTimeout
+	}
+	return err
+}
+
+// isNetError 判断错误是否来自连接本身
+func isNetError(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// rejectAuth 服务端认证失败时关闭连接，不通知处理器
+func rejectAuth(conn io.Closer, addr string, err error) {
+	log.Warn("session auth failed", addr, err)
+	metrics.add("session.abort."+CLOSE_AUTH_FAILED.String(), 1)
+	conn.Close()
+}
+
+// sameIdentity 比较两次认证的身份，无法比较的类型视为不同
+func sameIdentity(a, b interface{}) (same bool) {
+	defer func() {
+		if recover() != nil {
+			same = false
+		}
+	}()
+	if x, ok := a.([]byte); ok {
+		y, ok := b.([]byte)
+		return ok && bytes.Equal(x, y)
+	}
+	return a == b
+}
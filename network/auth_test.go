@@ -0,0 +1,99 @@
+package network
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+var errBadToken = errors.New("unknown token")
+
+// tokenServer 启动使用令牌认证的服务端，令牌 "alice" 以外的都被拒绝
+func tokenServer(t *testing.T, timeout time.Duration) *testHandler {
+	t.Helper()
+	sh := newTestHandler()
+	srv := NewTcpServer(sh, memAddress(t))
+	srv.SetAuthenticator(TokenAuthenticator(func(token []byte) (interface{}, error) {
+		if string(token) != "alice" {
+			return nil, errBadToken
+		}
+		return "user:" + string(token), nil
+	}), timeout)
+	startServer(t, srv, 1)
+	return sh
+}
+
+// TestAuthToken 令牌认证通过后才通知 Connect，身份附加到服务端会话上
+func TestAuthToken(t *testing.T) {
+	sh := tokenServer(t, 0)
+	ch := newTestHandler()
+	c := NewTcpClient(ch)
+	c.SetAuthenticator(TokenCredential([]byte("alice")), 0)
+	cs := dialClient(t, c, ch, memAddress(t))
+	ss := sh.waitConnect(t)
+	if id := ss.Identity(); id != "user:alice" {
+		t.Fatalf("server identity = %v, want user:alice", id)
+	}
+	if id := cs.Identity(); id != nil {
+		t.Fatalf("client identity = %v, want nil", id)
+	}
+	if err := c.Write(cs, 1, []byte("after auth")); err != nil {
+		t.Fatal(err)
+	}
+	if m := sh.waitMessage(t); string(m.body) != "after auth" {
+		t.Fatalf("server got %q", m.body)
+	}
+}
+
+// TestAuthRejected 认证失败时客户端收到服务端给出的原因，服务端不通知处理器
+func TestAuthRejected(t *testing.T) {
+	sh := tokenServer(t, 0)
+	before := Metrics()["session.abort.auth_failed"]
+	ch := newTestHandler()
+	c := NewTcpClient(ch)
+	c.SetAuthenticator(TokenCredential([]byte("mallory")), 0)
+	err := c.Dial(memAddress(t))
+	if !errors.Is(err, ErrAuthFailed) || !strings.Contains(err.Error(), errBadToken.Error()) {
+		t.Fatalf("Dial = %v, want ErrAuthFailed with %q", err, errBadToken)
+	}
+	waitFor(t, "auth failure metric", func() bool { return Metrics()["session.abort.auth_failed"] > before })
+	select {
+	case s := <-sh.connect:
+		t.Fatalf("Connect called for rejected session %d", s.fd)
+	default:
+	}
+}
+
+// TestAuthTimeout 对端在超时时间内没有完成认证时，两端都得到 ErrAuthTimeout
+func TestAuthTimeout(t *testing.T) {
+	const timeout = 50 * time.Millisecond
+	t.Run("client", func(t *testing.T) {
+		// 服务端不回复认证结果
+		addr := listenLocal(t, func(conn net.Conn) {
+			defer conn.Close()
+			io.Copy(io.Discard, conn)
+		})
+		c := NewTcpClient(newTestHandler())
+		c.SetAuthenticator(TokenCredential([]byte("alice")), timeout)
+		if err := c.Dial(addr); err != ErrAuthTimeout {
+			t.Fatalf("Dial = %v, want ErrAuthTimeout", err)
+		}
+	})
+	t.Run("server", func(t *testing.T) {
+		srv := NewTcpServer(newTestHandler(), memAddress(t))
+		srv.SetAuthenticator(TokenAuthenticator(func(token []byte) (interface{}, error) { return nil, nil }), timeout)
+		// 客户端不发送令牌
+		client, server := net.Pipe()
+		defer client.Close()
+		done := asyncErr(func() error {
+			_, err := srv.authAccept(server)
+			return err
+		})
+		if err := waitErr(t, done); err != ErrAuthTimeout {
+			t.Fatalf("authAccept = %v, want ErrAuthTimeout", err)
+		}
+	})
+}
@@ -0,0 +1,121 @@
+package network
+
+import (
+	"errors"
+	"hash/crc32"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrCorruptFrame 表示收到的消息包校验和不匹配，会话被断开
+var ErrCorruptFrame = errors.New("network: corrupt frame")
+
+// 握手中校验算法的取值
+const checksumCRC32C = 1
+
+// 校验和尾部的长度
+const checksumSize = 4
+
+// crcTable CRC32C（Castagnoli）查找表
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// checksumState 会话的校验和状态。
+// 双方都启用时在握手中协商，每个方向在本端写出或读到 HANDSHAKE_RET 之后，
+// 消息包的消息体之后附加 4 字节的 CRC32C，覆盖消息头和消息体；消息头中的长度不包括校验和。
+type checksumState struct {
+	enabled bool        // 握手协商后启用，在写出握手响应之前设置
+	reading bool        // 读到握手响应后开始校验收到的消息包，只在读协程中访问
+	writing atomic.Bool // 写出握手响应后开始为发送的消息包附加校验和
+	lock    sync.Mutex  // 直接写连接时保证校验状态的切换和写入的顺序一致
+}
+
+// SetChecksum 设置之后建立的会话是否在握手中协商 CRC32C 校验和，需要两端都启用才生效。
+// 校验和不匹配时以 CLOSE_CORRUPT_FRAME 关闭会话，次数统计到 "session.checksum.corrupt"。
+func (this *TcpConn) SetChecksum(enable bool) {
+	this.checksum = enable
+}
+
+// offerChecksum 客户端在握手请求中申请校验和
+func (this *Session) offerChecksum(offer hsOptions) {
+	if this.checksum {
+		offer[HS_CHECKSUM] = []byte{checksumCRC32C}
+	}
+}
+
+// acceptChecksum 服务端处理握手请求中的校验和申请
+func (this *Session) acceptChecksum(offer, ret hsOptions) {
+	value, ok := offer[HS_CHECKSUM]
+	if !ok || !this.checksum || len(value) != 1 || value[0] != checksumCRC32C {
+		return
+	}
+	this.crc.enabled = true
+	ret[HS_CHECKSUM] = []byte{checksumCRC32C}
+}
+
+// finishChecksum 客户端处理握手响应中的校验和，此后收到的消息包需要校验
+func (this *Session) finishChecksum(ret hsOptions) {
+	value, ok := ret[HS_CHECKSUM]
+	if !ok || !this.checksum || len(value) != 1 || value[0] != checksumCRC32C {
+		return
+	}
+	this.crc.enabled = true
+	this.crc.reading = true
+}
+
+// readChecksum 读取消息包的校验和并与消息头和消息体比较，调用方刚用 readPacket 读出 pkg
+func (this *Session) readChecksum(pkg *Data) error {
+	var trailer [checksumSize]byte
+	if _, err := io.ReadFull(this.reader, trailer[:]); err != nil {
+		return err
+	}
+	sum := crc32.Update(crc32.Checksum(this.header[:], crcTable), crcTable, pkg.body)
+	if sum != decodeUint32(trailer[:]) {
+		metrics.add("session.checksum.corrupt", 1)
+		return ErrCorruptFrame
+	}
+	return nil
+}
+
+// writePacket 将消息包写到连接上，启用校验和时附加校验和；写出握手响应后开始附加校验和
+func (this *Session) writePacket(pkg []byte) error {
+	if this.direct {
+		// 直接写连接时可能有多个协程同时写入
+		this.crc.lock.Lock()
+		defer this.crc.lock.Unlock()
+	}
+	out := pkg
+	if this.crc.writing.Load() {
+		out = withChecksum(pkg)
+	}
+	_, err := this.conn.Write(out)
+	if err == nil && pkg[2] == HANDSHAKE_RET && this.crc.enabled {
+		this.crc.writing.Store(true)
+	}
+	return err
+}
+
+// withChecksum 返回附加了校验和的消息包，广播时已经附加过校验和的消息包原样返回。
+// 消息头中的长度不包括校验和，据此判断是否已经附加。
+func withChecksum(pkg []byte) []byte {
+	if len(pkg) > 5+int(pkg[0])+int(pkg[1])<<8 {
+		return pkg
+	}
+	return appendChecksum(pkg)
+}
+
+// appendChecksum 返回附加了校验和的消息包副本，原消息包可能被多个会话共享
+func appendChecksum(pkg []byte) []byte {
+	out := make([]byte, len(pkg), len(pkg)+checksumSize)
+	copy(out, pkg)
+	return append(out, encodeUint32(crc32.Checksum(pkg, crcTable))...)
+}
+
+// verifyChecksum 校验连续内存中的消息包 frame 及其后的校验和 trailer
+func verifyChecksum(frame, trailer []byte) bool {
+	if crc32.Checksum(frame, crcTable) == decodeUint32(trailer) {
+		return true
+	}
+	metrics.add("session.checksum.corrupt", 1)
+	return false
+}
@@ -0,0 +1,90 @@
+package network
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+// corruptConn 在 corrupt 置位后翻转每次写入的最后一个字节
+type corruptConn struct {
+	net.Conn
+	corrupt *atomic.Bool
+}
+
+func (this *corruptConn) Write(b []byte) (int, error) {
+	if this.corrupt.Load() && len(b) > 0 {
+		b = append([]byte{}, b...)
+		b[len(b)-1] ^= 0xff
+	}
+	return this.Conn.Write(b)
+}
+
+// checksumPair 连接启用校验和的服务端和客户端，客户端写出的数据可以被破坏
+func checksumPair(t *testing.T, server, client bool) (*testHandler, *Session, *TcpClient, *Session, *atomic.Bool) {
+	t.Helper()
+	sh := newTestHandler()
+	srv := NewTcpServer(sh, memAddress(t))
+	srv.SetChecksum(server)
+	startServer(t, srv, 1)
+
+	corrupt := new(atomic.Bool)
+	ch := newTestHandler()
+	c := NewTcpClient(ch)
+	c.SetChecksum(client)
+	c.SetConnWrapper(func(conn net.Conn) net.Conn { return &corruptConn{Conn: conn, corrupt: corrupt} })
+	cs := dialClient(t, c, ch, memAddress(t))
+	ss := sh.waitConnect(t)
+
+	// 交换一次消息，保证握手已经完成
+	if err := c.Write(cs, 1, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if m := sh.waitMessage(t); string(m.body) != "hello" {
+		t.Fatalf("server got %q", m.body)
+	}
+	if server && client {
+		// 客户端写出握手确认后才开始附加校验和
+		waitFor(t, "client checksum", cs.crc.writing.Load)
+	}
+	return sh, ss, c, cs, corrupt
+}
+
+func TestChecksumNegotiation(t *testing.T) {
+	cases := []struct {
+		name           string
+		server, client bool
+	}{
+		{"both", true, true},
+		{"server only", true, false},
+		{"client only", false, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, ss, _, cs, _ := checksumPair(t, c.server, c.client)
+			want := c.server && c.client
+			if ss.crc.enabled != want || cs.crc.writing.Load() != want {
+				t.Fatalf("checksum server=%v client=%v, want %v", ss.crc.enabled, cs.crc.writing.Load(), want)
+			}
+		})
+	}
+}
+
+func TestChecksumCorruptFrame(t *testing.T) {
+	sh, _, c, cs, corrupt := checksumPair(t, true, true)
+	before := Metrics()["session.checksum.corrupt"]
+
+	corrupt.Store(true)
+	c.Write(cs, 2, []byte("garbled"))
+	if info := sh.waitClose(t); info.Reason != CLOSE_CORRUPT_FRAME || info.Err != ErrCorruptFrame {
+		t.Fatalf("server close = %v, want corrupt_frame", info)
+	}
+	if Metrics()["session.checksum.corrupt"] == before {
+		t.Fatal("session.checksum.corrupt not counted")
+	}
+	select {
+	case m := <-sh.message:
+		t.Fatalf("corrupt frame delivered: %q", m.body)
+	default:
+	}
+}
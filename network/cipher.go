@@ -0,0 +1,338 @@
+package network
+
+import (
+	"github.com/lizhen1412/eegos/log"
+
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// 会话加密的错误
+var (
+	ErrCipherFailed  = errors.New("network: cipher key exchange failed") // 密钥交换失败，通常是两端的预共享密钥不同
+	ErrDecryptFailed = errors.New("network: decrypt failed")             // 加密记录无法解密，数据被篡改、重放或乱序
+	ErrWeakKey       = errors.New("network: pre-shared key too short")   // 预共享密钥短于 MinCipherKeySize
+)
+
+// 预共享密钥的最小长度
+const MinCipherKeySize = 16
+
+// 密钥交换的默认超时时间
+const DefaultCipherTimeout = 10 * time.Second
+
+// 密钥交换消息的版本
+const cipherVersion = 1
+
+// 加密记录的最大长度，记录长度用 2 字节表示
+const maxRecordSize = 65535
+
+// 每个加密记录中明文的最大长度
+const maxRecordPlain = maxRecordSize - 16
+
+// cipherConfig 会话加密设置
+type cipherConfig struct {
+	psk     []byte
+	timeout time.Duration
+}
+
+// SetCipher 设置之后建立的连接在认证和会话启动之前用预共享密钥 psk 协商会话密钥，两端需要同时设置。
+// 双方交换临时的 X25519 公钥并用 psk 的 HMAC 互相验证，之后连接上的所有数据按 AES-256-GCM 加密，
+// 每个方向使用独立的密钥和递增的序号作为 nonce，重放、乱序或篡改的记录会导致会话以 CLOSE_CORRUPT_FRAME 关闭。
+// 加密在处理器之下完成，对 Handler 透明；断线恢复的连接会重新协商密钥。
+// 密钥交换是连接建立后的第一步，不经过握手协商，两端必须同时设置相同的 psk：
+// 只有服务端设置时客户端的第一个消息不是密钥交换消息，服务端关闭连接；
+// 只有客户端设置时服务端把密钥交换消息当作普通消息，客户端等待响应超时后 Dial 返回 ErrCipherFailed。
+// 服务端协商失败时关闭连接，不通知处理器，统计到 "session.abort.cipher_failed"；客户端协商失败时 Dial 返回 ErrCipherFailed。
+// psk 为空时取消加密，短于 MinCipherKeySize 时返回 ErrWeakKey。
+func (this *TcpConn) SetCipher(psk []byte) error {
+	if len(psk) == 0 {
+		this.cipher = nil
+		return nil
+	}
+	if len(psk) < MinCipherKeySize {
+		return ErrWeakKey
+	}
+	this.cipher = &cipherConfig{psk: append([]byte{}, psk...), timeout: DefaultCipherTimeout}
+	return nil
+}
+
+// acceptCipher 服务端在连接上完成密钥交换，返回协商的记录加密状态
+func (this *TcpConn) acceptCipher(conn io.ReadWriter) (*frameCipher, error) {
+	var fc *frameCipher
+	err := this.withCipherDeadline(conn, func() error {
+		dType, body, err := (&authConn{conn: conn}).read()
+		if err != nil {
+			return err
+		}
+		if dType != CIPHER || len(body) != 1+32+sha256.Size || body[0] != cipherVersion {
+			return ErrCipherFailed
+		}
+		clientPub := body[1:33]
+		if !hmac.Equal(body[33:], this.cipher.mac("client", clientPub)) {
+			return ErrCipherFailed
+		}
+
+		key, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		serverPub := key.PublicKey().Bytes()
+		ret := append(append([]byte{}, serverPub...), this.cipher.mac("server", clientPub, serverPub)...)
+		if _, err := conn.Write(packFrame(0, CIPHER, ret)); err != nil {
+			return err
+		}
+		fc, err = this.cipher.derive(key, clientPub, serverPub, false)
+		return err
+	})
+	return fc, err
+}
+
+// dialCipher 客户端在连接上完成密钥交换，返回协商的记录加密状态
+func (this *TcpConn) dialCipher(conn io.ReadWriter) (*frameCipher, error) {
+	var fc *frameCipher
+	err := this.withCipherDeadline(conn, func() error {
+		key, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		clientPub := key.PublicKey().Bytes()
+		body := append([]byte{cipherVersion}, clientPub...)
+		body = append(body, this.cipher.mac("client", clientPub)...)
+		if _, err := conn.Write(packFrame(0, CIPHER, body)); err != nil {
+			return err
+		}
+
+		// 服务端验证失败时直接关闭连接
+		dType, ret, err := (&authConn{conn: conn}).read()
+		if err != nil {
+			return ErrCipherFailed
+		}
+		if dType != CIPHER || len(ret) != 32+sha256.Size {
+			return ErrCipherFailed
+		}
+		serverPub := ret[:32]
+		if !hmac.Equal(ret[32:], this.cipher.mac("server", clientPub, serverPub)) {
+			return ErrCipherFailed
+		}
+		fc, err = this.cipher.derive(key, clientPub, serverPub, true)
+		return err
+	})
+	return fc, err
+}
+
+// withCipherDeadline 在密钥交换超时时间内运行 fn
+func (this *TcpConn) withCipherDeadline(conn io.ReadWriter, fn func() error) error {
+	if deadline, ok := conn.(interface{ SetDeadline(time.Time) error }); ok {
+		deadline.SetDeadline(time.Now().Add(this.cipher.timeout))
+		defer deadline.SetDeadline(time.Time{})
+	}
+	err := fn()
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return ErrCipherFailed
+	}
+	return err
+}
+
+// rejectCipher 服务端密钥交换失败时关闭连接，不通知处理器
+func rejectCipher(conn io.Closer, addr string, err error) {
+	log.Warn("session cipher failed", addr, err)
+	metrics.add("session.abort.cipher_failed", 1)
+	conn.Close()
+}
+
+// mac 计算密钥交换消息的 HMAC，label 区分两个方向
+func (this *cipherConfig) mac(label string, keys ...[]byte) []byte {
+	m := hmac.New(sha256.New, this.psk)
+	m.Write([]byte("eegos cipher " + label))
+	for _, key := range keys {
+		m.Write(key)
+	}
+	return m.Sum(nil)
+}
+
+// derive 由 ECDH 共享密钥派生两个方向的 AES-256-GCM 密钥（HKDF-SHA256，以 psk 作为盐）
+func (this *cipherConfig) derive(key *ecdh.PrivateKey, clientPub, serverPub []byte, client bool) (*frameCipher, error) {
+	peerPub := clientPub
+	if client {
+		peerPub = serverPub
+	}
+	peer, err := ecdh.X25519().NewPublicKey(peerPub)
+	if err != nil {
+		return nil, ErrCipherFailed
+	}
+	shared, err := key.ECDH(peer)
+	if err != nil {
+		return nil, ErrCipherFailed
+	}
+
+	// HKDF 提取和扩展
+	extract := hmac.New(sha256.New, this.psk)
+	extract.Write(shared)
+	prk := extract.Sum(nil)
+	info := append(append([]byte("eegos cipher keys"), clientPub...), serverPub...)
+	var okm, block []byte
+	for i := byte(1); len(okm) < 64; i++ {
+		expand := hmac.New(sha256.New, prk)
+		expand.Write(block)
+		expand.Write(info)
+		expand.Write([]byte{i})
+		block = expand.Sum(nil)
+		okm = append(okm, block...)
+	}
+
+	toServer, err := newGCM(okm[:32])
+	if err != nil {
+		return nil, err
+	}
+	toClient, err := newGCM(okm[32:64])
+	if err != nil {
+		return nil, err
+	}
+	if client {
+		return &frameCipher{sealer: toServer, opener: toClient}, nil
+	}
+	return &frameCipher{sealer: toClient, opener: toServer}, nil
+}
+
+// newGCM 创建 AES-GCM
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// frameCipher 一个连接的记录加密状态。
+// 每次写入的数据加密为一个或多个记录：长度(2 字节，小端) + 密文和认证标签，长度作为附加数据参与认证。
+// nonce 为 4 字节 0 加上 8 字节的记录序号，两端各自计数，不在记录中传输，因此重放和乱序的记录无法解密。
+type frameCipher struct {
+	sealer  cipher.AEAD
+	sealSeq uint64
+	opener  cipher.AEAD
+	openSeq uint64
+	pending []byte // 已解密但还未读取的明文
+}
+
+// seal 把 b 加密为记录追加到 dst，调用方保证写入按顺序进行
+func (this *frameCipher) seal(dst, b []byte) []byte {
+	var nonce [12]byte
+	for len(b) > 0 {
+		n := len(b)
+		if n > maxRecordPlain {
+			n = maxRecordPlain
+		}
+		binary.BigEndian.PutUint64(nonce[4:], this.sealSeq)
+		this.sealSeq++
+		size := n + this.sealer.Overhead()
+		head := [2]byte{uint8(size), uint8(size >> 8)}
+		dst = this.sealer.Seal(append(dst, head[:]...), nonce[:], b[:n], head[:])
+		b = b[n:]
+	}
+	return dst
+}
+
+// open 解密一个记录，head 为记录的长度字段
+func (this *frameCipher) open(head, record []byte) ([]byte, error) {
+	var nonce [12]byte
+	binary.BigEndian.PutUint64(nonce[4:], this.openSeq)
+	plain, err := this.opener.Open(record[:0], nonce[:], record, head)
+	if err != nil {
+		metrics.add("session.cipher.decrypt_failed", 1)
+		return nil, ErrDecryptFailed
+	}
+	this.openSeq++
+	return plain, nil
+}
+
+// openAll 解密 data 中所有完整的记录，返回明文和不完整的剩余数据
+func (this *frameCipher) openAll(data []byte) ([]byte, []byte, error) {
+	var plain []byte
+	for len(data) >= 2 {
+		size := int(data[0]) + int(data[1])<<8
+		if len(data) < 2+size {
+			break
+		}
+		p, err := this.open(data[:2], data[2:2+size])
+		if err != nil {
+			return nil, nil, err
+		}
+		plain = append(plain, p...)
+		data = data[2+size:]
+	}
+	return plain, data, nil
+}
+
+// cipherConn 加密的连接，写入的数据加密后写出，读取时每次从连接读取一个完整的记录
+type cipherConn struct {
+	net.Conn
+	cipher *frameCipher
+	lock   sync.Mutex // 保证记录序号与写出的顺序一致
+	header [2]byte
+	record []byte // 读取记录的缓冲区，明文在原处解密，读完之后才会被下一个记录覆盖
+}
+
+// newCipherConn 用协商的加密状态包装连接
+func newCipherConn(conn net.Conn, fc *frameCipher) *cipherConn {
+	return &cipherConn{Conn: conn, cipher: fc}
+}
+
+// Read 读取解密后的数据
+func (this *cipherConn) Read(b []byte) (int, error) {
+	for len(this.cipher.pending) == 0 {
+		if _, err := io.ReadFull(this.Conn, this.header[:]); err != nil {
+			return 0, err
+		}
+		size := int(this.header[0]) + int(this.header[1])<<8
+		if cap(this.record) < size {
+			this.record = make([]byte, size)
+		}
+		record := this.record[:size]
+		if _, err := io.ReadFull(this.Conn, record); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		plain, err := this.cipher.open(this.header[:], record)
+		if err != nil {
+			return 0, err
+		}
+		this.cipher.pending = plain
+	}
+	n := copy(b, this.cipher.pending)
+	this.cipher.pending = this.cipher.pending[n:]
+	return n, nil
+}
+
+// Write 加密并写出数据
+func (this *cipherConn) Write(b []byte) (int, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if _, err := this.Conn.Write(this.cipher.seal(nil, b)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// setCipher 用协商的加密状态包装会话的连接，在会话启动之前调用。
+// 会话的连接不是 net.Conn 时无法包装，返回 ErrCipherFailed。
+func (this *Session) setCipher(fc *frameCipher) error {
+	conn, ok := this.conn.(net.Conn)
+	if !ok {
+		return ErrCipherFailed
+	}
+	this.conn = newCipherConn(conn, fc)
+	this.reader.Reset(this.conn)
+	return nil
+}
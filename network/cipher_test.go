@@ -0,0 +1,144 @@
+package network
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+var testPSK = []byte("0123456789abcdef")
+
+// TestCipherKeyExchange 两端协商出对称的记录加密状态，重放的记录无法解密
+func TestCipherKeyExchange(t *testing.T) {
+	cfg := &TcpConn{}
+	if err := cfg.SetCipher(testPSK); err != nil {
+		t.Fatal(err)
+	}
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	type result struct {
+		fc  *frameCipher
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		fc, err := cfg.acceptCipher(a)
+		done <- result{fc, err}
+	}()
+	client, err := cfg.dialCipher(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := <-done
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	server := r.fc
+
+	record := client.seal(nil, []byte("hello"))
+	plain, rest, err := server.openAll(append([]byte{}, record...))
+	if err != nil || string(plain) != "hello" || len(rest) != 0 {
+		t.Fatalf("openAll = %q %v %v", plain, rest, err)
+	}
+	reply := server.seal(nil, []byte("world"))
+	if plain, _, err := client.openAll(reply); err != nil || string(plain) != "world" {
+		t.Fatalf("client openAll = %q %v", plain, err)
+	}
+	if _, _, err := server.openAll(record); err != ErrDecryptFailed {
+		t.Fatalf("replayed record: %v, want ErrDecryptFailed", err)
+	}
+}
+
+func TestSetCipherWeakKey(t *testing.T) {
+	if err := (&TcpConn{}).SetCipher([]byte("short")); err != ErrWeakKey {
+		t.Fatalf("SetCipher = %v, want ErrWeakKey", err)
+	}
+}
+
+func TestSetCipherNotNetConn(t *testing.T) {
+	s := CreateSession(readerConn{bytes.NewReader(nil)}, func(uint16, uint16, []byte) {})
+	if err := s.setCipher(&frameCipher{}); err != ErrCipherFailed {
+		t.Fatalf("setCipher = %v, want ErrCipherFailed", err)
+	}
+}
+
+// cipherPair 连接启用加密的服务端和客户端，客户端写出的数据可以被破坏
+func cipherPair(t *testing.T) (*testHandler, *TcpClient, *Session, *atomic.Bool) {
+	t.Helper()
+	sh := newTestHandler()
+	srv := NewTcpServer(sh, memAddress(t))
+	if err := srv.SetCipher(testPSK); err != nil {
+		t.Fatal(err)
+	}
+	startServer(t, srv, 1)
+
+	corrupt := new(atomic.Bool)
+	ch := newTestHandler()
+	c := NewTcpClient(ch)
+	if err := c.SetCipher(testPSK); err != nil {
+		t.Fatal(err)
+	}
+	c.SetConnWrapper(func(conn net.Conn) net.Conn { return &corruptConn{Conn: conn, corrupt: corrupt} })
+	cs := dialClient(t, c, ch, memAddress(t))
+	return sh, c, cs, corrupt
+}
+
+func TestCipherSession(t *testing.T) {
+	sh, c, cs, _ := cipherPair(t)
+	ss := sh.waitConnect(t)
+	if _, ok := ss.conn.(*cipherConn); !ok {
+		t.Fatalf("server conn is %T, want *cipherConn", ss.conn)
+	}
+	for i := 0; i < 3; i++ {
+		if err := c.Write(cs, uint16(i), bytes.Repeat([]byte("x"), 1000*i)); err != nil {
+			t.Fatal(err)
+		}
+		if m := sh.waitMessage(t); m.head != uint16(i) || len(m.body) != 1000*i {
+			t.Fatalf("server got head %d with %d bytes", m.head, len(m.body))
+		}
+	}
+}
+
+func TestCipherBadKey(t *testing.T) {
+	sh := newTestHandler()
+	srv := NewTcpServer(sh, memAddress(t))
+	srv.SetCipher(testPSK)
+	startServer(t, srv, 1)
+	before := Metrics()["session.abort.cipher_failed"]
+
+	c := NewTcpClient(newTestHandler())
+	c.SetCipher([]byte("fedcba9876543210"))
+	if err := c.Dial(memAddress(t)); !errors.Is(err, ErrCipherFailed) {
+		t.Fatalf("Dial = %v, want ErrCipherFailed", err)
+	}
+	waitFor(t, "cipher_failed metric", func() bool { return Metrics()["session.abort.cipher_failed"] > before })
+	select {
+	case s := <-sh.connect:
+		t.Fatalf("server accepted session %d", s.fd)
+	default:
+	}
+}
+
+func TestCipherTamperedRecord(t *testing.T) {
+	sh, c, cs, corrupt := cipherPair(t)
+	sh.waitConnect(t)
+	before := Metrics()["session.cipher.decrypt_failed"]
+
+	corrupt.Store(true)
+	c.Write(cs, 1, []byte("tampered"))
+	if info := sh.waitClose(t); info.Reason != CLOSE_CORRUPT_FRAME || info.Err != ErrDecryptFailed {
+		t.Fatalf("server close = %v, want corrupt_frame", info)
+	}
+	if Metrics()["session.cipher.decrypt_failed"] == before {
+		t.Fatal("session.cipher.decrypt_failed not counted")
+	}
+	select {
+	case m := <-sh.message:
+		t.Fatalf("tampered record delivered: %q", m.body)
+	default:
+	}
+}
@@ -0,0 +1,152 @@
+package network
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// 时钟同步的平滑系数，每个新样本占 1/clockSmoothing 的权重
+const clockSmoothing = 8
+
+// RTT 超过平滑值的 clockOutlier 倍的样本被视为排队等异常延迟，不参与平滑
+const clockOutlier = 3
+
+// 连续 clockOutlierReset 个异常样本说明往返时间确实变大了，以最新的样本重新开始估计
+const clockOutlierReset = 4
+
+// ClockSync 会话的时钟同步估计，由心跳携带的时间戳按 NTP 的方式计算。
+// 客户端发送心跳时带上发送时间 t0，服务端回复收到时间 t1 和回复时间 t2，客户端记录收到回复的时间 t3，
+// 偏移为 ((t1-t0)+(t2-t3))/2，往返时间为 (t3-t0)-(t2-t1)。
+// 客户端在下一次心跳中带回上一次的四个时间戳，服务端据此得到同样的样本，所以两端都有估计。
+type ClockSync struct {
+	Offset  time.Duration // 对端时钟减去本端时钟的平滑估计，客户端为服务端时间减本地时间
+	RTT     time.Duration // 往返时间的平滑估计
+	Samples int           // 参与平滑的样本数，0 表示还没有估计
+	Updated time.Time     // 最近一次更新的本地时间
+}
+
+// clockState 会话的时钟同步状态
+type clockState struct {
+	lock     sync.Mutex
+	sync     ClockSync
+	last     [4]int64 // 客户端最近一次完整交换的 t0、t1、t2、t3，随下一次心跳发给服务端
+	ready    bool     // last 是否有效
+	outliers int      // 连续被丢弃的异常样本数
+}
+
+// Clock 返回会话的时钟同步估计。客户端会话的 Offset 是服务端时间减本地时间，
+// 服务端会话的 Offset 是客户端时间减服务端时间；对端不支持时间戳时 Samples 为 0。
+func (this *Session) Clock() ClockSync {
+	this.clock.lock.Lock()
+	defer this.clock.lock.Unlock()
+	return this.clock.sync
+}
+
+// PeerTime 按时钟同步估计返回对端当前的时间，没有估计时返回本地时间
+func (this *Session) PeerTime() time.Time {
+	return time.Now().Add(this.Clock().Offset)
+}
+
+// Clock 返回与服务器的时钟同步估计，未连接时返回零值
+func (this *TcpClient) Clock() ClockSync {
+	s := this.currentSession()
+	if s == nil {
+		return ClockSync{}
+	}
+	return s.Clock()
+}
+
+// ServerTime 按时钟同步估计返回服务器当前的时间，没有估计时返回本地时间
+func (this *TcpClient) ServerTime() time.Time {
+	return time.Now().Add(this.Clock().Offset)
+}
+
+// heartbeatBody 客户端心跳的消息体：发送时间 t0，以及上一次完整交换的四个时间戳
+func (this *clockState) heartbeatBody(now time.Time) []byte {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	body := binary.LittleEndian.AppendUint64(nil, uint64(now.UnixNano()))
+	if this.ready {
+		for _, t := range this.last {
+			body = binary.LittleEndian.AppendUint64(body, uint64(t))
+		}
+	}
+	return body
+}
+
+// heartbeatRet 服务端处理心跳携带的时间戳，返回心跳响应的消息体。
+// received 为收到心跳的时间；对端没有带时间戳时返回空消息体，与旧版本兼容。
+func (this *clockState) heartbeatRet(body []byte, received time.Time) []byte {
+	if len(body) != 8 && len(body) != 40 {
+		return []byte{}
+	}
+	if len(body) == 40 {
+		var t [4]int64
+		for i := range t {
+			t[i] = int64(binary.LittleEndian.Uint64(body[8+8*i:]))
+		}
+		// 服务端的估计方向相反：客户端时间减服务端时间
+		offset, rtt := clockSample(t)
+		this.update(-offset, rtt, received)
+	}
+	ret := append([]byte{}, body[:8]...)
+	ret = binary.LittleEndian.AppendUint64(ret, uint64(received.UnixNano()))
+	return binary.LittleEndian.AppendUint64(ret, uint64(time.Now().UnixNano()))
+}
+
+// heartbeatAck 客户端处理心跳响应携带的时间戳，received 为收到响应的时间
+func (this *clockState) heartbeatAck(body []byte, received time.Time) {
+	if len(body) != 24 {
+		return
+	}
+	t := [4]int64{
+		int64(binary.LittleEndian.Uint64(body)),
+		int64(binary.LittleEndian.Uint64(body[8:])),
+		int64(binary.LittleEndian.Uint64(body[16:])),
+		received.UnixNano(),
+	}
+	offset, rtt := clockSample(t)
+	this.update(offset, rtt, received)
+
+	this.lock.Lock()
+	this.last, this.ready = t, true
+	this.lock.Unlock()
+}
+
+// clockSample 由一次交换的四个时间戳计算服务端相对客户端的偏移和往返时间
+func clockSample(t [4]int64) (time.Duration, time.Duration) {
+	offset := ((t[1] - t[0]) + (t[2] - t[3])) / 2
+	rtt := (t[3] - t[0]) - (t[2] - t[1])
+	if rtt < 0 {
+		rtt = 0
+	}
+	return time.Duration(offset), time.Duration(rtt)
+}
+
+// update 用一个样本更新平滑估计，往返时间异常大的样本被丢弃；
+// 连续 clockOutlierReset 个异常样本时以最新的样本重新开始估计，避免往返时间持续变大后估计不再更新
+func (this *clockState) update(offset, rtt time.Duration, now time.Time) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	s := &this.sync
+	switch {
+	case s.Samples == 0:
+		s.Offset, s.RTT = offset, rtt
+	case s.RTT > 0 && rtt > s.RTT*clockOutlier:
+		metrics.add("session.clock.outlier", 1)
+		this.outliers++
+		if this.outliers < clockOutlierReset {
+			return
+		}
+		metrics.add("session.clock.reset", 1)
+		s.Offset, s.RTT = offset, rtt
+		this.outliers = 0
+	default:
+		s.Offset += (offset - s.Offset) / clockSmoothing
+		s.RTT += (rtt - s.RTT) / clockSmoothing
+		this.outliers = 0
+	}
+	s.Samples++
+	s.Updated = now
+}
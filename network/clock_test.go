@@ -0,0 +1,59 @@
+package network
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClockSample(t *testing.T) {
+	ms := int64(time.Millisecond)
+	cases := []struct {
+		name        string
+		t           [4]int64
+		offset, rtt time.Duration
+	}{
+		{"same clock", [4]int64{0, 5 * ms, 6 * ms, 11 * ms}, 0, 10 * time.Millisecond},
+		{"server ahead", [4]int64{0, 105 * ms, 106 * ms, 11 * ms}, 100 * time.Millisecond, 10 * time.Millisecond},
+		{"server behind", [4]int64{1000 * ms, 905 * ms, 906 * ms, 1011 * ms}, -100 * time.Millisecond, 10 * time.Millisecond},
+		{"asymmetric path", [4]int64{0, 9 * ms, 9 * ms, 10 * ms}, 4 * time.Millisecond, 10 * time.Millisecond},
+		{"negative rtt", [4]int64{0, 0, 20 * ms, 10 * ms}, 5 * time.Millisecond, 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			offset, rtt := clockSample(c.t)
+			if offset != c.offset || rtt != c.rtt {
+				t.Fatalf("clockSample = %v, %v, want %v, %v", offset, rtt, c.offset, c.rtt)
+			}
+		})
+	}
+}
+
+func TestClockUpdate(t *testing.T) {
+	type sample struct{ offset, rtt time.Duration }
+	cases := []struct {
+		name        string
+		samples     []sample
+		offset, rtt time.Duration
+		count       int
+	}{
+		{"first sample", []sample{{80, 16}}, 80, 16, 1},
+		{"smoothed", []sample{{80, 16}, {160, 32}}, 90, 18, 2},
+		{"outlier dropped", []sample{{80, 16}, {800, 160}}, 80, 16, 1},
+		{"outliers interrupted", []sample{{80, 16}, {800, 160}, {800, 160}, {800, 160}, {80, 16}, {800, 160}}, 80, 16, 2},
+		{"lasting rtt increase", []sample{{80, 16}, {800, 160}, {800, 160}, {800, 160}, {800, 160}}, 800, 160, 2},
+		{"smoothed after reset", []sample{{80, 16}, {800, 160}, {800, 160}, {800, 160}, {800, 160}, {880, 176}}, 810, 162, 3},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var state clockState
+			for _, s := range c.samples {
+				state.update(s.offset, s.rtt, time.Now())
+			}
+			got := state.sync
+			if got.Offset != c.offset || got.RTT != c.rtt || got.Samples != c.count {
+				t.Fatalf("update = offset %v rtt %v samples %d, want %v %v %d",
+					got.Offset, got.RTT, got.Samples, c.offset, c.rtt, c.count)
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package network
+
+import (
+	"fmt"
+)
+
+// CloseReason 表示会话关闭的原因
+type CloseReason uint8
+
+// 会话关闭原因常量
+const (
+	CLOSE_UNKNOWN           CloseReason = iota // 未知原因，如处理协程崩溃
+	CLOSE_NORMAL                               // 本端主动关闭
+	CLOSE_EOF                                  // 对端关闭连接
+	CLOSE_READ_ERROR                           // 读取数据出错
+	CLOSE_WRITE_ERROR                          // 写入数据出错
+	CLOSE_HEARTBEAT_TIMEOUT                    // 超时未收到对端的任何数据
+	CLOSE_KICK                                 // 服务端踢出
+	CLOSE_PROTOCOL_ERROR                       // 对端违反协议
+	CLOSE_RATE_LIMITED                         // 对端发送消息的速率超过限制
+	CLOSE_AUTH_FAILED                          // 认证失败或超时
+	CLOSE_CORRUPT_FRAME                        // 消息包校验和不匹配
+)
+
+// closeReasonNames 关闭原因的名称，用于日志和统计
+var closeReasonNames = [...]string{
+	CLOSE_UNKNOWN:           "unknown",
+	CLOSE_NORMAL:            "normal",
+	CLOSE_EOF:               "eof",
+	CLOSE_READ_ERROR:        "read_error",
+	CLOSE_WRITE_ERROR:       "write_error",
+	CLOSE_HEARTBEAT_TIMEOUT: "heartbeat_timeout",
+	CLOSE_KICK:              "kick",
+	CLOSE_PROTOCOL_ERROR:    "protocol_error",
+	CLOSE_RATE_LIMITED:      "rate_limited",
+	CLOSE_AUTH_FAILED:       "auth_failed",
+	CLOSE_CORRUPT_FRAME:     "corrupt_frame",
+}
+
+// String 返回关闭原因的名称
+func (this CloseReason) String() string {
+	if int(this) < len(closeReasonNames) && closeReasonNames[this] != "" {
+		return closeReasonNames[this]
+	}
+	return fmt.Sprintf("reason(%d)", uint8(this))
+}
+
+// CloseInfo 描述会话关闭的原因和引起关闭的底层错误
+type CloseInfo struct {
+	Reason CloseReason // 关闭原因
+	Err    error       // 引起关闭的底层错误，可以为 nil
+}
+
+// String 返回关闭信息的可读描述
+func (this CloseInfo) String() string {
+	if this.Err == nil {
+		return this.Reason.String()
+	}
+	return this.Reason.String() + ": " + this.Err.Error()
+}
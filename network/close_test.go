@@ -0,0 +1,119 @@
+package network
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// readErrConn 收到对端的任何数据后，读取返回 err
+type readErrConn struct {
+	net.Conn
+	err error
+}
+
+func (this readErrConn) Read(b []byte) (int, error) {
+	if _, err := this.Conn.Read(b); err != nil {
+		return 0, err
+	}
+	return 0, this.err
+}
+
+// TestCloseInfo 各种关闭方式映射到处理器 Close 收到的关闭信息
+func TestCloseInfo(t *testing.T) {
+	errKick := errors.New("kicked by test")
+	errBroken := errors.New("broken conn")
+	writeTimeout := &net.OpError{Op: "write", Net: "tcp", Err: os.ErrDeadlineExceeded}
+	readTimeout := &net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}
+	wrapErr := func(err error) func(*TcpServer) {
+		return func(srv *TcpServer) {
+			srv.SetConnWrapper(func(conn net.Conn) net.Conn { return readErrConn{conn, err} })
+		}
+	}
+
+	cases := []struct {
+		name    string
+		setup   func(*TcpServer)
+		trigger func(conn net.Conn, ss *Session)
+		reason  CloseReason
+		err     func(error) bool
+	}{
+		{
+			name:    "eof",
+			trigger: func(conn net.Conn, ss *Session) { conn.Close() },
+			reason:  CLOSE_EOF,
+			err:     func(err error) bool { return err == io.EOF },
+		},
+		{
+			name:    "read error",
+			setup:   wrapErr(errBroken),
+			trigger: func(conn net.Conn, ss *Session) { conn.Write([]byte{0}) },
+			reason:  CLOSE_READ_ERROR,
+			err:     func(err error) bool { return err == errBroken },
+		},
+		{
+			name:    "kick",
+			trigger: func(conn net.Conn, ss *Session) { ss.Kick(errKick) },
+			reason:  CLOSE_KICK,
+			err:     func(err error) bool { return err == errKick },
+		},
+		{
+			name:    "heartbeat timeout",
+			setup:   func(srv *TcpServer) { srv.SetHeartbeatTimeout(20 * time.Millisecond) },
+			trigger: func(conn net.Conn, ss *Session) {},
+			reason:  CLOSE_HEARTBEAT_TIMEOUT,
+			err:     func(err error) bool { return errors.Is(err, os.ErrDeadlineExceeded) },
+		},
+		{
+			// 连接包装内部的写入超时不是心跳超时
+			name: "write timeout",
+			setup: func(srv *TcpServer) {
+				srv.SetHeartbeatTimeout(time.Minute)
+				wrapErr(writeTimeout)(srv)
+			},
+			trigger: func(conn net.Conn, ss *Session) { conn.Write([]byte{0}) },
+			reason:  CLOSE_READ_ERROR,
+			err:     func(err error) bool { return err == writeTimeout },
+		},
+		{
+			// 没有设置读空闲超时，读取超时来自连接包装
+			name:    "read timeout without idle",
+			setup:   wrapErr(readTimeout),
+			trigger: func(conn net.Conn, ss *Session) { conn.Write([]byte{0}) },
+			reason:  CLOSE_READ_ERROR,
+			err:     func(err error) bool { return err == readTimeout },
+		},
+		{
+			name:    "protocol error",
+			trigger: func(conn net.Conn, ss *Session) { conn.Write(packFrame(0, HANDSHAKE, []byte{1})) },
+			reason:  CLOSE_PROTOCOL_ERROR,
+			err:     func(err error) bool { return err == ErrBadHandshake },
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			sh := newTestHandler()
+			srv := NewTcpServer(sh, "127.0.0.1:0")
+			if c.setup != nil {
+				c.setup(srv)
+			}
+			startServer(t, srv, 1)
+			conn, err := net.Dial("tcp", srv.Addrs()[0].String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			go io.Copy(io.Discard, conn)
+			ss := sh.waitConnect(t)
+
+			c.trigger(conn, ss)
+			info := sh.waitClose(t)
+			if info.Reason != c.reason || !c.err(info.Err) {
+				t.Fatalf("Close got %v, want reason %v", info, c.reason)
+			}
+		})
+	}
+}
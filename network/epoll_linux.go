@@ -0,0 +1,562 @@
+//go:build linux
+
+package network
+
+import (
+	"github.com/lizhen1412/eegos/log"
+
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// 当前平台支持 epoll 模式
+const supportEpoll = true
+
+// epoll 模式下每个连接未写出数据的上限，超过后写入返回 ErrQueueFull
+const epollWriteLimit = 1 << 20
+
+// epoll 模式下事件循环每次读取的最大字节数
+const epollReadSize = 65536
+
+// epollGroup 一组事件循环，新连接按轮询分配
+type epollGroup struct {
+	loops []*eventLoop
+	next  atomic.Uint32
+}
+
+// newEpollGroup 创建 n 个事件循环并启动
+func newEpollGroup(server *TcpServer, n int) (*epollGroup, error) {
+	group := &epollGroup{}
+	for i := 0; i < n; i++ {
+		loop, err := newEventLoop(server)
+		if err != nil {
+			for _, loop := range group.loops {
+				loop.release()
+			}
+			return nil, err
+		}
+		group.loops = append(group.loops, loop)
+	}
+	for _, loop := range group.loops {
+		go loop.run()
+	}
+	return group, nil
+}
+
+// add 把新连接交给一个事件循环，identity 是认证得到的对端身份，fc 是协商的加密状态，不加密时为 nil
+func (this *epollGroup) add(conn net.Conn, listener string, identity interface{}, fc *frameCipher) {
+	loop := this.loops[int(this.next.Add(1))%len(this.loops)]
+	loop.add(conn, listener, identity, fc)
+}
+
+// eventLoop 一个事件循环，在一个协程中完成所属连接的读取、消息解析和积压数据的写出
+type eventLoop struct {
+	epfd   int
+	wake   [2]int // 唤醒事件循环的管道，读端注册到 epoll
+	server *TcpServer
+	lock   sync.Mutex         // 保护 conns 和 tasks
+	conns  map[int]*epollConn // 以文件描述符作为键
+	tasks  []func()           // 其他协程投递给事件循环执行的任务
+	buf    []byte             // 读取缓冲区，只在事件循环协程中使用
+}
+
+// newEventLoop 创建事件循环和唤醒管道
+func newEventLoop(server *TcpServer) (*eventLoop, error) {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	loop := &eventLoop{
+		epfd:   epfd,
+		wake:   [2]int{-1, -1},
+		server: server,
+		conns:  make(map[int]*epollConn),
+		buf:    make([]byte, epollReadSize),
+	}
+	if err := syscall.Pipe2(loop.wake[:], syscall.O_NONBLOCK|syscall.O_CLOEXEC); err != nil {
+		loop.release()
+		return nil, err
+	}
+	if err := syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, loop.wake[0], &syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(loop.wake[0])}); err != nil {
+		loop.release()
+		return nil, err
+	}
+	return loop, nil
+}
+
+// release 关闭还未启动的事件循环的文件描述符
+func (this *eventLoop) release() {
+	syscall.Close(this.epfd)
+	for _, fd := range this.wake {
+		if fd >= 0 {
+			syscall.Close(fd)
+		}
+	}
+}
+
+// post 把任务交给事件循环协程执行，需要读写连接读取状态的操作都通过它完成
+func (this *eventLoop) post(task func()) {
+	this.lock.Lock()
+	this.tasks = append(this.tasks, task)
+	this.lock.Unlock()
+	// 管道已满时事件循环必然会被唤醒，忽略 EAGAIN
+	ignoringEINTR(func() (int, error) { return syscall.Write(this.wake[1], []byte{1}) })
+}
+
+// runTasks 清空唤醒管道并执行投递的任务
+func (this *eventLoop) runTasks() {
+	var drain [64]byte
+	for {
+		n, err := ignoringEINTR(func() (int, error) { return syscall.Read(this.wake[0], drain[:]) })
+		if n <= 0 || err != nil {
+			break
+		}
+	}
+	this.lock.Lock()
+	tasks := this.tasks
+	this.tasks = nil
+	this.lock.Unlock()
+	for _, task := range tasks {
+		task()
+	}
+}
+
+// add 为新连接创建会话并附加认证得到的身份，通知处理器后注册到 epoll
+func (this *eventLoop) add(conn net.Conn, listener string, identity interface{}, fc *frameCipher) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		conn.Close()
+		return
+	}
+	log.Debug("new connection from ", conn.RemoteAddr())
+	applied, err := applySocketOptions(tcpConn, this.server.sockOpts)
+	if err != nil {
+		log.Warn("apply socket options", conn.RemoteAddr(), err)
+	}
+
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		log.Error("epoll SyscallConn", err)
+		conn.Close()
+		return
+	}
+	c := &epollConn{tcp: tcpConn, loop: this, cipher: fc}
+	if fc != nil {
+		// 认证期间已经解密但还未读取的数据
+		c.in, fc.pending = fc.pending, nil
+	}
+	raw.Control(func(fd uintptr) {
+		c.fd = int(fd)
+	})
+	c.lastRead.Store(time.Now().UnixNano())
+
+	s := createDirectSession(c, this.server.handle.Message)
+	s.server = true
+	s.listener = listener
+	s.sockOpts = applied
+	s.idle = this.server.idle
+	s.flow = this.server.flow
+	s.rate = this.server.rate
+	s.mux = this.server.mux
+	s.groups = this.server.groups
+	s.identity = identity
+	s.checksum = this.server.checksum
+	s.policy = this.server.policy
+	c.session = s
+
+	// 先通知处理器再开始读取，保证 Connect 在所有消息之前
+	defer func() {
+		if err := recover(); err != nil {
+			log.Error(err, string(debug.Stack()))
+			s.CloseWithReason(CLOSE_UNKNOWN, fmt.Errorf("%v", err))
+		}
+	}()
+	this.server.live.Store(s, struct{}{})
+	this.server.handle.Connect(s.fd, s)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return
+	}
+	this.lock.Lock()
+	this.conns[c.fd] = c
+	this.lock.Unlock()
+	if err := syscall.EpollCtl(this.epfd, syscall.EPOLL_CTL_ADD, c.fd, &syscall.EpollEvent{Events: c.events(), Fd: int32(c.fd)}); err != nil {
+		s.setCloseInfo(CLOSE_READ_ERROR, err)
+		c.closeLocked()
+	}
+}
+
+// remove 从事件循环中移除连接，调用方持有连接的锁
+func (this *eventLoop) remove(c *epollConn) {
+	this.lock.Lock()
+	if this.conns[c.fd] == c {
+		delete(this.conns, c.fd)
+	}
+	this.lock.Unlock()
+	syscall.EpollCtl(this.epfd, syscall.EPOLL_CTL_DEL, c.fd, nil)
+}
+
+// run 事件循环，每秒检查一次读空闲超时的连接
+func (this *eventLoop) run() {
+	events := make([]syscall.EpollEvent, 128)
+	lastSweep := time.Now()
+	for {
+		n, err := syscall.EpollWait(this.epfd, events, 1000)
+		if err != nil && err != syscall.EINTR {
+			log.Error("epoll wait", err)
+			return
+		}
+		for i := 0; i < n; i++ {
+			if int(events[i].Fd) == this.wake[0] {
+				this.runTasks()
+				continue
+			}
+			this.lock.Lock()
+			c := this.conns[int(events[i].Fd)]
+			this.lock.Unlock()
+			if c == nil {
+				continue
+			}
+			ev := events[i].Events
+			if ev&syscall.EPOLLOUT != 0 {
+				c.flush()
+			}
+			if ev&(syscall.EPOLLIN|syscall.EPOLLHUP|syscall.EPOLLERR) != 0 {
+				this.read(c, ev)
+			}
+		}
+		if time.Since(lastSweep) >= time.Second {
+			lastSweep = time.Now()
+			this.sweep()
+		}
+	}
+}
+
+// read 读取连接上的数据并解析出完整的消息
+func (this *eventLoop) read(c *epollConn, ev uint32) {
+	if c.paused.Load() {
+		// 暂停读取期间对端断开，直接关闭连接，避免水平触发的事件反复唤醒
+		if ev&(syscall.EPOLLHUP|syscall.EPOLLERR) != 0 {
+			c.fail(CLOSE_EOF, io.EOF)
+		}
+		return
+	}
+
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		return
+	}
+	n, err := ignoringEINTR(func() (int, error) { return syscall.Read(c.fd, this.buf) })
+	c.lock.Unlock()
+	if err == syscall.EAGAIN {
+		return
+	}
+	if err != nil {
+		c.fail(CLOSE_READ_ERROR, err)
+		return
+	}
+	if n == 0 {
+		c.fail(CLOSE_EOF, io.EOF)
+		return
+	}
+	c.lastRead.Store(time.Now().UnixNano())
+
+	data := this.buf[:n]
+	if c.cipher != nil {
+		if data, err = c.open(data); err != nil {
+			c.fail(CLOSE_CORRUPT_FRAME, err)
+			return
+		}
+	}
+	if len(c.in) > 0 {
+		data = append(c.in, data...)
+	}
+	c.keep(c.parse(data))
+}
+
+// sweep 关闭读空闲超时的连接
+func (this *eventLoop) sweep() {
+	now := time.Now().UnixNano()
+	expired := make([]*epollConn, 0)
+	this.lock.Lock()
+	for _, c := range this.conns {
+		if idle := c.session.idle; idle > 0 && !c.paused.Load() && now-c.lastRead.Load() > int64(idle) {
+			expired = append(expired, c)
+		}
+	}
+	this.lock.Unlock()
+	for _, c := range expired {
+		c.fail(CLOSE_HEARTBEAT_TIMEOUT, os.ErrDeadlineExceeded)
+	}
+}
+
+// epollConn epoll 模式下的连接，作为会话的 conn。
+// 写入在调用方的协程中以非阻塞方式直接写到套接字，写不完的数据积压到 out，等待可写事件时由事件循环写出。
+type epollConn struct {
+	tcp      *net.TCPConn
+	fd       int
+	loop     *eventLoop
+	session  *Session
+	lock     sync.Mutex   // 保护 closed 和 out，以及对文件描述符的读写
+	closed   bool         // 连接已关闭
+	out      []byte       // 积压的待写出数据
+	in       []byte       // 不完整的消息，只在读取方使用
+	cipher   *frameCipher // 协商的加密状态，nil 表示不加密
+	sealed   []byte       // 不完整的加密记录，只在读取方使用
+	paused   atomic.Bool  // 超过速率限制时暂停读取
+	lastRead atomic.Int64 // 上次读到数据的时间，用于检查读空闲超时
+}
+
+// events 返回连接需要关注的事件，调用方持有锁
+func (this *epollConn) events() uint32 {
+	var events uint32
+	if !this.paused.Load() {
+		events |= syscall.EPOLLIN
+	}
+	if len(this.out) > 0 {
+		events |= syscall.EPOLLOUT
+	}
+	return events
+}
+
+// modify 更新连接关注的事件，调用方持有锁
+func (this *epollConn) modify() {
+	if this.closed {
+		return
+	}
+	syscall.EpollCtl(this.loop.epfd, syscall.EPOLL_CTL_MOD, this.fd, &syscall.EpollEvent{Events: this.events(), Fd: int32(this.fd)})
+}
+
+// Read epoll 模式下由事件循环读取数据，不支持直接读取
+func (this *epollConn) Read(b []byte) (int, error) {
+	return 0, ErrClosed
+}
+
+// Write 以非阻塞方式写出数据，写不完的部分积压等待事件循环写出，积压超过上限时返回 ErrQueueFull
+func (this *epollConn) Write(b []byte) (int, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.closed {
+		return 0, ErrClosed
+	}
+	size := len(b)
+	if len(this.out) > 0 && len(this.out)+size > epollWriteLimit {
+		return 0, ErrQueueFull
+	}
+	if this.cipher != nil {
+		// 在锁内加密，保证记录序号与写出的顺序一致
+		b = this.cipher.seal(nil, b)
+	}
+	if len(this.out) > 0 {
+		this.out = append(this.out, b...)
+		return size, nil
+	}
+
+	n, err := ignoringEINTR(func() (int, error) { return syscall.Write(this.fd, b) })
+	if err != nil && err != syscall.EAGAIN {
+		this.session.setCloseInfo(CLOSE_WRITE_ERROR, err)
+		this.closeLocked()
+		return 0, err
+	}
+	if n < 0 {
+		n = 0
+	}
+	if n < len(b) {
+		this.out = append(this.out, b[n:]...)
+		this.modify()
+	}
+	return size, nil
+}
+
+// flush 在可写事件中写出积压的数据
+func (this *epollConn) flush() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.closed || len(this.out) == 0 {
+		return
+	}
+	n, err := ignoringEINTR(func() (int, error) { return syscall.Write(this.fd, this.out) })
+	if err != nil && err != syscall.EAGAIN {
+		this.session.setCloseInfo(CLOSE_WRITE_ERROR, err)
+		this.closeLocked()
+		return
+	}
+	if n > 0 {
+		this.out = this.out[n:]
+	}
+	if len(this.out) == 0 {
+		this.out = nil
+		this.modify()
+	}
+}
+
+// Close 关闭连接，会话的关闭通知在新的协程中发出
+func (this *epollConn) Close() error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.closeLocked()
+}
+
+// closeLocked 关闭连接，调用方持有锁
+func (this *epollConn) closeLocked() error {
+	if this.closed {
+		return nil
+	}
+	this.closed = true
+	this.session.state.CompareAndSwap(WORKING, CLOSING)
+	this.loop.remove(this)
+	err := this.tcp.Close()
+	go this.loop.server.Close(this.session)
+	return err
+}
+
+// fail 以指定原因关闭连接
+func (this *epollConn) fail(reason CloseReason, err error) {
+	this.session.setCloseInfo(reason, err)
+	this.Close()
+}
+
+// open 解密读到的数据中完整的加密记录，不完整的记录保留到下次读取
+func (this *epollConn) open(data []byte) ([]byte, error) {
+	if len(this.sealed) > 0 {
+		data = append(this.sealed, data...)
+	}
+	plain, rest, err := this.cipher.openAll(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) == 0 {
+		this.sealed = nil
+	} else {
+		this.sealed = append([]byte(nil), rest...)
+	}
+	return plain, nil
+}
+
+// keep 保存不完整的消息等待后续数据，拷贝一份以免引用事件循环的读取缓冲区
+func (this *epollConn) keep(rest []byte) {
+	if len(rest) == 0 {
+		this.in = nil
+		return
+	}
+	this.in = append([]byte(nil), rest...)
+}
+
+// parse 从 data 中解析出完整的消息并处理，返回剩余的不完整数据。
+// 会话关闭或者超过速率限制暂停读取时停止解析。
+func (this *epollConn) parse(data []byte) []byte {
+	s := this.session
+	for len(data) >= 5 && s.state.Load() == WORKING && !this.paused.Load() {
+		pkgLen := int(data[0]) + int(data[1])<<8
+		trailer := 0
+		if s.crc.reading {
+			trailer = checksumSize
+		}
+		// 超长的消息在断开模式下根据消息头立即断开，不等待消息体
+		oversized := s.policy != nil && pkgLen > s.policy.MaxFrameSize
+		if oversized && s.policy.Oversized == POLICY_DISCONNECT {
+			_, err := s.checkLength(pkgLen)
+			this.fail(CLOSE_PROTOCOL_ERROR, err)
+			return nil
+		}
+		if len(data) < 5+pkgLen+trailer {
+			break
+		}
+		if oversized {
+			s.checkLength(pkgLen)
+			if data[2] == DATA {
+				s.consumeCredit()
+			}
+			data = data[5+pkgLen+trailer:]
+			continue
+		}
+		if trailer > 0 && !verifyChecksum(data[:5+pkgLen], data[5+pkgLen:5+pkgLen+trailer]) {
+			this.fail(CLOSE_CORRUPT_FRAME, ErrCorruptFrame)
+			return nil
+		}
+		pkg := newData()
+		pkg.dType = data[2]
+		pkg.head = uint16(data[3]) + uint16(data[4])<<8
+		if pkgLen > 0 {
+			pkg.buf = getBuffer(pkgLen)
+			pkg.body = *pkg.buf
+			copy(pkg.body, data[5:5+pkgLen])
+		}
+		data = data[5+pkgLen+trailer:]
+		this.deliver(pkg)
+	}
+	return data
+}
+
+// deliver 处理一个完整的消息，与协程模式的 Reader 和 processInData 相同
+func (this *epollConn) deliver(pkg *Data) {
+	s := this.session
+	if ok, err := s.checkFrame(pkg); !ok {
+		s.dropData(pkg)
+		if err != nil {
+			this.fail(CLOSE_PROTOCOL_ERROR, err)
+		}
+		return
+	}
+	if s.handleControl(pkg) {
+		releaseData(pkg)
+		return
+	}
+	wait, ok, err := s.checkRate(pkg)
+	if err != nil {
+		releaseData(pkg)
+		this.fail(CLOSE_RATE_LIMITED, err)
+		return
+	}
+	if !ok {
+		s.dropData(pkg)
+		return
+	}
+	if wait > 0 {
+		this.pause(wait)
+	}
+	this.loop.server.process(s, pkg)
+}
+
+// pause 暂停读取 wait 时长，依靠 TCP 的背压减慢对端。
+// 到期后在事件循环协程中恢复读取，与读取共用 in 等只在读取方使用的状态。
+func (this *epollConn) pause(wait time.Duration) {
+	this.lock.Lock()
+	this.paused.Store(true)
+	this.modify()
+	this.lock.Unlock()
+	time.AfterFunc(wait, func() { this.loop.post(this.unpause) })
+}
+
+// unpause 在事件循环协程中恢复读取，先处理暂停前已经读到的消息
+func (this *epollConn) unpause() {
+	this.paused.Store(false)
+	this.lastRead.Store(time.Now().UnixNano())
+	this.keep(this.parse(this.in))
+	if this.paused.Load() {
+		return
+	}
+	this.lock.Lock()
+	this.modify()
+	this.lock.Unlock()
+}
+
+// ignoringEINTR 执行系统调用，被信号中断时重试
+func ignoringEINTR(fn func() (int, error)) (int, error) {
+	for {
+		n, err := fn()
+		if err != syscall.EINTR {
+			return n, err
+		}
+	}
+}
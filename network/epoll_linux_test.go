@@ -0,0 +1,124 @@
+//go:build linux
+
+package network
+
+import (
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// startEpollServer 在本地 TCP 端口上启动 epoll 模式的服务器，返回监听地址
+func startEpollServer(t testing.TB, h Handler, setup func(*TcpServer)) string {
+	t.Helper()
+	srv := NewTcpServer(h, "127.0.0.1:0")
+	srv.SetEventLoops(1)
+	if setup != nil {
+		setup(srv)
+	}
+	startServer(t, srv, 1)
+	return srv.Addrs()[0].String()
+}
+
+// TestEpollRateDelay 超过速率限制后暂停读取，恢复读取在事件循环中进行，消息全部送达
+func TestEpollRateDelay(t *testing.T) {
+	sh := newTestHandler()
+	addr := startEpollServer(t, sh, func(srv *TcpServer) {
+		srv.SetRateLimit(RateLimit{Messages: 200, MessageBurst: 5, Action: RATE_DELAY})
+	})
+
+	ch := newTestHandler()
+	c := NewTcpClient(ch)
+	s := dialClient(t, c, ch, addr)
+	sh.waitConnect(t)
+
+	const count = 40
+	start := time.Now()
+	for i := 0; i < count; i++ {
+		if err := c.Write(s, uint16(i), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// epoll 模式下消息处理函数在各自的协程中调用，不保证顺序
+	seen := make(map[uint16]bool)
+	for i := 0; i < count; i++ {
+		seen[sh.waitMessage(t).head] = true
+	}
+	if len(seen) != count {
+		t.Fatalf("got %d distinct messages, want %d", len(seen), count)
+	}
+	// 超出突发上限的 35 个消息按每秒 200 个放行
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Fatalf("%d messages took %v, rate limit not applied", count, elapsed)
+	}
+}
+
+// TestEpollRateDropReturnsCredit epoll 模式下按速率限制丢弃的消息同样归还流量控制额度
+func TestEpollRateDropReturnsCredit(t *testing.T) {
+	addr := startEpollServer(t, newTestHandler(), func(srv *TcpServer) {
+		srv.SetFlowControl(FlowControl{Window: 4})
+		srv.SetRateLimit(dropLimit)
+	})
+	sendThroughDrops(t, addr, nil, "session.ratelimit.drop")
+}
+
+// TestEpollPolicyDropReturnsCredit epoll 模式下按协议策略丢弃的超长消息同样归还流量控制额度
+func TestEpollPolicyDropReturnsCredit(t *testing.T) {
+	addr := startEpollServer(t, newTestHandler(), func(srv *TcpServer) {
+		srv.SetFlowControl(FlowControl{Window: 4})
+		srv.SetProtocolPolicy(ProtocolPolicy{MaxFrameSize: 8, Oversized: POLICY_COUNT})
+	})
+	sendThroughDrops(t, addr, make([]byte, 16), "session.violation.oversized")
+}
+
+// BenchmarkEpollConnMemory 打开 b.N 个 epoll 模式的连接，报告每个连接占用的栈和堆内存
+func BenchmarkEpollConnMemory(b *testing.B) {
+	benchConnMemory(b, func(srv *TcpServer) { srv.SetEventLoops(1) })
+}
+
+// BenchmarkGoroutineConnMemory 打开 b.N 个协程模式的连接，与 BenchmarkEpollConnMemory 对比
+func BenchmarkGoroutineConnMemory(b *testing.B) {
+	benchConnMemory(b, nil)
+}
+
+// benchConnMemory 在本地 TCP 端口上启动服务器并打开 b.N 个连接，报告每个连接增加的 StackInuse+HeapInuse，
+// 协程模式每个会话的读写协程栈计入 StackInuse
+func benchConnMemory(b *testing.B, setup func(*TcpServer)) {
+	h := newTestHandler()
+	h.connect = make(chan *Session, b.N)
+	srv := NewTcpServer(h, "127.0.0.1:0")
+	if setup != nil {
+		setup(srv)
+	}
+	startServer(b, srv, 1)
+	addr := srv.Addrs()[0].String()
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	conns := make([]net.Conn, 0, b.N)
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			b.Fatal(err)
+		}
+		conns = append(conns, conn)
+	}
+	for i := 0; i < b.N; i++ {
+		h.waitConnect(b)
+	}
+	b.StopTimer()
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	// 同一进程中的客户端连接也计算在内，结果是两端合计的上限
+	inuse := func(m *runtime.MemStats) int64 { return int64(m.StackInuse + m.HeapInuse) }
+	b.ReportMetric(float64(inuse(&after)-inuse(&before))/float64(b.N), "bytes/conn")
+	runtime.KeepAlive(conns)
+}
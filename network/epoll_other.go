@@ -0,0 +1,23 @@
+//go:build !linux
+
+package network
+
+import (
+	"net"
+)
+
+// 当前平台不支持 epoll 模式
+const supportEpoll = false
+
+// epollGroup 在不支持 epoll 的平台上只是占位，不会被创建
+type epollGroup struct{}
+
+// newEpollGroup 当前平台不支持 epoll 模式
+func newEpollGroup(server *TcpServer, n int) (*epollGroup, error) {
+	return nil, ErrUnsupportedOption
+}
+
+// add 当前平台不支持 epoll 模式
+func (this *epollGroup) add(conn net.Conn, listener string, identity interface{}, fc *frameCipher) {
+	conn.Close()
+}
@@ -0,0 +1,12 @@
+package network
+
+import (
+	"errors"
+)
+
+// 写入和连接相关的错误
+var (
+	ErrClosed    = errors.New("network: session closed")      // 会话未处于工作状态或已关闭
+	ErrTooLarge  = errors.New("network: package too large")   // 消息体超过 65535 字节
+	ErrQueueFull = errors.New("network: write queue is full") // 会话的发送队列已满
+)
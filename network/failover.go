@@ -0,0 +1,201 @@
+package network
+
+import (
+	"github.com/lizhen1412/eegos/log"
+
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ErrNoEndpoint 表示故障转移列表中所有的地址都无法连接
+var ErrNoEndpoint = errors.New("network: no endpoint available")
+
+// errSwitchPrimary 切回主节点时关闭备用节点连接的原因
+var errSwitchPrimary = errors.New("network: switch back to primary endpoint")
+
+// 所有地址都连接失败后重新尝试的默认间隔
+const DefaultFailoverRetry = time.Second
+
+// Failover 客户端的多地址故障转移设置。
+// 连接失败或连接断开且无法恢复时依次尝试下一个地址，建立的是新会话，处理器会先收到 Close 再收到 Connect。
+// 检查主节点时建立一个连接后立即关闭，不发送任何消息：主节点的处理器每次检查都会收到一次 Connect
+// 和随后原因为 CLOSE_EOF 的 Close；主节点设置了加密或认证时连接在协商阶段被拒绝，只统计到 "session.abort.*"。
+type Failover struct {
+	Endpoints []string      // 服务器地址，按顺序模式时第一个为主节点
+	Random    bool          // 随机排列地址，用于分散负载，此时没有主节点
+	Retry     time.Duration // 所有地址都连接失败后等待多久重新尝试，0 使用 DefaultFailoverRetry
+	Primary   time.Duration // 连接备用节点时检查主节点是否恢复的间隔，恢复后切回主节点，0 表示不切回
+}
+
+// failoverState 故障转移的状态
+type failoverState struct {
+	config   Failover
+	order    []string      // 尝试地址的顺序
+	lock     sync.Mutex    // 保护以下字段
+	active   int           // 当前连接的地址在 order 中的序号
+	next     int           // 连接断开后首先尝试的序号
+	stopped  bool          // 客户端已被主动关闭
+	stopping chan struct{} // 客户端被主动关闭时关闭
+}
+
+// closed 返回客户端是否已被主动关闭
+func (this *failoverState) closed() bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.stopped
+}
+
+// stop 停止故障转移
+func (this *failoverState) stop() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if !this.stopped {
+		this.stopped = true
+		close(this.stopping)
+	}
+}
+
+// DialEndpoints 按故障转移设置连接服务器，从第一个地址开始依次尝试，全部失败时返回 ErrNoEndpoint。
+// 连接建立后，断开且无法恢复时客户端在后台连接下一个地址，直到调用 Close。
+func (this *TcpClient) DialEndpoints(ctx context.Context, failover Failover) error {
+	if len(failover.Endpoints) == 0 {
+		return ErrNoEndpoint
+	}
+	if failover.Retry <= 0 {
+		failover.Retry = DefaultFailoverRetry
+	}
+	order := append([]string{}, failover.Endpoints...)
+	if failover.Random {
+		rand.Shuffle(len(order), func(i, j int) { order[i], order[j] = order[j], order[i] })
+	}
+	this.failover = &failoverState{config: failover, order: order, stopping: make(chan struct{})}
+	return this.dialFrom(ctx, 0)
+}
+
+// Endpoint 返回当前连接的服务器地址
+func (this *TcpClient) Endpoint() string {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.addr
+}
+
+// dialFrom 从序号 start 开始依次尝试每个地址一次
+func (this *TcpClient) dialFrom(ctx context.Context, start int) error {
+	f := this.failover
+	var lastErr error
+	for i := 0; i < len(f.order); i++ {
+		if f.closed() {
+			return ErrClosed
+		}
+		index := (start + i) % len(f.order)
+		addr := f.order[index]
+		this.isOpen.Store(true)
+		this.ticker.Reset(5 * time.Second)
+		err := this.DialContext(ctx, addr)
+		if err == nil {
+			s := this.currentSession()
+			// 连接期间客户端被关闭
+			if f.closed() {
+				s.Close()
+				return ErrClosed
+			}
+			this.connected(index, s)
+			return nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return fmt.Errorf("%w: %v", ErrNoEndpoint, lastErr)
+}
+
+// connected 记录当前连接的地址，连接的是备用节点时开始检查主节点，s 是刚建立的会话
+func (this *TcpClient) connected(index int, s *Session) {
+	f := this.failover
+	f.lock.Lock()
+	changed := f.active != index
+	f.active = index
+	f.next = (index + 1) % len(f.order)
+	f.lock.Unlock()
+
+	if changed {
+		metrics.add("client.failover.switch", 1)
+		log.Info("failover endpoint", f.order[index])
+	}
+	if index != 0 && !f.config.Random && f.config.Primary > 0 {
+		go this.watchPrimary(s)
+	}
+}
+
+// watchPrimary 定期检查主节点是否可以连接，可以时关闭备用节点的会话并切回主节点。
+// 检查使用真实的连接，主节点的处理器会看到一个立即断开的客户端，参见 Failover。
+func (this *TcpClient) watchPrimary(s *Session) {
+	f := this.failover
+	ticker := time.NewTicker(f.config.Primary)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			return
+		case <-f.stopping:
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), f.config.Primary)
+		conn, err := this.dial(ctx, f.order[0])
+		cancel()
+		if err != nil {
+			continue
+		}
+		conn.Close()
+
+		f.lock.Lock()
+		f.next = 0
+		f.lock.Unlock()
+		log.Info("primary endpoint is back", f.order[0])
+		s.CloseWithReason(CLOSE_NORMAL, errSwitchPrimary)
+		return
+	}
+}
+
+// connectionLost 会话断开且无法恢复时通知处理器，设置了故障转移时在后台连接下一个地址
+func (this *TcpClient) connectionLost(s *Session) {
+	this.isOpen.Store(false)
+	this.ticker.Stop()
+	this.TcpConn.Close(s)
+
+	f := this.failover
+	if f == nil || f.closed() {
+		return
+	}
+	f.lock.Lock()
+	next := f.next
+	f.lock.Unlock()
+	go this.redial(next)
+}
+
+// redial 从序号 start 开始反复尝试所有地址，直到连接成功或客户端被关闭
+func (this *TcpClient) redial(start int) {
+	f := this.failover
+	for {
+		err := this.dialFrom(context.Background(), start)
+		if err == nil || err == ErrClosed {
+			return
+		}
+		log.Warn("failover", err)
+		// 之后的每一轮从主节点开始
+		if !f.config.Random {
+			start = 0
+		}
+		select {
+		case <-time.After(f.config.Retry):
+		case <-f.stopping:
+			return
+		}
+	}
+}
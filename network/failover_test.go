@@ -0,0 +1,94 @@
+package network
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestFailoverRedial 备用节点断开后客户端在后台连接下一个地址，Endpoint 和 Clock 可以被并发读取
+func TestFailoverRedial(t *testing.T) {
+	primary := memAddress(t) + "-primary"
+	backup := memAddress(t) + "-backup"
+	bh := newTestHandler()
+	startServer(t, NewTcpServer(bh, backup), 1)
+
+	ch := newTestHandler()
+	c := NewTcpClient(ch)
+	err := c.DialEndpoints(context.Background(), Failover{Endpoints: []string{primary, backup}, Retry: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+	ch.waitConnect(t)
+	if got := c.Endpoint(); got != backup {
+		t.Fatalf("Endpoint = %q, want %q", got, backup)
+	}
+
+	// 故障转移期间不断读取当前地址和时钟估计
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				c.Endpoint()
+				c.Clock()
+			}
+		}
+	}()
+	defer func() {
+		close(stop)
+		wg.Wait()
+	}()
+
+	ph := newTestHandler()
+	startServer(t, NewTcpServer(ph, primary), 1)
+	bh.waitConnect(t).Kick(nil)
+	ch.waitClose(t)
+	ch.waitConnect(t)
+	ph.waitConnect(t)
+	if got := c.Endpoint(); got != primary {
+		t.Fatalf("Endpoint after failover = %q, want %q", got, primary)
+	}
+}
+
+// TestFailoverSwitchPrimary 主节点恢复后客户端切回主节点，主节点的处理器先看到一次探测连接
+func TestFailoverSwitchPrimary(t *testing.T) {
+	primary := memAddress(t) + "-primary"
+	backup := memAddress(t) + "-backup"
+	startServer(t, NewTcpServer(newTestHandler(), backup), 1)
+
+	ch := newTestHandler()
+	c := NewTcpClient(ch)
+	err := c.DialEndpoints(context.Background(), Failover{
+		Endpoints: []string{primary, backup},
+		Retry:     10 * time.Millisecond,
+		Primary:   20 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+	ch.waitConnect(t)
+
+	ph := newTestHandler()
+	startServer(t, NewTcpServer(ph, primary), 1)
+	ph.waitConnect(t)
+	if info := ph.waitClose(t); info.Reason != CLOSE_EOF {
+		t.Fatalf("probe closed with %v, want eof", info)
+	}
+	if info := ch.waitClose(t); info.Err != errSwitchPrimary {
+		t.Fatalf("backup session closed with %v, want switch to primary", info)
+	}
+	ch.waitConnect(t)
+	ph.waitConnect(t)
+	if got := c.Endpoint(); got != primary {
+		t.Fatalf("Endpoint = %q, want %q", got, primary)
+	}
+}
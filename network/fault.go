@@ -0,0 +1,280 @@
+package network
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrFaultReset 表示连接被故障注入重置
+var ErrFaultReset = errors.New("network: connection reset by fault injection")
+
+// 匹配任意端点的名称
+const FaultAny = "*"
+
+// FaultRule 描述一条链路上注入的故障，零值表示没有故障
+type FaultRule struct {
+	Latency   time.Duration // 每次写入前的固定延迟
+	Jitter    time.Duration // 在固定延迟上追加的随机抖动上限
+	Bandwidth int           // 每秒允许写入的字节数，0 表示不限制
+	Stall     bool          // 暂停链路上的收发，直到规则被修改
+}
+
+// faultLink 表示两个命名端点之间的链路，不区分方向
+type faultLink struct {
+	a, b string
+}
+
+// newFaultLink 创建链路，端点按名称排序以保证与方向无关
+func newFaultLink(a, b string) faultLink {
+	if a > b {
+		a, b = b, a
+	}
+	return faultLink{a, b}
+}
+
+// FaultNetwork 管理命名端点之间的故障规则，用于在测试中模拟恶劣网络。
+// 通过 Wrap 或 Wrapper 包装的连接在每次读写时查询当前规则，
+// 所有方法都可以在运行时并发调用。
+type FaultNetwork struct {
+	lock       sync.RWMutex
+	rules      map[faultLink]FaultRule // 链路上的故障规则
+	partitions map[faultLink]bool      // 被分区的链路
+	conns      map[*faultConn]struct{} // 所有未关闭的包装连接
+	changed    chan struct{}           // 规则变化时关闭并替换，唤醒等待中的读写
+	random     *rand.Rand              // 生成抖动的随机数
+	randLock   sync.Mutex              // 保护 random
+}
+
+// NewFaultNetwork 创建一个没有任何故障的 FaultNetwork
+func NewFaultNetwork() *FaultNetwork {
+	return &FaultNetwork{
+		rules:      make(map[faultLink]FaultRule),
+		partitions: make(map[faultLink]bool),
+		conns:      make(map[*faultConn]struct{}),
+		changed:    make(chan struct{}),
+		random:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// SetFault 设置端点 a 和 b 之间链路的故障规则，端点名称可以使用 FaultAny
+func (this *FaultNetwork) SetFault(a, b string, rule FaultRule) {
+	this.lock.Lock()
+	this.rules[newFaultLink(a, b)] = rule
+	this.notify()
+	this.lock.Unlock()
+}
+
+// ClearFault 清除端点 a 和 b 之间链路的故障规则
+func (this *FaultNetwork) ClearFault(a, b string) {
+	this.lock.Lock()
+	delete(this.rules, newFaultLink(a, b))
+	this.notify()
+	this.lock.Unlock()
+}
+
+// Partition 断开端点 a 和 b 之间的链路，链路上的读写会一直阻塞直到 Heal
+func (this *FaultNetwork) Partition(a, b string) {
+	this.lock.Lock()
+	this.partitions[newFaultLink(a, b)] = true
+	this.notify()
+	this.lock.Unlock()
+}
+
+// Heal 恢复被 Partition 断开的链路
+func (this *FaultNetwork) Heal(a, b string) {
+	this.lock.Lock()
+	delete(this.partitions, newFaultLink(a, b))
+	this.notify()
+	this.lock.Unlock()
+}
+
+// Reset 重置端点 a 和 b 之间的所有连接，之后的读写返回 ErrFaultReset
+func (this *FaultNetwork) Reset(a, b string) {
+	this.lock.RLock()
+	conns := make([]*faultConn, 0)
+	for c := range this.conns {
+		if this.match(c.local, c.remote, a, b) {
+			conns = append(conns, c)
+		}
+	}
+	this.lock.RUnlock()
+
+	for _, c := range conns {
+		c.reset()
+	}
+}
+
+// Wrap 包装连接 conn，local 和 remote 是连接两端的端点名称
+func (this *FaultNetwork) Wrap(conn net.Conn, local, remote string) net.Conn {
+	c := &faultConn{Conn: conn, network: this, local: local, remote: remote, closed: make(chan struct{})}
+	this.lock.Lock()
+	this.conns[c] = struct{}{}
+	this.lock.Unlock()
+	return c
+}
+
+// Wrapper 返回一个包装函数，可以传给 TcpConn.SetConnWrapper。
+// 服务端通常不知道对端名称，此时 remote 可以使用 FaultAny。
+func (this *FaultNetwork) Wrapper(local, remote string) func(net.Conn) net.Conn {
+	return func(conn net.Conn) net.Conn {
+		return this.Wrap(conn, local, remote)
+	}
+}
+
+// notify 唤醒等待规则变化的读写，调用方需持有写锁
+func (this *FaultNetwork) notify() {
+	close(this.changed)
+	this.changed = make(chan struct{})
+}
+
+// match 判断连接的两端是否属于链路 a-b，支持 FaultAny
+func (this *FaultNetwork) match(local, remote, a, b string) bool {
+	hit := func(name, pattern string) bool {
+		return pattern == FaultAny || name == pattern
+	}
+	return (hit(local, a) && hit(remote, b)) || (hit(local, b) && hit(remote, a))
+}
+
+// lookup 查询连接两端之间生效的规则和分区状态，精确匹配优先于通配
+func (this *FaultNetwork) lookup(local, remote string) (FaultRule, bool, chan struct{}) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	links := [...]faultLink{
+		newFaultLink(local, remote),
+		newFaultLink(local, FaultAny),
+		newFaultLink(FaultAny, remote),
+		newFaultLink(FaultAny, FaultAny),
+	}
+	partitioned := false
+	for _, link := range links {
+		if this.partitions[link] {
+			partitioned = true
+			break
+		}
+	}
+	for _, link := range links {
+		if rule, ok := this.rules[link]; ok {
+			return rule, partitioned, this.changed
+		}
+	}
+	return FaultRule{}, partitioned, this.changed
+}
+
+// jitter 返回 [0, max) 之间的随机时长
+func (this *FaultNetwork) jitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	this.randLock.Lock()
+	defer this.randLock.Unlock()
+	return time.Duration(this.random.Int63n(int64(max)))
+}
+
+// faultConn 是注入故障的连接包装
+type faultConn struct {
+	net.Conn
+	network   *FaultNetwork
+	local     string        // 本端端点名称
+	remote    string        // 对端端点名称
+	closed    chan struct{} // 连接关闭或重置后关闭
+	closeOnce sync.Once
+	isReset   atomic.Bool // 是否被故障注入重置
+}
+
+// wait 等待链路可用，返回当前生效的规则
+func (this *faultConn) wait() (FaultRule, error) {
+	for {
+		rule, partitioned, changed := this.network.lookup(this.local, this.remote)
+		if !partitioned && !rule.Stall {
+			return rule, nil
+		}
+		select {
+		case <-changed:
+		case <-this.closed:
+			return rule, this.closeError()
+		}
+	}
+}
+
+// sleep 等待 d 时长，连接关闭时提前返回错误
+func (this *faultConn) sleep(d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-this.closed:
+		return this.closeError()
+	}
+}
+
+// closeError 返回连接关闭后读写的错误
+func (this *faultConn) closeError() error {
+	if this.isReset.Load() {
+		return ErrFaultReset
+	}
+	return net.ErrClosed
+}
+
+// Read 从连接读取数据，链路被暂停或分区时数据会被扣留
+func (this *faultConn) Read(b []byte) (int, error) {
+	n, err := this.Conn.Read(b)
+	if this.isReset.Load() {
+		return 0, ErrFaultReset
+	}
+	if n > 0 {
+		if _, werr := this.wait(); werr != nil {
+			return 0, werr
+		}
+	}
+	return n, err
+}
+
+// Write 向连接写入数据，写入前按规则注入延迟、抖动和带宽限制
+func (this *faultConn) Write(b []byte) (int, error) {
+	if this.isReset.Load() {
+		return 0, ErrFaultReset
+	}
+	rule, err := this.wait()
+	if err != nil {
+		return 0, err
+	}
+	delay := rule.Latency + this.network.jitter(rule.Jitter)
+	if rule.Bandwidth > 0 {
+		delay += time.Duration(int64(len(b)) * int64(time.Second) / int64(rule.Bandwidth))
+	}
+	if err := this.sleep(delay); err != nil {
+		return 0, err
+	}
+	// 写入期间被重置时底层连接返回的是关闭错误，与 Read 一样转换为 ErrFaultReset
+	n, err := this.Conn.Write(b)
+	if err != nil && this.isReset.Load() {
+		return n, ErrFaultReset
+	}
+	return n, err
+}
+
+// Close 关闭连接并从 FaultNetwork 中移除
+func (this *faultConn) Close() error {
+	this.closeOnce.Do(func() {
+		close(this.closed)
+		this.network.lock.Lock()
+		delete(this.network.conns, this)
+		this.network.lock.Unlock()
+	})
+	return this.Conn.Close()
+}
+
+// reset 模拟连接被重置
+func (this *faultConn) reset() {
+	this.isReset.Store(true)
+	this.Close()
+}
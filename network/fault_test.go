@@ -0,0 +1,140 @@
+package network
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// newFaultPipe 创建一对内存连接，a 端按端点 "a"、"b" 包装
+func newFaultPipe(t *testing.T, fn *FaultNetwork) (net.Conn, net.Conn) {
+	a, b := net.Pipe()
+	wrapped := fn.Wrap(a, "a", "b")
+	t.Cleanup(func() {
+		wrapped.Close()
+		b.Close()
+	})
+	return wrapped, b
+}
+
+// readAsync 在后台读取 n 个字节，读取完成后通知返回的通道
+func readAsync(conn net.Conn, n int) chan error {
+	done := make(chan error, 1)
+	go func() {
+		buf := make([]byte, n)
+		_, err := conn.Read(buf)
+		done <- err
+	}()
+	return done
+}
+
+func TestFaultLatency(t *testing.T) {
+	fn := NewFaultNetwork()
+	a, b := newFaultPipe(t, fn)
+	fn.SetFault("a", "b", FaultRule{Latency: 80 * time.Millisecond})
+
+	done := readAsync(b, 1)
+	start := time.Now()
+	if _, err := a.Write([]byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond {
+		t.Fatalf("write took %v, want at least 80ms", elapsed)
+	}
+
+	// 清除规则后立即生效
+	fn.ClearFault("a", "b")
+	done = readAsync(b, 1)
+	start = time.Now()
+	a.Write([]byte{2})
+	<-done
+	if elapsed := time.Since(start); elapsed > 40*time.Millisecond {
+		t.Fatalf("write after ClearFault took %v", elapsed)
+	}
+}
+
+func TestFaultPartitionHeal(t *testing.T) {
+	fn := NewFaultNetwork()
+	a, b := newFaultPipe(t, fn)
+	fn.Partition(FaultAny, "b")
+
+	done := readAsync(b, 1)
+	go a.Write([]byte{1})
+	select {
+	case <-done:
+		t.Fatal("write crossed a partitioned link")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	fn.Heal(FaultAny, "b")
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("write still blocked after Heal")
+	}
+}
+
+func TestFaultReset(t *testing.T) {
+	fn := NewFaultNetwork()
+	a, _ := newFaultPipe(t, fn)
+	fn.Reset("a", FaultAny)
+	if _, err := a.Write([]byte{1}); err != ErrFaultReset {
+		t.Fatalf("write after Reset = %v, want ErrFaultReset", err)
+	}
+	if _, err := a.Read(make([]byte, 1)); err != ErrFaultReset {
+		t.Fatalf("read after Reset = %v, want ErrFaultReset", err)
+	}
+}
+
+// TestFaultResetDuringWrite 写入阻塞在底层连接上时被重置，返回 ErrFaultReset 而不是关闭错误
+func TestFaultResetDuringWrite(t *testing.T) {
+	fn := NewFaultNetwork()
+	a, _ := newFaultPipe(t, fn)
+	done := make(chan error, 1)
+	go func() {
+		// 对端没有读取，net.Pipe 的写入一直阻塞
+		_, err := a.Write([]byte{1})
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	fn.Reset("a", "b")
+	select {
+	case err := <-done:
+		if err != ErrFaultReset {
+			t.Fatalf("in-flight write = %v, want ErrFaultReset", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("write not interrupted by Reset")
+	}
+}
+
+// TestFaultResetSession 通过 SetConnWrapper 注入的重置会关闭两端的会话
+func TestFaultResetSession(t *testing.T) {
+	fn := NewFaultNetwork()
+	sh := newTestHandler()
+	srv := NewTcpServer(sh, memAddress(t))
+	srv.SetConnWrapper(fn.Wrapper("server", FaultAny))
+	startServer(t, srv, 1)
+
+	ch := newTestHandler()
+	c := NewTcpClient(ch)
+	c.SetConnWrapper(fn.Wrapper("client", "server"))
+	dialClient(t, c, ch, memAddress(t))
+	sh.waitConnect(t)
+
+	// 重置可能先被读协程或正在写入的写协程发现，两种情况的错误都是 ErrFaultReset
+	fn.Reset("client", "server")
+	info := ch.waitClose(t)
+	if info.Reason != CLOSE_READ_ERROR && info.Reason != CLOSE_WRITE_ERROR || info.Err != ErrFaultReset {
+		t.Fatalf("client close = %v, want read_error or write_error: %v", info, ErrFaultReset)
+	}
+	if info := sh.waitClose(t); info.Reason == CLOSE_NORMAL {
+		t.Fatalf("server close = %v", info)
+	}
+}
@@ -0,0 +1,127 @@
+package network
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrNoCredit 表示对端授予的发送额度已经用完
+var ErrNoCredit = errors.New("network: no send credit")
+
+// FlowControl 描述基于额度的流量控制。
+// 连接时双方在握手中交换各自的接收窗口，发送方每发送一条数据消息消耗一个额度，
+// 接收方的处理函数每消费一条消息就累计一个额度，累计到窗口的一半时授予发送方。
+// 只有双方都启用时才生效，与不支持的对端通信时不做限制。
+type FlowControl struct {
+	Window  uint32        // 本端的接收窗口，即对端最多可以发送多少条尚未被消费的数据消息
+	Block   bool          // 额度用完时阻塞等待（true）还是立即返回 ErrNoCredit（false）
+	Timeout time.Duration // 阻塞等待额度的最长时间，超时返回 ErrNoCredit；0 表示等到会话关闭
+}
+
+// flowState 会话的流量控制状态
+type flowState struct {
+	enabled  atomic.Bool   // 握手协商后启用
+	lock     sync.Mutex    // 保护 credit
+	credit   uint32        // 剩余的发送额度
+	signal   chan struct{} // 收到新额度时通知等待中的发送方
+	consumed atomic.Uint32 // 已消费但还未授予对端的消息数
+}
+
+// enableFlow 启用流量控制，peerWindow 是对端的接收窗口，即初始发送额度
+func (this *Session) enableFlow(peerWindow uint32) {
+	this.flowState.lock.Lock()
+	this.flowState.credit = peerWindow
+	this.flowState.lock.Unlock()
+	this.flowState.signal = make(chan struct{}, 1)
+	this.flowState.enabled.Store(true)
+}
+
+// acquireCredit 发送数据消息前获取一个额度，wait 为 false 时即使设置了 Block 也不等待
+func (this *Session) acquireCredit(wait bool) error {
+	if !this.flowState.enabled.Load() {
+		return nil
+	}
+
+	var timeout <-chan time.Time
+	for {
+		this.flowState.lock.Lock()
+		if this.flowState.credit > 0 {
+			this.flowState.credit--
+			this.flowState.lock.Unlock()
+			return nil
+		}
+		this.flowState.lock.Unlock()
+
+		if !wait || !this.flow.Block {
+			return ErrNoCredit
+		}
+		if timeout == nil && this.flow.Timeout > 0 {
+			timer := time.NewTimer(this.flow.Timeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case <-this.flowState.signal:
+		case <-timeout:
+			return ErrNoCredit
+		case <-this.done:
+			return ErrClosed
+		}
+	}
+}
+
+// refundCredit 消息没有进入发送队列时退还额度
+func (this *Session) refundCredit() {
+	if !this.flowState.enabled.Load() {
+		return
+	}
+	this.flowState.lock.Lock()
+	this.flowState.credit++
+	this.flowState.lock.Unlock()
+}
+
+// grantCredit 处理对端授予的额度
+func (this *Session) grantCredit(body []byte) {
+	if len(body) != 4 || !this.flowState.enabled.Load() {
+		return
+	}
+	this.flowState.lock.Lock()
+	this.flowState.credit += decodeUint32(body)
+	this.flowState.lock.Unlock()
+
+	select {
+	case this.flowState.signal <- struct{}{}:
+	default:
+	}
+}
+
+// dropData 丢弃收到的消息。对端发送数据消息时已经消耗了额度，丢弃同样累计额度，否则对端的额度会永久减少
+func (this *Session) dropData(pkg *Data) {
+	if pkg.dType == DATA {
+		this.consumeCredit()
+	}
+	releaseData(pkg)
+}
+
+// consumeCredit 处理函数消费一条数据消息后累计额度，累计到窗口的一半时授予对端。
+// 启用前消费的消息也会计入，保证授予的额度不少于对端消耗的额度。
+func (this *Session) consumeCredit() {
+	if this.flow == nil {
+		return
+	}
+	consumed := this.flowState.consumed.Add(1)
+	threshold := this.flow.Window / 2
+	if threshold == 0 {
+		threshold = 1
+	}
+	if consumed < threshold || !this.flowState.enabled.Load() {
+		return
+	}
+	if this.flowState.consumed.CompareAndSwap(consumed, 0) {
+		if err := this.doWrite(0, CREDIT, encodeUint32(consumed), PRIORITY_HIGH); err != nil {
+			this.flowState.consumed.Add(consumed)
+		}
+	}
+}
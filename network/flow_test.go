@@ -0,0 +1,210 @@
+package network
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHsOptions(t *testing.T) {
+	opts := hsOptions{HS_CREDIT: encodeUint32(16), HS_CHECKSUM: {1}, 200: nil}
+	got, err := decodeHsOptions(opts.encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(opts) || decodeUint32(got[HS_CREDIT]) != 16 || !bytes.Equal(got[HS_CHECKSUM], []byte{1}) {
+		t.Fatalf("decoded %v, want %v", got, opts)
+	}
+
+	for _, body := range [][]byte{{1}, {1, 4, 0, 8}, {1, 0xff, 0xff}} {
+		if _, err := decodeHsOptions(body); err != ErrBadHandshake {
+			t.Errorf("decodeHsOptions(%v) = %v, want ErrBadHandshake", body, err)
+		}
+	}
+}
+
+// flowPair 连接启用流量控制的服务端和客户端，等待客户端完成协商。
+// 服务端每从 release 收到一个信号才处理一个消息，在此之前不会授予额度。
+func flowPair(t *testing.T, server, client FlowControl) (*blockingHandler, *TcpClient, *Session) {
+	t.Helper()
+	sh := &blockingHandler{testHandler: newTestHandler(), release: make(chan struct{})}
+	t.Cleanup(func() { close(sh.release) })
+	srv := NewTcpServer(sh, memAddress(t))
+	srv.SetFlowControl(server)
+	startServer(t, srv, 1)
+
+	ch := newTestHandler()
+	c := NewTcpClient(ch)
+	c.SetFlowControl(client)
+	cs := dialClient(t, c, ch, memAddress(t))
+	sh.waitConnect(t)
+	waitFor(t, "flow negotiation", cs.flowState.enabled.Load)
+	return sh, c, cs
+}
+
+// flowCredit 返回会话剩余的发送额度
+func flowCredit(s *Session) uint32 {
+	s.flowState.lock.Lock()
+	defer s.flowState.lock.Unlock()
+	return s.flowState.credit
+}
+
+// TestFlowNegotiation 双方都设置流量控制时启用，初始额度为对端的接收窗口，只有一方设置时不限制
+func TestFlowNegotiation(t *testing.T) {
+	cases := []struct {
+		name           string
+		server, client *FlowControl
+		enabled        bool
+	}{
+		{"both", &FlowControl{Window: 4}, &FlowControl{Window: 8}, true},
+		{"server only", &FlowControl{Window: 4}, nil, false},
+		{"client only", nil, &FlowControl{Window: 8}, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			sh := newTestHandler()
+			srv := NewTcpServer(sh, memAddress(t))
+			if c.server != nil {
+				srv.SetFlowControl(*c.server)
+			}
+			startServer(t, srv, 1)
+			ch := newTestHandler()
+			client := NewTcpClient(ch)
+			if c.client != nil {
+				client.SetFlowControl(*c.client)
+			}
+			cs := dialClient(t, client, ch, memAddress(t))
+			ss := sh.waitConnect(t)
+
+			if c.enabled {
+				waitFor(t, "client negotiation", cs.flowState.enabled.Load)
+			}
+			// 握手消息先于数据消息处理，一次往返后双方都已完成协商
+			if err := client.Write(cs, 1, nil); err != nil {
+				t.Fatal(err)
+			}
+			sh.waitMessage(t)
+			if err := srv.Write(ss, 1, nil); err != nil {
+				t.Fatal(err)
+			}
+			ch.waitMessage(t)
+
+			if cs.flowState.enabled.Load() != c.enabled || ss.flowState.enabled.Load() != c.enabled {
+				t.Fatalf("flow enabled client %v server %v, want %v",
+					cs.flowState.enabled.Load(), ss.flowState.enabled.Load(), c.enabled)
+			}
+			if c.enabled {
+				// 各自发送了一个消息，对端还没有授予额度
+				if got := flowCredit(cs); got != c.server.Window-1 {
+					t.Fatalf("client credit %d, want %d", got, c.server.Window-1)
+				}
+				if got := flowCredit(ss); got != c.client.Window-1 {
+					t.Fatalf("server credit %d, want %d", got, c.client.Window-1)
+				}
+			}
+		})
+	}
+}
+
+// TestFlowNoCredit 额度用完且不阻塞时立即返回 ErrNoCredit，不会进入发送队列
+func TestFlowNoCredit(t *testing.T) {
+	_, c, cs := flowPair(t, FlowControl{Window: 2}, FlowControl{Window: 8})
+	for i := 0; i < 2; i++ {
+		if err := c.Write(cs, 1, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Write(cs, 1, nil); err != ErrNoCredit {
+		t.Fatalf("write without credit = %v, want ErrNoCredit", err)
+	}
+	// 控制消息不受额度限制
+	if err := cs.doWrite(0, HEARTBEAT, nil, PRIORITY_HIGH); err != nil {
+		t.Fatalf("heartbeat without credit = %v", err)
+	}
+}
+
+// TestFlowBlockTimeout 阻塞等待额度超时后返回 ErrNoCredit
+func TestFlowBlockTimeout(t *testing.T) {
+	const timeout = 50 * time.Millisecond
+	_, c, cs := flowPair(t, FlowControl{Window: 1}, FlowControl{Window: 8, Block: true, Timeout: timeout})
+	c.Write(cs, 1, nil)
+	start := time.Now()
+	if err := c.Write(cs, 1, nil); err != ErrNoCredit {
+		t.Fatalf("blocked write = %v, want ErrNoCredit", err)
+	}
+	if elapsed := time.Since(start); elapsed < timeout {
+		t.Fatalf("write returned after %v, want at least %v", elapsed, timeout)
+	}
+}
+
+// TestFlowBlockUntilGrant 阻塞的写入在对端消费消息、授予额度后继续
+func TestFlowBlockUntilGrant(t *testing.T) {
+	sh, c, cs := flowPair(t, FlowControl{Window: 2}, FlowControl{Window: 8, Block: true})
+	for i := 0; i < 2; i++ {
+		c.Write(cs, 1, nil)
+	}
+	done := asyncErr(func() error { return c.Write(cs, 2, nil) })
+	select {
+	case err := <-done:
+		t.Fatalf("write returned %v without credit", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	sh.release <- struct{}{}
+	if err := waitErr(t, done); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestFlowLegacyClient 不发送握手的旧客户端不受流量控制限制，双向收发正常
+func TestFlowLegacyClient(t *testing.T) {
+	sh := newTestHandler()
+	srv := NewTcpServer(sh, "127.0.0.1:0")
+	srv.SetFlowControl(FlowControl{Window: 1})
+	startServer(t, srv, 1)
+	conn, err := net.Dial("tcp", srv.Addrs()[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go io.Copy(io.Discard, conn)
+	ss := sh.waitConnect(t)
+
+	for i := 0; i < 5; i++ {
+		if _, err := conn.Write(packFrame(uint16(i), DATA, []byte("legacy"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		sh.waitMessage(t)
+	}
+	if ss.flowState.enabled.Load() {
+		t.Fatal("flow control enabled without a handshake")
+	}
+	for i := 0; i < 5; i++ {
+		if err := srv.Write(ss, 1, []byte("reply")); err != nil {
+			t.Fatalf("write to legacy client: %v", err)
+		}
+	}
+}
+
+// TestFlowLegacyServer 不回复握手的旧服务端，客户端的流量控制保持关闭
+func TestFlowLegacyServer(t *testing.T) {
+	addr := listenLocal(t, func(conn net.Conn) {
+		defer conn.Close()
+		io.Copy(io.Discard, conn)
+	})
+	ch := newTestHandler()
+	c := NewTcpClient(ch)
+	c.SetFlowControl(FlowControl{Window: 1})
+	cs := dialClient(t, c, ch, addr)
+	for i := 0; i < 5; i++ {
+		if err := c.Write(cs, 1, nil); err != nil {
+			t.Fatalf("write %d to legacy server: %v", i, err)
+		}
+	}
+	if cs.flowState.enabled.Load() {
+		t.Fatal("flow control enabled without a handshake response")
+	}
+}
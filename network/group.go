@@ -0,0 +1,227 @@
+package network
+
+import (
+	"sync"
+)
+
+// GroupEvent 表示分组成员的变化
+type GroupEvent uint8
+
+// 分组成员的变化
+const (
+	GROUP_JOIN  GroupEvent = iota // 会话加入分组
+	GROUP_LEAVE                   // 会话离开分组，会话关闭时自动离开所有分组
+)
+
+// groupEventNames 成员变化的名称
+var groupEventNames = [...]string{
+	GROUP_JOIN:  "join",
+	GROUP_LEAVE: "leave",
+}
+
+// String 返回成员变化的名称
+func (this GroupEvent) String() string {
+	if int(this) < len(groupEventNames) {
+		return groupEventNames[this]
+	}
+	return "unknown"
+}
+
+// Groups 管理一个 TcpConn 上会话的分组，例如房间或场景，通过 TcpConn.Groups 获取。
+// 分组在第一个成员加入时创建，最后一个成员离开时删除；会话关闭时自动离开所有分组。
+// 广播只打包一次消息，所有成员的发送队列共享同一个缓冲区。
+type Groups struct {
+	lock    sync.RWMutex                                     // 保护以下字段
+	groups  map[string]map[*Session]struct{}                 // 分组名到成员
+	joined  map[*Session]map[string]struct{}                 // 会话到所在的分组，用于关闭时清理
+	onEvent func(event GroupEvent, group string, s *Session) // 成员变化的回调
+}
+
+// newGroups 创建一个空的分组管理器
+func newGroups() *Groups {
+	return &Groups{
+		groups: make(map[string]map[*Session]struct{}),
+		joined: make(map[*Session]map[string]struct{}),
+	}
+}
+
+// SetEventHandler 设置成员变化的回调，回调在加入或离开的调用方协程中执行，不持有分组的锁
+func (this *Groups) SetEventHandler(fn func(event GroupEvent, group string, s *Session)) {
+	this.lock.Lock()
+	this.onEvent = fn
+	this.lock.Unlock()
+}
+
+// Join 将会话加入分组，已在分组中时不做任何事，会话已关闭时返回 ErrClosed
+func (this *Groups) Join(group string, s *Session) error {
+	if s == nil || s.state.Load() != WORKING {
+		return ErrClosed
+	}
+
+	this.lock.Lock()
+	// 在锁内检查会话是否已释放，Release 先关闭 done 再离开所有分组，保证已释放的会话不会留在分组中
+	select {
+	case <-s.done:
+		this.lock.Unlock()
+		return ErrClosed
+	default:
+	}
+	members := this.groups[group]
+	if members == nil {
+		members = make(map[*Session]struct{})
+		this.groups[group] = members
+	}
+	if _, ok := members[s]; ok {
+		this.lock.Unlock()
+		return nil
+	}
+	members[s] = struct{}{}
+	joined := this.joined[s]
+	if joined == nil {
+		joined = make(map[string]struct{})
+		this.joined[s] = joined
+	}
+	joined[group] = struct{}{}
+	onEvent := this.onEvent
+	this.lock.Unlock()
+
+	if onEvent != nil {
+		onEvent(GROUP_JOIN, group, s)
+	}
+	return nil
+}
+
+// Leave 将会话移出分组
+func (this *Groups) Leave(group string, s *Session) {
+	this.lock.Lock()
+	ok := this.remove(group, s)
+	onEvent := this.onEvent
+	this.lock.Unlock()
+
+	if ok && onEvent != nil {
+		onEvent(GROUP_LEAVE, group, s)
+	}
+}
+
+// leaveAll 将会话移出所有分组，会话释放时调用
+func (this *Groups) leaveAll(s *Session) {
+	this.lock.Lock()
+	var left []string
+	for group := range this.joined[s] {
+		if this.remove(group, s) {
+			left = append(left, group)
+		}
+	}
+	onEvent := this.onEvent
+	this.lock.Unlock()
+
+	if onEvent != nil {
+		for _, group := range left {
+			onEvent(GROUP_LEAVE, group, s)
+		}
+	}
+}
+
+// remove 从分组中移除会话并删除空的分组，返回会话是否在分组中，调用方持有锁
+func (this *Groups) remove(group string, s *Session) bool {
+	members := this.groups[group]
+	if _, ok := members[s]; !ok {
+		return false
+	}
+	delete(members, s)
+	if len(members) == 0 {
+		delete(this.groups, group)
+	}
+	joined := this.joined[s]
+	delete(joined, group)
+	if len(joined) == 0 {
+		delete(this.joined, s)
+	}
+	return true
+}
+
+// Members 返回分组当前的成员
+func (this *Groups) Members(group string) []*Session {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	members := make([]*Session, 0, len(this.groups[group]))
+	for s := range this.groups[group] {
+		members = append(members, s)
+	}
+	return members
+}
+
+// Count 返回分组当前的成员数
+func (this *Groups) Count(group string) int {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	return len(this.groups[group])
+}
+
+// Joined 返回会话所在的分组
+func (this *Groups) Joined(s *Session) []string {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	groups := make([]string, 0, len(this.joined[s]))
+	for group := range this.joined[s] {
+		groups = append(groups, group)
+	}
+	return groups
+}
+
+// Broadcast 以普通优先级向分组的所有成员发送数据消息，返回消息进入发送队列的成员数
+func (this *Groups) Broadcast(group string, head uint16, body []byte) (int, error) {
+	return this.broadcast(group, nil, head, body, PRIORITY_NORMAL)
+}
+
+// BroadcastExcept 以普通优先级向分组中除 except 以外的成员发送数据消息，通常用于排除发送者
+func (this *Groups) BroadcastExcept(group string, except *Session, head uint16, body []byte) (int, error) {
+	return this.broadcast(group, except, head, body, PRIORITY_NORMAL)
+}
+
+// BroadcastPriority 以指定优先级向分组的所有成员发送数据消息
+func (this *Groups) BroadcastPriority(group string, head uint16, body []byte, priority Priority) (int, error) {
+	return this.broadcast(group, nil, head, body, priority)
+}
+
+// broadcast 打包一次消息并放入每个成员的发送队列，不会阻塞。
+// 消息体过大时返回 ErrTooLarge；个别成员已关闭、发送队列已满或者流量控制额度用完时跳过该成员，
+// 即使设置了 FlowControl.Block 也不等待，避免一个慢成员拖住整个分组。
+// 跳过的次数统计到 "group.broadcast.dropped"，其中额度不足的还统计到 "group.broadcast.nocredit"。
+// 启用校验和的成员共享同一个附加了校验和的消息包，校验和只计算一次。
+func (this *Groups) broadcast(group string, except *Session, head uint16, body []byte, priority Priority) (int, error) {
+	if len(body) > maxBodySize {
+		return 0, ErrTooLarge
+	}
+
+	// 复制成员列表后释放锁，发送时可能因流量控制阻塞
+	members := this.Members(group)
+	if len(members) == 0 {
+		return 0, nil
+	}
+
+	pkg := packFrame(head, DATA, body)
+	var summed []byte
+	sent := 0
+	for _, s := range members {
+		if s == except {
+			continue
+		}
+		frame := pkg
+		if s.crc.writing.Load() {
+			if summed == nil {
+				summed = appendChecksum(pkg)
+			}
+			frame = summed
+		}
+		if err := s.offerFrame(frame, priority); err != nil {
+			metrics.add("group.broadcast.dropped", 1)
+			if err == ErrNoCredit {
+				metrics.add("group.broadcast.nocredit", 1)
+			}
+			continue
+		}
+		sent++
+	}
+	return sent, nil
+}
@@ -0,0 +1,97 @@
+package network
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// blockingHandler 消息处理函数阻塞到测试结束，因此不会授予流量控制额度
+type blockingHandler struct {
+	*testHandler
+	release chan struct{}
+}
+
+func (this *blockingHandler) Message(fd, head uint16, body []byte) {
+	<-this.release
+}
+
+// waitFor 轮询等待条件成立
+func waitFor(t testing.TB, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestBroadcastSkipsMembersWithoutCredit 一个成员额度用完时广播不阻塞，其他成员照常收到消息，
+// 启用校验和的成员收到的消息包校验通过
+func TestBroadcastSkipsMembersWithoutCredit(t *testing.T) {
+	sh := newTestHandler()
+	srv := NewTcpServer(sh, memAddress(t))
+	srv.SetFlowControl(FlowControl{Window: 2, Block: true})
+	srv.SetChecksum(true)
+	startServer(t, srv, 1)
+
+	// 客户端的接收窗口决定服务端向它发送的额度
+	dial := func(h Handler, connect *testHandler, window uint32) *Session {
+		c := NewTcpClient(h)
+		c.SetFlowControl(FlowControl{Window: window})
+		c.SetChecksum(true)
+		dialClient(t, c, connect, memAddress(t))
+		s := sh.waitConnect(t)
+		waitFor(t, "handshake", func() bool { return s.flowState.enabled.Load() && s.crc.writing.Load() })
+		return s
+	}
+	fast := newTestHandler()
+	fastSession := dial(fast, fast, 64)
+	slow := &blockingHandler{testHandler: newTestHandler(), release: make(chan struct{})}
+	t.Cleanup(func() { close(slow.release) })
+	slowSession := dial(slow, slow.testHandler, 2)
+
+	groups := srv.Groups()
+	groups.Join("room", fastSession)
+	groups.Join("room", slowSession)
+
+	before := Metrics()["group.broadcast.nocredit"]
+	const count = 5
+	sent := 0
+	start := time.Now()
+	for i := 0; i < count; i++ {
+		n, err := groups.Broadcast("room", uint16(i), []byte(fmt.Sprint("msg", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sent += n
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("broadcast blocked for %v", elapsed)
+	}
+	// 慢成员只收到窗口内的两条消息
+	if sent != count+2 {
+		t.Fatalf("sent to %d members in total, want %d", sent, count+2)
+	}
+	if skipped := Metrics()["group.broadcast.nocredit"] - before; skipped < count-2 {
+		t.Fatalf("nocredit counted %d times, want at least %d", skipped, count-2)
+	}
+
+	seen := make(map[uint16]string)
+	for i := 0; i < count; i++ {
+		m := fast.waitMessage(t)
+		seen[m.head] = string(m.body)
+	}
+	for i := 0; i < count; i++ {
+		if seen[uint16(i)] != fmt.Sprint("msg", i) {
+			t.Fatalf("fast member got %v", seen)
+		}
+	}
+	select {
+	case info := <-fast.close:
+		t.Fatalf("fast member closed: %v", info)
+	default:
+	}
+}
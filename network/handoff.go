@@ -0,0 +1,117 @@
+package network
+
+import (
+	"github.com/lizhen1412/eegos/log"
+
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// ErrHandoffFailed 表示没有从旧进程继承到监听器
+var ErrHandoffFailed = errors.New("network: listener handoff failed")
+
+// 交接时等待对端回应的时间
+const handoffTimeout = 10 * time.Second
+
+// SetHandoff 设置平滑重启时继承监听器的 unix 套接字路径，需要在 Start 之前调用。
+// Start 时先连接该路径，从调用了 ServeHandoff 的旧进程继承监听同一地址的监听器，
+// 连接失败或没有对应的监听器时自己监听，旧进程不存在时与正常启动相同。
+func (this *TcpServer) SetHandoff(path string) {
+	this.handoff = path
+}
+
+// Close 关闭指定会话并释放相关资源，同时从服务器的会话集合中移除
+func (this *TcpServer) Close(s *Session) {
+	this.live.Delete(s)
+	this.TcpConn.Close(s)
+}
+
+// Sessions 返回服务器当前的会话数，包括等待恢复的会话
+func (this *TcpServer) Sessions() int {
+	n := 0
+	this.live.Range(func(key, value interface{}) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+// StopAccept 关闭所有监听器，不再接受新连接，已建立的会话不受影响，Start 随后返回
+func (this *TcpServer) StopAccept() {
+	this.lisLock.Lock()
+	defer this.lisLock.Unlock()
+	this.stopped = true
+	for _, l := range this.listeners {
+		l.Close()
+	}
+	for _, l := range this.others {
+		l.Close()
+	}
+	this.listeners = nil
+	this.others = nil
+}
+
+// Drain 停止接受新连接，并在 window 时间内逐个关闭已建立的会话，关闭原因为 CLOSE_NORMAL。
+// 会话均匀分散在 window 内关闭，避免所有客户端同时重连；window 为 0 时立即全部关闭。
+// 所有会话都通知过处理器后返回 nil，ctx 结束时返回 ctx.Err()。
+func (this *TcpServer) Drain(ctx context.Context, window time.Duration) error {
+	this.StopAccept()
+
+	var sessions []*Session
+	this.live.Range(func(key, value interface{}) bool {
+		sessions = append(sessions, key.(*Session))
+		return true
+	})
+	log.Info("drain sessions", len(sessions), window)
+
+	var interval time.Duration
+	if len(sessions) > 0 {
+		interval = window / time.Duration(len(sessions))
+	}
+	for i, s := range sessions {
+		if i > 0 && interval > 0 {
+			select {
+			case <-time.After(interval):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		s.Close()
+	}
+
+	// 等待处理器收到所有会话的关闭通知
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for this.Sessions() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// takeListener 从继承的监听器中取出监听 addr 的一个，没有时返回 nil
+func takeListener(inherited *[]*net.TCPListener, addr *net.TCPAddr) *net.TCPListener {
+	for i, l := range *inherited {
+		if sameListenAddr(l.Addr().(*net.TCPAddr), addr) {
+			*inherited = append((*inherited)[:i], (*inherited)[i+1:]...)
+			return l
+		}
+	}
+	return nil
+}
+
+// sameListenAddr 判断监听器的地址是否满足配置的地址，配置的 IP 为空时匹配任意地址的监听器
+func sameListenAddr(lis, addr *net.TCPAddr) bool {
+	if lis.Port != addr.Port {
+		return false
+	}
+	if addr.IP == nil || addr.IP.IsUnspecified() {
+		return lis.IP == nil || lis.IP.IsUnspecified()
+	}
+	return lis.IP.Equal(addr.IP)
+}
@@ -0,0 +1,18 @@
+//go:build !unix
+
+package network
+
+import (
+	"context"
+	"net"
+)
+
+// ServeHandoff 当前平台不支持传递文件描述符
+func (this *TcpServer) ServeHandoff(ctx context.Context, path string) error {
+	return ErrUnsupportedOption
+}
+
+// inheritListeners 当前平台不支持传递文件描述符
+func inheritListeners(path string) ([]*net.TCPListener, error) {
+	return nil, ErrUnsupportedOption
+}
@@ -0,0 +1,158 @@
+//go:build unix
+
+package network
+
+import (
+	"github.com/lizhen1412/eegos/log"
+
+	"context"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// 一次交接最多传递的监听器数量
+const maxHandoffListeners = 64
+
+// ServeHandoff 在 unix 套接字 path 上等待新进程继承监听器，用于不断开连接的平滑重启。
+// 新进程设置相同的 SetHandoff 路径后启动，旧进程通过 SCM_RIGHTS 把监听器的文件描述符传给它，
+// 收到新进程的确认后关闭自己的监听器并返回 nil，之后由调用方调用 Drain 逐步关闭已有的会话。
+// 交接中途失败时继续等待下一个新进程；ctx 结束时停止等待并返回 ctx.Err()，监听器保持不变。
+func (this *TcpServer) ServeHandoff(ctx context.Context, path string) error {
+	os.Remove(path)
+	lis, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return err
+	}
+	// 新进程会在同一路径上创建自己的套接字，旧进程关闭时不删除路径
+	lis.SetUnlinkOnClose(false)
+	defer lis.Close()
+	// ctx 结束时关闭交接套接字，唤醒阻塞的 AcceptUnix
+	stop := context.AfterFunc(ctx, func() { lis.Close() })
+	defer stop()
+
+	for {
+		conn, err := lis.AcceptUnix()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		err = this.sendListeners(conn)
+		conn.Close()
+		if err != nil {
+			log.Warn("listener handoff", err)
+			continue
+		}
+		metrics.add("server.handoff.sent", 1)
+		log.Info("listeners handed off", path)
+		this.StopAccept()
+		return nil
+	}
+}
+
+// sendListeners 把所有监听器的文件描述符和地址发给新进程，并等待新进程确认
+func (this *TcpServer) sendListeners(conn *net.UnixConn) error {
+	this.lisLock.Lock()
+	listeners := append([]*net.TCPListener{}, this.listeners...)
+	this.lisLock.Unlock()
+	if len(listeners) == 0 || len(listeners) > maxHandoffListeners {
+		return ErrHandoffFailed
+	}
+
+	files := make([]*os.File, 0, len(listeners))
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	fds := make([]int, 0, len(listeners))
+	addrs := make([]string, 0, len(listeners))
+	for _, l := range listeners {
+		f, err := l.File()
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+		fds = append(fds, int(f.Fd()))
+		addrs = append(addrs, l.Addr().String())
+	}
+
+	conn.SetDeadline(time.Now().Add(handoffTimeout))
+	if _, _, err := conn.WriteMsgUnix([]byte(strings.Join(addrs, "\n")), syscall.UnixRights(fds...), nil); err != nil {
+		return err
+	}
+	// 新进程创建好监听器后回复一个字节
+	ack := make([]byte, 1)
+	if _, err := conn.Read(ack); err != nil {
+		return err
+	}
+	return nil
+}
+
+// inheritListeners 连接旧进程的交接套接字并继承监听器，旧进程不存在时返回错误
+func inheritListeners(path string) ([]*net.TCPListener, error) {
+	conn, err := net.DialTimeout("unix", path, handoffTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	unixConn := conn.(*net.UnixConn)
+	unixConn.SetDeadline(time.Now().Add(handoffTimeout))
+
+	buf := make([]byte, 4096)
+	oob := make([]byte, syscall.CmsgSpace(4*maxHandoffListeners))
+	n, oobn, _, _, err := unixConn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, err
+	}
+	var fds []int
+	for i := range msgs {
+		rights, err := syscall.ParseUnixRights(&msgs[i])
+		if err != nil {
+			continue
+		}
+		fds = append(fds, rights...)
+	}
+
+	names := strings.Split(string(buf[:n]), "\n")
+	listeners := make([]*net.TCPListener, 0, len(fds))
+	for i, fd := range fds {
+		name := "handoff"
+		if i < len(names) {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(fd), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			log.Warn("inherit listener", name, err)
+			continue
+		}
+		if tcpLis, ok := l.(*net.TCPListener); ok {
+			listeners = append(listeners, tcpLis)
+		} else {
+			l.Close()
+		}
+	}
+	if len(listeners) == 0 {
+		return nil, ErrHandoffFailed
+	}
+
+	// 监听器已经就绪，通知旧进程停止接受连接
+	if _, err := unixConn.Write([]byte{1}); err != nil {
+		for _, l := range listeners {
+			l.Close()
+		}
+		return nil, err
+	}
+	metrics.add("server.handoff.inherited", uint64(len(listeners)))
+	return listeners, nil
+}
@@ -0,0 +1,156 @@
+//go:build unix
+
+package network
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// serveHandoff 在后台运行 ServeHandoff，等待交接套接字创建后返回接收结果的通道
+func serveHandoff(t *testing.T, ctx context.Context, srv *TcpServer, path string) chan error {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() { done <- srv.ServeHandoff(ctx, path) }()
+	waitFor(t, "handoff socket", func() bool {
+		_, err := os.Stat(path)
+		return err == nil
+	})
+	return done
+}
+
+// TestHandoff 新进程继承旧进程的监听器，新连接由新服务器接受，旧服务器的会话由 Drain 关闭
+func TestHandoff(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "handoff.sock")
+	oldHandler := newTestHandler()
+	oldSrv := NewTcpServer(oldHandler, "127.0.0.1:0")
+	startServer(t, oldSrv, 1)
+	addr := oldSrv.Addrs()[0].String()
+
+	ch := newTestHandler()
+	dialClient(t, NewTcpClient(ch), ch, addr)
+	oldHandler.waitConnect(t)
+
+	before := Metrics()["server.handoff.inherited"]
+	done := serveHandoff(t, context.Background(), oldSrv, path)
+	newHandler := newTestHandler()
+	newSrv := NewTcpServer(newHandler, addr)
+	newSrv.SetHandoff(path)
+	startServer(t, newSrv, 1)
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("ServeHandoff did not return")
+	}
+	if got := newSrv.Addrs()[0].String(); got != addr {
+		t.Fatalf("new server listens on %s, want %s", got, addr)
+	}
+	if addrs := oldSrv.Addrs(); len(addrs) != 0 {
+		t.Fatalf("old server still listens on %v", addrs)
+	}
+	if Metrics()["server.handoff.inherited"] == before {
+		t.Fatal("server.handoff.inherited not counted")
+	}
+
+	// 新连接由新服务器接受
+	nh := newTestHandler()
+	dialClient(t, NewTcpClient(nh), nh, addr)
+	newHandler.waitConnect(t)
+
+	// 旧服务器的会话被 Drain 关闭
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	if err := oldSrv.Drain(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	if info := oldHandler.waitClose(t); info.Reason != CLOSE_NORMAL {
+		t.Fatalf("drained session closed with %v", info)
+	}
+	if n := oldSrv.Sessions(); n != 0 {
+		t.Fatalf("%d sessions left after Drain", n)
+	}
+	ch.waitClose(t)
+}
+
+// TestHandoffCancel ctx 结束时 ServeHandoff 返回，服务器继续监听
+func TestHandoffCancel(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "handoff.sock")
+	srv := NewTcpServer(newTestHandler(), "127.0.0.1:0")
+	startServer(t, srv, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := serveHandoff(t, ctx, srv, path)
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatalf("ServeHandoff = %v, want context.Canceled", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("ServeHandoff not cancelled")
+	}
+	if len(srv.Addrs()) != 1 {
+		t.Fatal("server stopped listening after a cancelled handoff")
+	}
+}
+
+// TestHandoffNoOldProcess 交接套接字不存在时自己监听
+func TestHandoffNoOldProcess(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "missing.sock")
+	if _, err := inheritListeners(path); err == nil {
+		t.Fatal("inherited listeners from a missing socket")
+	}
+	h := newTestHandler()
+	srv := NewTcpServer(h, "127.0.0.1:0")
+	srv.SetHandoff(path)
+	startServer(t, srv, 1)
+	conn, err := net.Dial("tcp", srv.Addrs()[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	h.waitConnect(t)
+}
+
+// TestStopAccept 停止接受新连接后 Start 返回，已建立的会话不受影响
+func TestStopAccept(t *testing.T) {
+	sh := newTestHandler()
+	srv := NewTcpServer(sh, "127.0.0.1:0")
+	started := make(chan struct{})
+	go func() {
+		srv.Start()
+		close(started)
+	}()
+	waitFor(t, "listening", func() bool { return len(srv.Addrs()) == 1 })
+	addr := srv.Addrs()[0].String()
+
+	ch := newTestHandler()
+	c := NewTcpClient(ch)
+	cs := dialClient(t, c, ch, addr)
+	sh.waitConnect(t)
+
+	srv.StopAccept()
+	select {
+	case <-started:
+	case <-time.After(testTimeout):
+		t.Fatal("Start did not return after StopAccept")
+	}
+	if conn, err := net.Dial("tcp", addr); err == nil {
+		conn.Close()
+		t.Fatal("dial succeeded after StopAccept")
+	}
+	if err := c.Write(cs, 1, []byte("still open")); err != nil {
+		t.Fatal(err)
+	}
+	if m := sh.waitMessage(t); string(m.body) != "still open" {
+		t.Fatalf("server got %q", m.body)
+	}
+}
@@ -0,0 +1,160 @@
+package network
+
+import (
+	"errors"
+	"sort"
+)
+
+// 握手选项的标签
+const (
+	HS_CREDIT   = 1 // 流量控制，值为 4 字节的接收窗口
+	HS_RESUME   = 2 // 会话恢复，请求的值为 4 字节的保留消息数，响应的值为 16 字节的令牌加上 4 字节的保留消息数
+	HS_STREAM   = 3 // 流复用，值为 4 字节的流接收窗口
+	HS_CHECKSUM = 4 // 消息包校验和，值为 1 字节的校验算法，目前只有 CRC32C
+)
+
+// ErrBadHandshake 表示握手消息无法解析
+var ErrBadHandshake = errors.New("network: malformed handshake")
+
+// hsOptions 握手选项，以标签作为键。
+// 编码为依次排列的 标签(1 字节) + 长度(2 字节) + 值，未知的标签会被忽略，便于扩展。
+type hsOptions map[uint8][]byte
+
+// encode 将握手选项编码为消息体
+func (this hsOptions) encode() []byte {
+	tags := make([]int, 0, len(this))
+	size := 0
+	for tag, value := range this {
+		tags = append(tags, int(tag))
+		size += 3 + len(value)
+	}
+	sort.Ints(tags)
+
+	body := make([]byte, 0, size)
+	for _, tag := range tags {
+		value := this[uint8(tag)]
+		body = append(body, uint8(tag), uint8(len(value)), uint8(len(value)>>8))
+		body = append(body, value...)
+	}
+	return body
+}
+
+// decodeHsOptions 解析握手消息体，值会被拷贝
+func decodeHsOptions(body []byte) (hsOptions, error) {
+	opts := make(hsOptions)
+	for len(body) > 0 {
+		if len(body) < 3 {
+			return nil, ErrBadHandshake
+		}
+		tag := body[0]
+		size := int(body[1]) + int(body[2])<<8
+		if len(body) < 3+size {
+			return nil, ErrBadHandshake
+		}
+		opts[tag] = append([]byte{}, body[3:3+size]...)
+		body = body[3+size:]
+	}
+	return opts, nil
+}
+
+// 握手状态常量
+const (
+	HS_NONE     = iota // 没有握手，与不支持握手的对端通信
+	HS_OFFERED         // 客户端已发送握手请求
+	HS_ACCEPTED        // 服务端已回复握手响应，等待客户端确认
+	HS_DONE            // 握手完成
+)
+
+// startHandshake 客户端在会话启动后发送握手请求，没有需要协商的功能时也发送空的请求，
+// 服务端据此判断新连接不是恢复请求。不支持握手的服务端会忽略请求，此时所有可选功能保持关闭。
+func (this *Session) startHandshake() error {
+	offer := make(hsOptions)
+	if this.flow != nil {
+		offer[HS_CREDIT] = encodeUint32(this.flow.Window)
+	}
+	this.offerResume(offer)
+	this.offerStreams(offer)
+	this.offerChecksum(offer)
+	this.hsState = HS_OFFERED
+	return this.doWrite(0, HANDSHAKE, offer.encode(), PRIORITY_HIGH)
+}
+
+// handleControl 在读协程中处理会话层的控制消息，返回 false 表示不是控制消息。
+// 控制消息在读取下一个消息之前处理完毕，保证协商结果按消息顺序生效。
+func (this *Session) handleControl(data *Data) bool {
+	switch data.dType {
+	case HANDSHAKE:
+		this.acceptHandshake(data.body)
+	case HANDSHAKE_RET:
+		if this.hsState == HS_OFFERED {
+			this.finishHandshake(data.body)
+		} else if this.hsState == HS_ACCEPTED {
+			// 客户端的确认，此后对端发来的消息都按协商结果处理
+			this.hsState = HS_DONE
+			this.resumeState.receiving = this.resumeState.enabled
+			this.crc.reading = this.crc.enabled
+		}
+	case CREDIT:
+		this.grantCredit(data.body)
+	case RESUME_ACK:
+		this.ackSent(data.body)
+	case STREAM:
+		this.handleStream(data)
+	case RESUME, RESUME_RET:
+		// 恢复请求只能是新连接的第一个消息，其他位置的恢复消息直接忽略
+	default:
+		return false
+	}
+	return true
+}
+
+// acceptHandshake 服务端处理握手请求，回复本端接受的功能
+func (this *Session) acceptHandshake(body []byte) {
+	if this.hsState != HS_NONE {
+		return
+	}
+	offer, err := decodeHsOptions(body)
+	if err != nil {
+		this.CloseWithReason(CLOSE_PROTOCOL_ERROR, err)
+		return
+	}
+
+	ret := make(hsOptions)
+	if value, ok := offer[HS_CREDIT]; ok && this.flow != nil && len(value) == 4 {
+		ret[HS_CREDIT] = encodeUint32(this.flow.Window)
+		this.enableFlow(decodeUint32(value))
+	}
+	this.acceptResume(offer, ret)
+	this.acceptStreams(offer, ret)
+	this.acceptChecksum(offer, ret)
+	this.hsState = HS_ACCEPTED
+	this.doWrite(0, HANDSHAKE_RET, ret.encode(), PRIORITY_HIGH)
+}
+
+// finishHandshake 客户端处理握手响应并回复确认
+func (this *Session) finishHandshake(body []byte) {
+	ret, err := decodeHsOptions(body)
+	if err != nil {
+		this.CloseWithReason(CLOSE_PROTOCOL_ERROR, err)
+		return
+	}
+
+	if value, ok := ret[HS_CREDIT]; ok && this.flow != nil && len(value) == 4 {
+		this.enableFlow(decodeUint32(value))
+	}
+	this.finishResume(ret)
+	this.finishStreams(ret)
+	this.finishChecksum(ret)
+	this.hsState = HS_DONE
+	this.doWrite(0, HANDSHAKE_RET, nil, PRIORITY_HIGH)
+}
+
+// encodeUint32 以小端序编码 32 位整数
+func encodeUint32(v uint32) []byte {
+	return []byte{uint8(v), uint8(v >> 8), uint8(v >> 16), uint8(v >> 24)}
+}
+
+// decodeUint32 以小端序解码 32 位整数，调用方保证长度至少为 4
+func decodeUint32(b []byte) uint32 {
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 | uint32(b[3])<<24
+}
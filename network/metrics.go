@@ -0,0 +1,49 @@
+package network
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// counterSet 按名称组织的一组计数器，可以并发使用
+type counterSet struct {
+	lock     sync.RWMutex       // 保护 counters 映射
+	counters map[string]*uint64 // 计数器，以指标名称作为键
+}
+
+// metrics 网络层的统计计数
+var metrics = &counterSet{counters: make(map[string]*uint64)}
+
+// add 为指定名称的计数器增加 delta，计数器不存在时自动创建
+func (this *counterSet) add(name string, delta uint64) {
+	this.lock.RLock()
+	counter, ok := this.counters[name]
+	this.lock.RUnlock()
+
+	if !ok {
+		this.lock.Lock()
+		if counter, ok = this.counters[name]; !ok {
+			counter = new(uint64)
+			this.counters[name] = counter
+		}
+		this.lock.Unlock()
+	}
+	atomic.AddUint64(counter, delta)
+}
+
+// snapshot 返回所有计数器当前值的拷贝
+func (this *counterSet) snapshot() map[string]uint64 {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	ret := make(map[string]uint64, len(this.counters))
+	for name, counter := range this.counters {
+		ret[name] = atomic.LoadUint64(counter)
+	}
+	return ret
+}
+
+// Metrics 返回网络层统计计数的快照，键为指标名称，例如 "session.close.eof"
+func Metrics() map[string]uint64 {
+	return metrics.snapshot()
+}
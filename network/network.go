@@ -14,11 +14,22 @@ const (
 	HEARTBEAT            // 心跳包类型
 	HEARTBEAT_RET        // 心跳包响应类型
 	DATA                 // 数据类型
+	HANDSHAKE            // 握手请求，客户端连接后发送，携带希望启用的可选功能
+	HANDSHAKE_RET        // 握手响应，服务端回复接受的功能，客户端再回复一次表示确认
+	CREDIT               // 流量控制额度，接收方消费消息后授予发送方
+	RESUME               // 恢复会话请求，客户端重连后作为第一个消息发送，携带恢复令牌和收到的消息数
+	RESUME_RET           // 恢复会话响应，携带服务端收到的消息数，消息体为空表示拒绝
+	RESUME_ACK           // 确认收到的数据消息数，发送方据此丢弃保留的消息
+	STREAM               // 复用流上的消息，消息头为流标识，消息体第一个字节为流消息类型
+	AUTH                 // 认证消息，只在会话启动前交换，消息体由认证器定义
+	AUTH_RET             // 服务端的认证结果，消息体为空表示通过，否则为失败原因
+	CIPHER               // 密钥交换消息，只在连接建立后、认证之前以明文交换
 )
 
 // Data 结构体表示一个通用的数据包
 type Data struct {
-	dType uint8  // 数据包类型
-	head  uint16 // 数据包头部
-	body  []byte // 数据包主体
+	dType uint8   // 数据包类型
+	head  uint16  // 数据包头部
+	body  []byte  // 数据包主体
+	buf   *[]byte // 消息体所在的池化缓冲区
 }
@@ -0,0 +1,108 @@
+package network
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// 测试中等待事件的超时时间
+const testTimeout = 5 * time.Second
+
+// testMessage 处理器收到的一个消息
+type testMessage struct {
+	fd   uint16
+	head uint16
+	body []byte
+}
+
+// testHandler 把处理器事件转发到通道的 Handler，供测试等待和检查
+type testHandler struct {
+	connect chan *Session
+	message chan testMessage
+	close   chan CloseInfo
+}
+
+// newTestHandler 创建一个事件通道足够大的 testHandler
+func newTestHandler() *testHandler {
+	return &testHandler{
+		connect: make(chan *Session, 64),
+		message: make(chan testMessage, 1024),
+		close:   make(chan CloseInfo, 64),
+	}
+}
+
+func (this *testHandler) Connect(fd uint16, s *Session) { this.connect <- s }
+
+func (this *testHandler) Message(fd, head uint16, body []byte) {
+	this.message <- testMessage{fd: fd, head: head, body: append([]byte{}, body...)}
+}
+
+func (this *testHandler) Heartbeat(fd, head uint16) {}
+
+func (this *testHandler) Close(fd uint16, info CloseInfo) { this.close <- info }
+
+// waitConnect 等待一个新会话
+func (this *testHandler) waitConnect(t testing.TB) *Session {
+	t.Helper()
+	select {
+	case s := <-this.connect:
+		return s
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting for Connect")
+		return nil
+	}
+}
+
+// waitMessage 等待一个消息
+func (this *testHandler) waitMessage(t testing.TB) testMessage {
+	t.Helper()
+	select {
+	case m := <-this.message:
+		return m
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting for Message")
+		return testMessage{}
+	}
+}
+
+// waitClose 等待会话关闭
+func (this *testHandler) waitClose(t testing.TB) CloseInfo {
+	t.Helper()
+	select {
+	case info := <-this.close:
+		return info
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting for Close")
+		return CloseInfo{}
+	}
+}
+
+// memAddress 返回测试专用的进程内地址，不同测试之间不会冲突
+func memAddress(t testing.TB) string {
+	return "mem://" + strings.ReplaceAll(t.Name(), "/", "-")
+}
+
+// startServer 启动服务器并等待所有地址开始监听，测试结束时停止接受连接
+func startServer(t testing.TB, srv *TcpServer, addrs int) {
+	t.Helper()
+	go srv.Start()
+	deadline := time.Now().Add(testTimeout)
+	for len(srv.Addrs()) < addrs {
+		if time.Now().After(deadline) {
+			t.Fatal("server did not start")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Cleanup(srv.StopAccept)
+}
+
+// dialClient 连接 addr 并等待客户端会话建立，测试结束时关闭客户端
+func dialClient(t testing.TB, c *TcpClient, h *testHandler, addr string) *Session {
+	t.Helper()
+	if err := c.Dial(addr); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+	return h.waitConnect(t)
+}
@@ -0,0 +1,117 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrProtocolViolation 表示对端发送了违反协议的消息，会话被断开
+var ErrProtocolViolation = errors.New("network: protocol violation")
+
+// errFrameDropped 表示超长的消息已按策略丢弃，读协程继续读取下一个消息
+var errFrameDropped = errors.New("network: frame dropped")
+
+// Violation 表示对端违反协议的类型
+type Violation uint8
+
+// 违反协议的类型
+const (
+	VIOLATION_UNKNOWN_TYPE  Violation = iota // 未知或不应在会话中出现的消息类型，包括 PKG_TYPE
+	VIOLATION_OVERSIZED                      // 消息体超过 MaxFrameSize
+	VIOLATION_EARLY_DATA                     // 服务端在握手之前收到数据消息
+	VIOLATION_HEARTBEAT_RET                  // 服务端收到心跳响应
+)
+
+// violationNames 违反协议类型的名称，用于日志和统计
+var violationNames = [...]string{
+	VIOLATION_UNKNOWN_TYPE:  "unknown_type",
+	VIOLATION_OVERSIZED:     "oversized",
+	VIOLATION_EARLY_DATA:    "early_data",
+	VIOLATION_HEARTBEAT_RET: "heartbeat_ret",
+}
+
+// String 返回违反协议类型的名称
+func (this Violation) String() string {
+	if int(this) < len(violationNames) {
+		return violationNames[this]
+	}
+	return "unknown"
+}
+
+// PolicyAction 表示收到违反协议的消息时的处理方式
+type PolicyAction uint8
+
+// 违反协议时的处理方式
+const (
+	POLICY_IGNORE     PolicyAction = iota // 丢弃消息，与未设置策略时的行为相同
+	POLICY_COUNT                          // 丢弃消息并统计到 "session.violation.<类型>"
+	POLICY_DISCONNECT                     // 统计后断开会话，关闭原因为 CLOSE_PROTOCOL_ERROR
+)
+
+// ProtocolPolicy 描述会话如何处理对端违反协议的消息，每种违规可以单独设置处理方式。
+// 检查在读协程中、消息交给处理器之前进行，对 goroutine 和 epoll 两种模式都有效。
+type ProtocolPolicy struct {
+	MaxFrameSize int          // 消息体的最大长度，0 或超过 65535 时为 65535，对控制消息同样有效
+	UnknownType  PolicyAction // 未知的消息类型，以及认证消息等只能在会话启动前出现的类型
+	Oversized    PolicyAction // 消息体超过 MaxFrameSize
+	EarlyData    PolicyAction // 服务端需要握手时在收到握手请求之前收到数据消息，未设置需要协商的功能时不检查
+	HeartbeatRet PolicyAction // 服务端收到只应由服务端发送的心跳响应
+}
+
+// SetProtocolPolicy 设置之后建立的会话处理违反协议的消息的方式，不设置时所有违规的消息都被忽略
+func (this *TcpConn) SetProtocolPolicy(policy ProtocolPolicy) {
+	if policy.MaxFrameSize <= 0 || policy.MaxFrameSize > maxBodySize {
+		policy.MaxFrameSize = maxBodySize
+	}
+	this.policy = &policy
+}
+
+// checkFrame 按协议策略检查收到的消息，在处理控制消息之前调用。
+// 返回 false 表示消息需要丢弃，断开模式下同时返回 ErrProtocolViolation。
+// 消息体的长度在读取消息体之前由 checkLength 检查。
+func (this *Session) checkFrame(pkg *Data) (bool, error) {
+	if this.policy == nil {
+		return true, nil
+	}
+
+	switch pkg.dType {
+	case HANDSHAKE, HANDSHAKE_RET, CREDIT, RESUME, RESUME_RET, RESUME_ACK, STREAM, HEARTBEAT:
+	case HEARTBEAT_RET:
+		if this.server {
+			return this.violate(VIOLATION_HEARTBEAT_RET, this.policy.HeartbeatRet)
+		}
+	case DATA:
+		if this.expectsHandshake() && this.hsState == HS_NONE {
+			return this.violate(VIOLATION_EARLY_DATA, this.policy.EarlyData)
+		}
+	default:
+		return this.violate(VIOLATION_UNKNOWN_TYPE, this.policy.UnknownType)
+	}
+	return true, nil
+}
+
+// checkLength 按消息头中的长度检查消息体是否超过 MaxFrameSize，在分配和读取消息体之前调用。
+// 返回 false 表示消息需要丢弃，断开模式下同时返回 ErrProtocolViolation。
+func (this *Session) checkLength(pkgLen int) (bool, error) {
+	if this.policy == nil || pkgLen <= this.policy.MaxFrameSize {
+		return true, nil
+	}
+	return this.violate(VIOLATION_OVERSIZED, this.policy.Oversized)
+}
+
+// expectsHandshake 服务端是否要求客户端在发送数据之前握手，设置了需要协商的功能时客户端总是先握手
+func (this *Session) expectsHandshake() bool {
+	return this.server && (this.flow != nil || this.resume != nil || this.mux != nil || this.checksum)
+}
+
+// violate 按处理方式处理一次违规
+func (this *Session) violate(kind Violation, action PolicyAction) (bool, error) {
+	switch action {
+	case POLICY_COUNT:
+		metrics.add("session.violation."+kind.String(), 1)
+	case POLICY_DISCONNECT:
+		metrics.add("session.violation."+kind.String(), 1)
+		return false, fmt.Errorf("%w: %s", ErrProtocolViolation, kind)
+	}
+	return false, nil
+}
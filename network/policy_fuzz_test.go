@@ -0,0 +1,87 @@
+package network
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+// readerConn 从固定的数据中读取，写入被丢弃
+type readerConn struct {
+	io.Reader
+}
+
+func (this readerConn) Write(b []byte) (int, error) { return len(b), nil }
+func (this readerConn) Close() error                { return nil }
+
+// newReadSession 创建从 data 读取消息的服务端会话，action 设置所有违规的处理方式
+func newReadSession(data []byte, action PolicyAction, checksum bool) *Session {
+	s := CreateSession(readerConn{bytes.NewReader(data)}, func(uint16, uint16, []byte) {})
+	s.server = true
+	s.flow = &FlowControl{Window: 4}
+	s.checksum = true
+	s.crc.reading = checksum
+	s.policy = &ProtocolPolicy{
+		MaxFrameSize: 64,
+		UnknownType:  action,
+		Oversized:    action,
+		EarlyData:    action,
+		HeartbeatRet: action,
+	}
+	s.state.Store(WORKING)
+	return s
+}
+
+// FuzzReadFrame 任意数据交给读协程解析，不能导致崩溃
+func FuzzReadFrame(f *testing.F) {
+	f.Add(packFrame(0, DATA, []byte("hello")), uint8(POLICY_COUNT), false)
+	f.Add(packFrame(0, HANDSHAKE, nil), uint8(POLICY_DISCONNECT), false)
+	f.Add(packFrame(0, HANDSHAKE, []byte{1, 4, 0, 8, 0, 0, 0}), uint8(POLICY_IGNORE), true)
+	f.Add(packFrame(0, HEARTBEAT_RET, make([]byte, 16)), uint8(POLICY_DISCONNECT), false)
+	f.Add(packFrame(0, 0xff, make([]byte, 128)), uint8(POLICY_IGNORE), false)
+	f.Add([]byte{0xff, 0xff, DATA, 0, 0}, uint8(POLICY_COUNT), true)
+	f.Fuzz(func(t *testing.T, data []byte, action uint8, checksum bool) {
+		s := newReadSession(data, PolicyAction(action%3), checksum)
+		for i := 0; i <= len(data); i++ {
+			if s.Reader() != nil {
+				break
+			}
+			select {
+			case pkg := <-s.inData:
+				releaseData(pkg)
+			default:
+			}
+		}
+	})
+}
+
+// TestReadFrameOversized 超长的消息根据消息头处理，不读取消息体
+func TestReadFrameOversized(t *testing.T) {
+	header := []byte{0xe8, 0x03, DATA, 0, 0} // 声明 1000 字节的消息体，实际没有
+	cases := []struct {
+		name   string
+		action PolicyAction
+		want   error
+	}{
+		{"disconnect", POLICY_DISCONNECT, ErrProtocolViolation},
+		{"ignore", POLICY_IGNORE, io.EOF},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := newReadSession(header, c.action, false)
+			if err := s.Reader(); !errors.Is(err, c.want) {
+				t.Fatalf("Reader = %v, want %v", err, c.want)
+			}
+		})
+	}
+}
+
+// TestPolicyDropReturnsCredit 按协议策略丢弃的超长消息归还流量控制额度，对端不会因额度用完而停止发送
+func TestPolicyDropReturnsCredit(t *testing.T) {
+	srv := NewTcpServer(newTestHandler(), memAddress(t))
+	srv.SetFlowControl(FlowControl{Window: 4})
+	srv.SetProtocolPolicy(ProtocolPolicy{MaxFrameSize: 8, Oversized: POLICY_COUNT})
+	startServer(t, srv, 1)
+	sendThroughDrops(t, memAddress(t), make([]byte, 16), "session.violation.oversized")
+}
@@ -0,0 +1,88 @@
+package network
+
+import (
+	"sync"
+)
+
+// 读缓冲区大小，Reader 通过 bufio 合并小包的系统调用
+const readBufferSize = 4096
+
+// bufferClasses 消息体缓冲区的分级容量，最大一级覆盖 65535 字节的消息体
+var bufferClasses = [...]int{64, 256, 1024, 4096, 16384, 65536}
+
+// bufferPools 与 bufferClasses 一一对应的缓冲区池
+var bufferPools [len(bufferClasses)]sync.Pool
+
+// dataPool 复用 Data 结构体
+var dataPool = sync.Pool{
+	New: func() interface{} {
+		return new(Data)
+	},
+}
+
+func init() {
+	// 为每一级缓冲区池设置创建函数
+	for i := range bufferPools {
+		size := bufferClasses[i]
+		bufferPools[i].New = func() interface{} {
+			buf := make([]byte, size)
+			return &buf
+		}
+	}
+}
+
+// getBuffer 按大小从对应级别的池中取出缓冲区，长度设置为 size
+func getBuffer(size int) *[]byte {
+	for i, c := range bufferClasses {
+		if size <= c {
+			buf := bufferPools[i].Get().(*[]byte)
+			*buf = (*buf)[:size]
+			return buf
+		}
+	}
+	// 超出最大级别的缓冲区不做复用
+	buf := make([]byte, size)
+	return &buf
+}
+
+// putBuffer 将缓冲区放回对应级别的池中，容量不匹配任何级别的缓冲区直接丢弃
+func putBuffer(buf *[]byte) {
+	c := cap(*buf)
+	for i := range bufferClasses {
+		if c == bufferClasses[i] {
+			*buf = (*buf)[:c]
+			bufferPools[i].Put(buf)
+			return
+		}
+	}
+}
+
+// newData 从池中取出一个 Data
+func newData() *Data {
+	return dataPool.Get().(*Data)
+}
+
+// releaseData 回收 Data 及其消息体缓冲区
+func releaseData(data *Data) {
+	if data.buf != nil {
+		putBuffer(data.buf)
+	}
+	*data = Data{}
+	dataPool.Put(data)
+}
+
+// detachData 只回收 Data 结构体，消息体的所有权交给处理函数
+func detachData(data *Data) {
+	*data = Data{}
+	dataPool.Put(data)
+}
+
+// ReleaseBody 将保留的消息体交还给缓冲区池。
+// 只有在会话设置了 SetRetainBody(true) 时，处理函数才拥有消息体，
+// 用完后可调用此方法归还；调用后不能再访问 body。
+func ReleaseBody(body []byte) {
+	if cap(body) == 0 {
+		return
+	}
+	putBuffer(&body)
+}
@@ -0,0 +1,124 @@
+package network
+
+import (
+	"io"
+	"testing"
+)
+
+// loopConn 循环返回同一段数据的连接，用于在不经过网络的情况下测量读取路径
+type loopConn struct {
+	data []byte
+	off  int
+}
+
+func (this *loopConn) Read(b []byte) (int, error) {
+	n := copy(b, this.data[this.off:])
+	this.off = (this.off + n) % len(this.data)
+	return n, nil
+}
+
+func (this *loopConn) Write(b []byte) (int, error) { return len(b), nil }
+func (this *loopConn) Close() error                { return nil }
+
+// benchBodySizes 基准测试使用的消息体长度
+var benchBodySizes = []struct {
+	name string
+	size int
+}{
+	{"64B", 64},
+	{"1KB", 1024},
+	{"16KB", 16384},
+}
+
+// newLoopSession 创建一个从循环连接读取 body 消息包的会话
+func newLoopSession(body []byte) *Session {
+	return CreateSession(&loopConn{data: packFrame(1, DATA, body)}, nil)
+}
+
+func TestReadPacketReusesBuffers(t *testing.T) {
+	body := []byte("hello")
+	s := newLoopSession(body)
+	for i := 0; i < 3; i++ {
+		pkg, err := s.readPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pkg.dType != DATA || pkg.head != 1 || string(pkg.body) != "hello" {
+			t.Fatalf("packet %d = %d %d %q", i, pkg.dType, pkg.head, pkg.body)
+		}
+		if cap(*pkg.buf) != bufferClasses[0] {
+			t.Fatalf("body buffer cap = %d, want %d", cap(*pkg.buf), bufferClasses[0])
+		}
+		releaseData(pkg)
+	}
+}
+
+func TestGetBufferClasses(t *testing.T) {
+	for _, size := range []int{1, 64, 65, 4096, 65535} {
+		buf := getBuffer(size)
+		if len(*buf) != size {
+			t.Fatalf("getBuffer(%d) len = %d", size, len(*buf))
+		}
+		if cap(*buf) < size || cap(*buf) > 65536 {
+			t.Fatalf("getBuffer(%d) cap = %d", size, cap(*buf))
+		}
+		putBuffer(buf)
+	}
+}
+
+func BenchmarkEncode(b *testing.B) {
+	for _, bs := range benchBodySizes {
+		body := make([]byte, bs.size)
+		b.Run(bs.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(bs.size + 5))
+			for i := 0; i < b.N; i++ {
+				packFrame(1, DATA, body)
+			}
+		})
+	}
+}
+
+// BenchmarkReadPacket 池化的读取路径，每个消息读取后立即回收
+func BenchmarkReadPacket(b *testing.B) {
+	for _, bs := range benchBodySizes {
+		s := newLoopSession(make([]byte, bs.size))
+		b.Run(bs.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(bs.size + 5))
+			for i := 0; i < b.N; i++ {
+				pkg, err := s.readPacket()
+				if err != nil {
+					b.Fatal(err)
+				}
+				releaseData(pkg)
+			}
+		})
+	}
+}
+
+// BenchmarkReadPacketUnpooled 池化之前的读取方式：每个消息分配消息头、Data 和消息体，作为对照
+func BenchmarkReadPacketUnpooled(b *testing.B) {
+	for _, bs := range benchBodySizes {
+		conn := &loopConn{data: packFrame(1, DATA, make([]byte, bs.size))}
+		b.Run(bs.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(bs.size + 5))
+			for i := 0; i < b.N; i++ {
+				head := make([]byte, 5)
+				if _, err := io.ReadFull(conn, head); err != nil {
+					b.Fatal(err)
+				}
+				pkg := &Data{dType: head[2], head: uint16(head[3]) + uint16(head[4])<<8}
+				pkg.body = make([]byte, int(head[0])+int(head[1])<<8)
+				if _, err := io.ReadFull(conn, pkg.body); err != nil {
+					b.Fatal(err)
+				}
+				benchSink = pkg
+			}
+		})
+	}
+}
+
+// benchSink 防止对照基准中的分配被编译器优化掉
+var benchSink *Data
@@ -0,0 +1,78 @@
+package network
+
+// Priority 表示消息的发送优先级，数值越小优先级越高
+type Priority uint8
+
+// 发送优先级常量
+const (
+	PRIORITY_HIGH   Priority = iota // 高优先级：心跳、控制消息和 rpc 响应
+	PRIORITY_NORMAL                 // 普通优先级：默认的数据消息
+	PRIORITY_LOW                    // 低优先级：大块数据
+	PRIORITY_COUNT                  // 优先级的数量
+)
+
+// WriteSchedule 描述写协程在多个优先级队列之间的调度方式。
+// 严格调度总是先发送高优先级队列中的消息；
+// 加权调度每一轮最多从各优先级队列发送 Weights 条消息，避免低优先级饿死。
+type WriteSchedule struct {
+	Weighted bool                // 是否使用加权调度，false 为严格优先级
+	Weights  [PRIORITY_COUNT]int // 加权调度时每一轮各优先级的消息配额
+}
+
+// DefaultWriteSchedule 默认使用严格优先级调度
+var DefaultWriteSchedule = WriteSchedule{Weighted: false, Weights: [PRIORITY_COUNT]int{8, 4, 1}}
+
+// nextPacket 按调度方式取出下一个要发送的消息包，会话释放后返回 false
+func (this *Session) nextPacket() ([]byte, bool) {
+	if this.schedule.Weighted {
+		return this.nextWeighted()
+	}
+	return this.nextStrict()
+}
+
+// nextStrict 严格优先级调度：依次检查高、普通、低优先级队列
+func (this *Session) nextStrict() ([]byte, bool) {
+	for p := range this.outQueues {
+		select {
+		case pkg := <-this.outQueues[p]:
+			return pkg, true
+		default:
+		}
+	}
+	return this.waitPacket()
+}
+
+// nextWeighted 加权调度：在配额内按优先级取消息，配额用完或有配额的队列都为空时开始新一轮
+func (this *Session) nextWeighted() ([]byte, bool) {
+	for round := 0; round < 2; round++ {
+		for p := range this.outQueues {
+			if this.credits[p] <= 0 {
+				continue
+			}
+			select {
+			case pkg := <-this.outQueues[p]:
+				this.credits[p]--
+				return pkg, true
+			default:
+			}
+		}
+		this.credits = this.schedule.Weights
+	}
+	return this.waitPacket()
+}
+
+// waitPacket 所有队列都为空时阻塞等待任意队列的消息
+func (this *Session) waitPacket() ([]byte, bool) {
+	select {
+	case pkg := <-this.outQueues[PRIORITY_HIGH]:
+		return pkg, true
+	case pkg := <-this.outQueues[PRIORITY_NORMAL]:
+		return pkg, true
+	case pkg := <-this.outQueues[PRIORITY_LOW]:
+		return pkg, true
+	case <-this.cClose:
+		return nil, false
+	case <-this.done:
+		return nil, false
+	}
+}
@@ -0,0 +1,91 @@
+package network
+
+import (
+	"bytes"
+	"testing"
+)
+
+// queuedSession 返回一个没有启动写协程的会话，各优先级队列中放入 counts 个消息包，
+// 消息包的第一个字节为其优先级
+func queuedSession(schedule WriteSchedule, counts [PRIORITY_COUNT]int) *Session {
+	s := CreateSession(readerConn{bytes.NewReader(nil)}, func(uint16, uint16, []byte) {})
+	s.SetWriteSchedule(schedule)
+	// 低优先级的大块数据最先入队
+	for p := PRIORITY_COUNT - 1; ; p-- {
+		for i := 0; i < counts[p]; i++ {
+			s.outQueues[p] <- []byte{byte(p)}
+		}
+		if p == PRIORITY_HIGH {
+			break
+		}
+	}
+	return s
+}
+
+// takePriorities 按调度顺序取出 n 个消息包，返回它们的优先级
+func takePriorities(t *testing.T, s *Session, n int) []Priority {
+	t.Helper()
+	order := make([]Priority, 0, n)
+	for i := 0; i < n; i++ {
+		pkg, ok := s.nextPacket()
+		if !ok {
+			t.Fatal("session released")
+		}
+		order = append(order, Priority(pkg[0]))
+	}
+	return order
+}
+
+// TestStrictSchedule 严格调度时后入队的高优先级消息先于已排队的大块数据发送
+func TestStrictSchedule(t *testing.T) {
+	s := queuedSession(DefaultWriteSchedule, [PRIORITY_COUNT]int{2, 2, 10})
+	order := takePriorities(t, s, 14)
+	want := []Priority{PRIORITY_HIGH, PRIORITY_HIGH, PRIORITY_NORMAL, PRIORITY_NORMAL}
+	for i, p := range want {
+		if order[i] != p {
+			t.Fatalf("strict order %v, want prefix %v", order, want)
+		}
+	}
+	for _, p := range order[len(want):] {
+		if p != PRIORITY_LOW {
+			t.Fatalf("strict order %v", order)
+		}
+	}
+}
+
+// TestWeightedSchedule 加权调度时每一轮按配额发送，低优先级队列不会饿死
+func TestWeightedSchedule(t *testing.T) {
+	schedule := WriteSchedule{Weighted: true, Weights: [PRIORITY_COUNT]int{4, 2, 1}}
+	s := queuedSession(schedule, [PRIORITY_COUNT]int{40, 40, 40})
+	order := takePriorities(t, s, 35)
+
+	// 每一轮 7 个消息：4 个高、2 个普通、1 个低
+	for round := 0; round < 5; round++ {
+		var counts [PRIORITY_COUNT]int
+		for _, p := range order[round*7 : round*7+7] {
+			counts[p]++
+		}
+		if counts != schedule.Weights {
+			t.Fatalf("round %d sent %v, want %v (order %v)", round, counts, schedule.Weights, order)
+		}
+	}
+
+	// 对比：严格调度在高优先级队列不空时不发送低优先级消息
+	strict := queuedSession(DefaultWriteSchedule, [PRIORITY_COUNT]int{40, 40, 40})
+	for _, p := range takePriorities(t, strict, 35) {
+		if p == PRIORITY_LOW {
+			t.Fatal("strict schedule sent low priority before high priority was empty")
+		}
+	}
+}
+
+// TestWeightedScheduleIdleLanes 有配额的队列为空时开始新一轮，不会因为配额卡住其他队列
+func TestWeightedScheduleIdleLanes(t *testing.T) {
+	schedule := WriteSchedule{Weighted: true, Weights: [PRIORITY_COUNT]int{4, 2, 1}}
+	s := queuedSession(schedule, [PRIORITY_COUNT]int{0, 0, 5})
+	for i, p := range takePriorities(t, s, 5) {
+		if p != PRIORITY_LOW {
+			t.Fatalf("packet %d has priority %d", i, p)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package network
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// ErrProxy 表示代理服务器拒绝了连接请求或回复无法解析
+var ErrProxy = errors.New("network: proxy error")
+
+// proxyConfig 代理服务器设置
+type proxyConfig struct {
+	scheme   string // socks5 或 http
+	addr     string // 代理服务器地址
+	user     *url.Userinfo
+	hasCreds bool
+}
+
+// SetProxy 设置客户端通过代理服务器连接，在 Dial 之前调用，rawURL 为空时直接连接。
+// 支持 "socks5://[user:pass@]host:port"（用户名密码认证）和 "http://[user:pass@]host:port"（HTTP CONNECT，Basic 认证）。
+// 断线恢复和故障转移的重新连接同样经过代理。只有 TCP 地址可以经过代理，
+// 设置了代理时连接 "tls://"、"ws://" 等其他传输方式的地址返回 ErrProxy，而不是绕过代理直接连接。
+func (this *TcpClient) SetProxy(rawURL string) error {
+	if rawURL == "" {
+		this.proxy = nil
+		return nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "socks5", "http":
+	default:
+		return fmt.Errorf("%w: unsupported scheme %q", ErrProxy, u.Scheme)
+	}
+	if u.Port() == "" {
+		return fmt.Errorf("%w: missing port in %q", ErrProxy, rawURL)
+	}
+	this.proxy = &proxyConfig{scheme: u.Scheme, addr: u.Host, user: u.User, hasCreds: u.User != nil}
+	return nil
+}
+
+// dial 建立到 addr 的连接，addr 带有 scheme 时使用对应的传输方式，否则建立 TCP 连接，设置了代理时经过代理服务器
+func (this *TcpClient) dial(ctx context.Context, addr string) (net.Conn, error) {
+	scheme, host := splitScheme(addr)
+	if scheme != "tcp" {
+		// 其他传输方式不经过代理，直接连接可能绕过只允许代理出口的网络策略
+		if this.proxy != nil {
+			return nil, fmt.Errorf("%w: %s transport cannot be dialed through a proxy", ErrProxy, scheme)
+		}
+		return this.dialTransport(ctx, scheme, host)
+	}
+	addr = host
+	dialer := net.Dialer{Timeout: this.dialTimeout}
+	if this.proxy == nil {
+		return dialer.DialContext(ctx, "tcp", addr)
+	}
+
+	conn, err := dialer.DialContext(ctx, "tcp", this.proxy.addr)
+	if err != nil {
+		return nil, err
+	}
+	// 与代理服务器的握手同样受拨号超时和 ctx 的限制
+	deadline, ok := ctx.Deadline()
+	if this.dialTimeout > 0 {
+		if d := time.Now().Add(this.dialTimeout); !ok || d.Before(deadline) {
+			deadline, ok = d, true
+		}
+	}
+	if ok {
+		conn.SetDeadline(deadline)
+	}
+	if this.proxy.scheme == "socks5" {
+		err = this.proxy.socks5Connect(conn, addr)
+	} else {
+		conn, err = this.proxy.httpConnect(conn, addr)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// socks5Connect 在 SOCKS5 代理连接上完成认证并请求连接 addr
+func (this *proxyConfig) socks5Connect(conn net.Conn, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 65535 {
+		return fmt.Errorf("%w: bad port %q", ErrProxy, portStr)
+	}
+
+	// 协商认证方式：0 为无需认证，2 为用户名密码
+	methods := []byte{0}
+	if this.hasCreds {
+		methods = []byte{0, 2}
+	}
+	if _, err := conn.Write(append([]byte{5, uint8(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 5 {
+		return fmt.Errorf("%w: not a socks5 proxy", ErrProxy)
+	}
+	switch reply[1] {
+	case 0:
+	case 2:
+		if !this.hasCreds {
+			return fmt.Errorf("%w: socks5 proxy requires authentication", ErrProxy)
+		}
+		user := this.user.Username()
+		pass, _ := this.user.Password()
+		if len(user) > 255 || len(pass) > 255 {
+			return fmt.Errorf("%w: socks5 credentials too long", ErrProxy)
+		}
+		req := append([]byte{1, uint8(len(user))}, user...)
+		req = append(append(req, uint8(len(pass))), pass...)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return fmt.Errorf("%w: socks5 authentication failed", ErrProxy)
+		}
+	default:
+		return fmt.Errorf("%w: no acceptable socks5 auth method", ErrProxy)
+	}
+
+	// 请求连接目标地址
+	req := []byte{5, 1, 0}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			req = append(append(req, 1), ip4...)
+		} else {
+			req = append(append(req, 4), ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return fmt.Errorf("%w: host name too long", ErrProxy)
+		}
+		req = append(append(req, 3, uint8(len(host))), host...)
+	}
+	req = append(req, uint8(port>>8), uint8(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	// 回复为 VER REP RSV ATYP BND.ADDR BND.PORT
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return err
+	}
+	if head[1] != 0 {
+		return fmt.Errorf("%w: socks5 connect failed with code %d", ErrProxy, head[1])
+	}
+	var size int
+	switch head[3] {
+	case 1:
+		size = net.IPv4len
+	case 4:
+		size = net.IPv6len
+	case 3:
+		b := make([]byte, 1)
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return err
+		}
+		size = int(b[0])
+	default:
+		return fmt.Errorf("%w: bad socks5 address type %d", ErrProxy, head[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, size+2))
+	return err
+}
+
+// httpConnect 通过 HTTP CONNECT 请求代理服务器建立到 addr 的隧道
+func (this *proxyConfig) httpConnect(conn net.Conn, addr string) (net.Conn, error) {
+	req := "CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n"
+	if this.hasCreds {
+		pass, _ := this.user.Password()
+		creds := base64.StdEncoding.EncodeToString([]byte(this.user.Username() + ":" + pass))
+		req += "Proxy-Authorization: Basic " + creds + "\r\n"
+	}
+	req += "\r\n"
+	if _, err := io.WriteString(conn, req); err != nil {
+		return conn, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return conn, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return conn, fmt.Errorf("%w: http connect: %s", ErrProxy, resp.Status)
+	}
+	// 服务端先发送的数据可能已经读入缓冲区
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn 先读出缓冲区中已读取的数据，再从连接读取
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// Read 从缓冲区或连接读取数据
+func (this *bufferedConn) Read(b []byte) (int, error) {
+	return this.reader.Read(b)
+}
@@ -0,0 +1,244 @@
+package network
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"runtime"
+	"strconv"
+	"testing"
+)
+
+// listenLocal 在 127.0.0.1 的随机端口上监听，每个连接交给 serve 处理
+func listenLocal(t *testing.T, serve func(net.Conn)) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lis.Close() })
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+	return lis.Addr().String()
+}
+
+// relay 在两个连接之间双向转发数据，任一方向结束时关闭两个连接
+func relay(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	go func() { io.Copy(a, b); done <- struct{}{} }()
+	go func() { io.Copy(b, a); done <- struct{}{} }()
+	<-done
+	a.Close()
+	b.Close()
+}
+
+// socks5StandIn 一个最小的 SOCKS5 代理，user 不为空时要求用户名密码认证，code 不为 0 时以该回复码拒绝连接请求
+func socks5StandIn(t *testing.T, user, pass string, code byte) string {
+	return listenLocal(t, func(conn net.Conn) {
+		defer conn.Close()
+		head := make([]byte, 2)
+		if _, err := io.ReadFull(conn, head); err != nil {
+			return
+		}
+		if _, err := io.ReadFull(conn, make([]byte, head[1])); err != nil {
+			return
+		}
+		if user == "" {
+			conn.Write([]byte{5, 0})
+		} else {
+			conn.Write([]byte{5, 2})
+			b := make([]byte, 2)
+			io.ReadFull(conn, b)
+			u := make([]byte, b[1])
+			io.ReadFull(conn, u)
+			io.ReadFull(conn, b[:1])
+			p := make([]byte, b[0])
+			io.ReadFull(conn, p)
+			if string(u) != user || string(p) != pass {
+				conn.Write([]byte{1, 1})
+				return
+			}
+			conn.Write([]byte{1, 0})
+		}
+
+		req := make([]byte, 4)
+		if _, err := io.ReadFull(conn, req); err != nil {
+			return
+		}
+		var host string
+		switch req[3] {
+		case 1:
+			ip := make([]byte, net.IPv4len)
+			io.ReadFull(conn, ip)
+			host = net.IP(ip).String()
+		case 3:
+			n := make([]byte, 1)
+			io.ReadFull(conn, n)
+			name := make([]byte, n[0])
+			io.ReadFull(conn, name)
+			host = string(name)
+		default:
+			return
+		}
+		port := make([]byte, 2)
+		io.ReadFull(conn, port)
+		reply := []byte{5, code, 0, 1, 0, 0, 0, 0, 0, 0}
+		if code != 0 {
+			conn.Write(reply)
+			return
+		}
+		target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1]))))
+		if err != nil {
+			reply[1] = 5
+			conn.Write(reply)
+			return
+		}
+		conn.Write(reply)
+		relay(conn, target)
+	})
+}
+
+// httpStandIn 一个最小的 HTTP CONNECT 代理，user 不为空时要求 Basic 认证，status 不为 200 时以该状态码拒绝
+func httpStandIn(t *testing.T, user, pass string, status int) string {
+	return listenLocal(t, func(conn net.Conn) {
+		defer conn.Close()
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil || req.Method != http.MethodConnect {
+			return
+		}
+		if user != "" {
+			want := "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass))
+			if req.Header.Get("Proxy-Authorization") != want {
+				io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+				return
+			}
+		}
+		if status != http.StatusOK {
+			io.WriteString(conn, "HTTP/1.1 "+strconv.Itoa(status)+" "+http.StatusText(status)+"\r\n\r\n")
+			return
+		}
+		target, err := net.Dial("tcp", req.Host)
+		if err != nil {
+			io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+			return
+		}
+		io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n")
+		relay(conn, target)
+	})
+}
+
+func TestProxyDial(t *testing.T) {
+	sh := newTestHandler()
+	srv := NewTcpServer(sh, "127.0.0.1:0")
+	startServer(t, srv, 1)
+	target := srv.Addrs()[0].String()
+
+	cases := []struct {
+		name  string
+		proxy func(t *testing.T) string // 启动代理并返回代理 URL
+		ok    bool
+	}{
+		{"socks5", func(t *testing.T) string {
+			return "socks5://alice:secret@" + socks5StandIn(t, "alice", "secret", 0)
+		}, true},
+		{"socks5 no auth", func(t *testing.T) string {
+			return "socks5://" + socks5StandIn(t, "", "", 0)
+		}, true},
+		{"socks5 bad password", func(t *testing.T) string {
+			return "socks5://alice:wrong@" + socks5StandIn(t, "alice", "secret", 0)
+		}, false},
+		{"socks5 refused", func(t *testing.T) string {
+			return "socks5://" + socks5StandIn(t, "", "", 5)
+		}, false},
+		{"http", func(t *testing.T) string {
+			return "http://bob:secret@" + httpStandIn(t, "bob", "secret", http.StatusOK)
+		}, true},
+		{"http bad password", func(t *testing.T) string {
+			return "http://bob:wrong@" + httpStandIn(t, "bob", "secret", http.StatusOK)
+		}, false},
+		{"http refused", func(t *testing.T) string {
+			return "http://" + httpStandIn(t, "", "", http.StatusForbidden)
+		}, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ch := newTestHandler()
+			client := NewTcpClient(ch)
+			if err := client.SetProxy(c.proxy(t)); err != nil {
+				t.Fatal(err)
+			}
+			err := client.Dial(target)
+			if !c.ok {
+				if !errors.Is(err, ErrProxy) {
+					t.Fatalf("Dial = %v, want ErrProxy", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(client.Close)
+			s := ch.waitConnect(t)
+			sh.waitConnect(t)
+			if err := client.Write(s, 7, []byte("via proxy")); err != nil {
+				t.Fatal(err)
+			}
+			if m := sh.waitMessage(t); m.head != 7 || string(m.body) != "via proxy" {
+				t.Fatalf("server got %d %q", m.head, m.body)
+			}
+		})
+	}
+}
+
+// TestPrepareConnUnwrapsBuffered HTTP 代理返回的 bufferedConn 同样应用套接字选项
+func TestPrepareConnUnwrapsBuffered(t *testing.T) {
+	server, _ := tcpPair(t)
+	c := NewTcpClientWithOptions(newTestHandler(), SocketOptions{Nagle: true})
+	conn := &bufferedConn{Conn: server, reader: bufio.NewReader(server)}
+	wrapped, applied := c.prepareConn(conn)
+	if wrapped != net.Conn(conn) {
+		t.Fatal("prepareConn replaced the buffered connection")
+	}
+	if runtime.GOOS != "linux" {
+		return
+	}
+	// 从套接字读回，确认选项确实设置到了被包装的连接上
+	actual, err := readSocketOptions(server, SocketOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !actual.Nagle || !applied.Nagle {
+		t.Fatal("socket options not applied through bufferedConn")
+	}
+}
+
+// TestProxyOtherTransport 设置了代理时其他传输方式的地址返回 ErrProxy，不会绕过代理直接连接
+func TestProxyOtherTransport(t *testing.T) {
+	sh := newTestHandler()
+	startServer(t, NewTcpServer(sh, memAddress(t)), 1)
+
+	c := NewTcpClient(newTestHandler())
+	if err := c.SetProxy("socks5://127.0.0.1:1"); err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range []string{memAddress(t), "ws://127.0.0.1:1/game", "tls://127.0.0.1:1"} {
+		if err := c.Dial(addr); !errors.Is(err, ErrProxy) {
+			t.Fatalf("Dial(%s) = %v, want ErrProxy", addr, err)
+		}
+	}
+	select {
+	case <-sh.connect:
+		t.Fatal("mem server reached without the proxy")
+	default:
+	}
+}
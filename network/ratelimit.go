@@ -0,0 +1,201 @@
+package network
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrRateLimited 表示对端发送消息的速率超过限制，会话被断开
+var ErrRateLimited = errors.New("network: rate limited")
+
+// RateAction 表示对端超过速率限制时的处理方式
+type RateAction uint8
+
+// 超过速率限制时的处理方式
+const (
+	RATE_DELAY      RateAction = iota // 暂停读取直到令牌足够，依靠 TCP 的背压减慢对端
+	RATE_DROP                         // 丢弃超出限制的消息
+	RATE_DISCONNECT                   // 断开会话，关闭原因为 CLOSE_RATE_LIMITED
+)
+
+// rateActionNames 处理方式的名称，用于统计
+var rateActionNames = [...]string{
+	RATE_DELAY:      "delay",
+	RATE_DROP:       "drop",
+	RATE_DISCONNECT: "disconnect",
+}
+
+// String 返回处理方式的名称
+func (this RateAction) String() string {
+	if int(this) < len(rateActionNames) {
+		return rateActionNames[this]
+	}
+	return "unknown"
+}
+
+// RateLimit 描述会话接收消息的令牌桶限制，消息数和字节数分别计算，任一超过即视为违规。
+// 令牌按每秒的速率补充，桶的容量即允许的突发量，容量为 0 时等于每秒的速率。
+// 使用 RATE_DROP 或 RATE_DISCONNECT 时字节桶的容量应不小于最大的消息体，否则大消息永远无法通过。
+type RateLimit struct {
+	Messages     int        // 每秒允许的消息数，0 表示不限制
+	MessageBurst int        // 消息数的突发上限
+	Bytes        int        // 每秒允许的消息体字节数，0 表示不限制
+	ByteBurst    int        // 字节数的突发上限
+	Action       RateAction // 超过限制时的处理方式
+}
+
+// rateConfig 速率限制设置，建立会话后只读
+type rateConfig struct {
+	limit RateLimit            // 默认限制，作用于所有消息
+	heads map[uint16]RateLimit // 按消息头覆盖的限制，匹配的数据消息不再计入默认限制
+}
+
+// tokenBucket 令牌桶
+type tokenBucket struct {
+	rate   float64   // 每秒补充的令牌数
+	burst  float64   // 桶的容量
+	tokens float64   // 当前的令牌数，延迟模式下可以为负数，表示欠下的令牌
+	last   time.Time // 上次补充令牌的时间
+}
+
+// newTokenBucket 创建一个装满令牌的令牌桶，rate 为 0 时返回 nil 表示不限制
+func newTokenBucket(rate, burst int) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = rate
+	}
+	return &tokenBucket{rate: float64(rate), burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// refill 按经过的时间补充令牌
+func (this *tokenBucket) refill(now time.Time) {
+	this.tokens += now.Sub(this.last).Seconds() * this.rate
+	if this.tokens > this.burst {
+		this.tokens = this.burst
+	}
+	this.last = now
+}
+
+// wait 返回令牌足够取出 n 个之前还需等待的时间
+func (this *tokenBucket) wait(n float64) time.Duration {
+	if this == nil || this.tokens >= n {
+		return 0
+	}
+	return time.Duration((n - this.tokens) / this.rate * float64(time.Second))
+}
+
+// take 取出 n 个令牌
+func (this *tokenBucket) take(n float64) {
+	if this != nil {
+		this.tokens -= n
+	}
+}
+
+// rateBuckets 一个限制对应的消息数和字节数令牌桶
+type rateBuckets struct {
+	action   RateAction
+	messages *tokenBucket
+	bytes    *tokenBucket
+}
+
+// newRateBuckets 按限制创建令牌桶
+func newRateBuckets(limit RateLimit) *rateBuckets {
+	return &rateBuckets{
+		action:   limit.Action,
+		messages: newTokenBucket(limit.Messages, limit.MessageBurst),
+		bytes:    newTokenBucket(limit.Bytes, limit.ByteBurst),
+	}
+}
+
+// rateState 会话的速率限制状态，只在读协程中访问
+type rateState struct {
+	buckets *rateBuckets            // 默认限制的令牌桶
+	heads   map[uint16]*rateBuckets // 按消息头覆盖的令牌桶，首次收到时创建
+}
+
+// limitRate 检查收到的消息是否超过速率限制。
+// 返回 true 表示消息可以继续处理；延迟模式下会在读协程中等待令牌足够，
+// 丢弃模式下返回 false，断开模式下返回 ErrRateLimited。
+func (this *Session) limitRate(pkg *Data) (bool, error) {
+	wait, ok, err := this.checkRate(pkg)
+	if wait > 0 && !this.sleep(wait) {
+		return false, ErrClosed
+	}
+	return ok, err
+}
+
+// checkRate 检查收到的消息是否超过速率限制，返回值与 limitRate 相同，
+// 延迟模式下不等待，而是取出令牌并返回调用方需要暂停读取的时间。
+func (this *Session) checkRate(pkg *Data) (time.Duration, bool, error) {
+	if this.rate == nil {
+		return 0, true, nil
+	}
+
+	buckets := this.rateBucketsFor(pkg)
+	if buckets == nil {
+		return 0, true, nil
+	}
+
+	now := time.Now()
+	size := float64(len(pkg.body))
+	if buckets.messages != nil {
+		buckets.messages.refill(now)
+	}
+	if buckets.bytes != nil {
+		buckets.bytes.refill(now)
+	}
+
+	wait := buckets.messages.wait(1)
+	if d := buckets.bytes.wait(size); d > wait {
+		wait = d
+	}
+	if wait > 0 {
+		metrics.add("session.ratelimit."+buckets.action.String(), 1)
+		switch buckets.action {
+		case RATE_DROP:
+			return 0, false, nil
+		case RATE_DISCONNECT:
+			return 0, false, ErrRateLimited
+		}
+	}
+
+	// 延迟模式下令牌可以欠下，等待结束时正好补足
+	buckets.messages.take(1)
+	buckets.bytes.take(size)
+	return wait, true, nil
+}
+
+// rateBucketsFor 返回消息适用的令牌桶，数据消息优先使用按消息头覆盖的限制
+func (this *Session) rateBucketsFor(pkg *Data) *rateBuckets {
+	if pkg.dType == DATA {
+		if limit, ok := this.rate.heads[pkg.head]; ok {
+			buckets, ok := this.rateState.heads[pkg.head]
+			if !ok {
+				if this.rateState.heads == nil {
+					this.rateState.heads = make(map[uint16]*rateBuckets)
+				}
+				buckets = newRateBuckets(limit)
+				this.rateState.heads[pkg.head] = buckets
+			}
+			return buckets
+		}
+	}
+	if this.rateState.buckets == nil {
+		this.rateState.buckets = newRateBuckets(this.rate.limit)
+	}
+	return this.rateState.buckets
+}
+
+// sleep 在读协程中等待 d 时长，会话关闭时提前返回 false
+func (this *Session) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-this.closingChan():
+		return false
+	}
+}
@@ -0,0 +1,39 @@
+package network
+
+import (
+	"testing"
+	"time"
+)
+
+// dropLimit 几乎所有消息都被丢弃的速率限制
+var dropLimit = RateLimit{Messages: 1, MessageBurst: 1, Action: RATE_DROP}
+
+// sendThroughDrops 以很小的流量控制窗口连续发送消息体为 body 的消息，
+// 服务端丢弃的消息需要归还额度，否则发送会因额度用完而失败；metric 统计丢弃的次数
+func sendThroughDrops(t *testing.T, addr string, body []byte, metric string) {
+	t.Helper()
+	ch := newTestHandler()
+	c := NewTcpClient(ch)
+	c.SetFlowControl(FlowControl{Window: 4, Block: true, Timeout: 2 * time.Second})
+	s := dialClient(t, c, ch, addr)
+	waitFor(t, "flow control", s.flowState.enabled.Load)
+
+	before := Metrics()[metric]
+	for i := 0; i < 20; i++ {
+		if err := c.Write(s, uint16(i), body); err != nil {
+			t.Fatalf("write %d: %v", i, err)
+		}
+	}
+	if Metrics()[metric] == before {
+		t.Fatal("no message was dropped")
+	}
+}
+
+func TestRateDropReturnsCredit(t *testing.T) {
+	sh := newTestHandler()
+	srv := NewTcpServer(sh, memAddress(t))
+	srv.SetFlowControl(FlowControl{Window: 4})
+	srv.SetRateLimit(dropLimit)
+	startServer(t, srv, 1)
+	sendThroughDrops(t, memAddress(t), nil, "session.ratelimit.drop")
+}
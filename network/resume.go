@@ -0,0 +1,542 @@
+package network
+
+import (
+	"github.com/lizhen1412/eegos/log"
+
+	"bufio"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrResumeRejected 表示对端拒绝恢复会话，会话状态已经过期或者丢失的消息无法补发
+var ErrResumeRejected = errors.New("network: session resume rejected")
+
+// ErrResumeReplaced 表示会话的旧连接被恢复请求的新连接替换
+var ErrResumeReplaced = errors.New("network: connection replaced by resume")
+
+// Resumption 描述断线后的会话恢复。
+// 双方在握手中协商，服务端为会话分配恢复令牌；连接因网络原因断开后，
+// 服务端在 Timeout 内保留会话状态而不通知 Handler.Close，客户端在 Timeout 内不断重连并携带令牌恢复会话。
+// 恢复后 Session 对象和会话标识保持不变，双方补发对端没有收到的数据消息，发送队列中的消息继续发送。
+// 主动关闭、踢出、违反协议和超过速率限制的会话不会被恢复；
+// 服务端无法区分对端正常断开和网络中断，收到 EOF 时也会等待恢复，处理器在 Timeout 之后才收到关闭通知。
+type Resumption struct {
+	Buffer  int           // 最多保留多少条对端还未确认的数据消息，超出后丢弃最早的消息，需要补发已丢弃的消息时恢复失败
+	Timeout time.Duration // 断线后保留会话状态等待恢复的时间
+}
+
+// 恢复令牌的长度
+const resumeTokenSize = 16
+
+// 恢复请求等待旧连接断开并进入等待恢复状态的时间，超时后拒绝恢复
+const resumeWait = time.Second
+
+// 客户端重连的间隔，从最小值开始每次翻倍
+const (
+	resumeRetryMin = 100 * time.Millisecond
+	resumeRetryMax = 2 * time.Second
+)
+
+// resumeState 会话的恢复状态。
+// 发送方给握手后的数据消息依次编号并保留到对端确认，接收方对收到的数据消息计数并定期确认，
+// 恢复时双方交换收到的消息数，据此补发对端没有收到的消息。
+type resumeState struct {
+	enabled    bool                  // 握手协商后启用，只在读协程中修改
+	token      [resumeTokenSize]byte // 恢复令牌
+	peerBuffer uint32                // 对端保留的消息数，决定确认的频率
+	recording  atomic.Bool           // 写协程写出握手响应后开始记录发送的数据消息
+	receiving  bool                  // 读协程读到握手响应后开始对收到的数据消息计数
+	lock       sync.Mutex            // 保护 sent 和 pending
+	sent       uint32                // 已发送的数据消息数，即最后一条消息的编号
+	pending    [][]byte              // 对端还未确认的消息，最后一条的编号为 sent
+	recv       atomic.Uint32         // 收到的数据消息数
+	acked      uint32                // 最后一次确认给对端的消息数
+}
+
+// offerResume 客户端在握手请求中申请会话恢复
+func (this *Session) offerResume(offer hsOptions) {
+	if this.resume != nil {
+		offer[HS_RESUME] = encodeUint32(uint32(this.resume.Buffer))
+	}
+}
+
+// acceptResume 服务端处理握手请求中的会话恢复申请，分配令牌并写入握手响应
+func (this *Session) acceptResume(offer, ret hsOptions) {
+	value, ok := offer[HS_RESUME]
+	if !ok || this.resume == nil || len(value) != 4 {
+		return
+	}
+	if _, err := io.ReadFull(rand.Reader, this.resumeState.token[:]); err != nil {
+		log.Error("resume token", err)
+		return
+	}
+	this.resumeState.peerBuffer = decodeUint32(value)
+	this.resumeState.enabled = true
+	if this.registry != nil {
+		this.registry.add(this)
+	}
+
+	ret[HS_RESUME] = append(append([]byte{}, this.resumeState.token[:]...), encodeUint32(uint32(this.resume.Buffer))...)
+}
+
+// finishResume 客户端处理握手响应中的恢复令牌，此后收到的数据消息开始计数
+func (this *Session) finishResume(ret hsOptions) {
+	value, ok := ret[HS_RESUME]
+	if !ok || this.resume == nil || len(value) != resumeTokenSize+4 {
+		return
+	}
+	copy(this.resumeState.token[:], value)
+	this.resumeState.peerBuffer = decodeUint32(value[resumeTokenSize:])
+	this.resumeState.enabled = true
+	this.resumeState.receiving = true
+}
+
+// markWritten 写协程写出消息后调用，写出握手响应后开始记录发送的数据消息
+func (this *Session) markWritten(pkg []byte) {
+	if pkg[2] == HANDSHAKE_RET && this.resumeState.enabled {
+		this.resumeState.recording.Store(true)
+	}
+}
+
+// recordSent 写协程写出数据消息前记录消息，保留到对端确认，超出上限时丢弃最早的消息
+func (this *Session) recordSent(pkg []byte) {
+	if pkg[2] != DATA || !this.resumeState.recording.Load() {
+		return
+	}
+	this.resumeState.lock.Lock()
+	this.resumeState.sent++
+	this.resumeState.pending = append(this.resumeState.pending, pkg)
+	if len(this.resumeState.pending) > this.resume.Buffer {
+		this.resumeState.pending[0] = nil
+		this.resumeState.pending = this.resumeState.pending[1:]
+		metrics.add("session.resume.overflow", 1)
+	}
+	this.resumeState.lock.Unlock()
+}
+
+// countReceived 读协程收到数据消息后计数，累计到对端保留上限的一半时确认
+func (this *Session) countReceived() {
+	if !this.resumeState.receiving {
+		return
+	}
+	recv := this.resumeState.recv.Add(1)
+	interval := this.resumeState.peerBuffer / 2
+	if interval == 0 {
+		interval = 1
+	}
+	if recv-this.resumeState.acked >= interval {
+		this.resumeState.acked = recv
+		this.doWrite(0, RESUME_ACK, encodeUint32(recv), PRIORITY_HIGH)
+	}
+}
+
+// ackSent 处理对端的确认，丢弃对端已经收到的消息
+func (this *Session) ackSent(body []byte) {
+	if len(body) != 4 || !this.resumeState.enabled {
+		return
+	}
+	this.resumeState.lock.Lock()
+	defer this.resumeState.lock.Unlock()
+	unacked := this.resumeState.sent - decodeUint32(body)
+	if int(unacked) < len(this.resumeState.pending) {
+		for i := 0; i < len(this.resumeState.pending)-int(unacked); i++ {
+			this.resumeState.pending[i] = nil
+		}
+		this.resumeState.pending = this.resumeState.pending[len(this.resumeState.pending)-int(unacked):]
+	}
+}
+
+// unacked 根据对端收到的消息数返回需要补发的消息，需要补发的消息已被丢弃时返回 ErrResumeRejected
+func (this *Session) unacked(peerRecv uint32) ([][]byte, error) {
+	this.resumeState.lock.Lock()
+	defer this.resumeState.lock.Unlock()
+	unacked := this.resumeState.sent - peerRecv
+	if int64(unacked) > int64(len(this.resumeState.pending)) {
+		return nil, ErrResumeRejected
+	}
+	this.resumeState.pending = this.resumeState.pending[len(this.resumeState.pending)-int(unacked):]
+	return append([][]byte{}, this.resumeState.pending...), nil
+}
+
+// resumableReason 判断以 reason 断开的会话是否可以等待恢复，只有网络原因的断开可以恢复
+func resumableReason(reason CloseReason) bool {
+	switch reason {
+	case CLOSE_EOF, CLOSE_READ_ERROR, CLOSE_WRITE_ERROR, CLOSE_HEARTBEAT_TIMEOUT:
+		return true
+	}
+	return false
+}
+
+// resumable 判断会话是否因网络原因断开，可以尝试等待恢复，最终由 park 决定
+func (this *Session) resumable() bool {
+	if this.resume == nil || !this.resumeState.enabled {
+		return false
+	}
+	this.closeLock.Lock()
+	defer this.closeLock.Unlock()
+	return resumableReason(this.closeInfo.Reason)
+}
+
+// park 在读协程退出后保留会话等待恢复，返回断开的原因和本次等待期间的关闭通道。
+// 等待写协程退出后在 closeLock 内重置关闭状态，期间写入的消息继续进入发送队列，恢复后发送；
+// 会话在此之前被主动关闭时不再恢复，以主动关闭的原因作为关闭原因并返回 false。
+func (this *Session) park() (CloseInfo, chan struct{}, bool) {
+	<-this.writeDone
+	// 流上的消息不会补发，断线时重置所有的流
+	this.closeStreams(ErrStreamReset)
+
+	this.closeLock.Lock()
+	defer this.closeLock.Unlock()
+	if this.abandoned != nil {
+		this.closeInfo = *this.abandoned
+	}
+	if this.abandoned != nil || !resumableReason(this.closeInfo.Reason) {
+		return this.closeInfo, nil, false
+	}
+	info := this.closeInfo
+	this.closeInfo = CloseInfo{}
+	this.closeSet = false
+	this.closing = make(chan struct{})
+	this.closingSet = false
+	this.state.Store(WORKING)
+	return info, this.closing, true
+}
+
+// reattach 把等待恢复的会话绑定到新的连接上
+func (this *Session) reattach(conn io.ReadWriteCloser, reader *bufio.Reader) {
+	this.closeLock.Lock()
+	this.conn = conn
+	this.closeLock.Unlock()
+	this.reader = reader
+	this.cClose = make(chan bool)
+}
+
+// replay 在启动读写协程之前把 first 和需要补发的消息直接写到连接上，保证补发的消息先于发送队列中的消息
+func (this *Session) replay(first []byte, pkgs [][]byte) error {
+	buf := first
+	for _, pkg := range pkgs {
+		// 恢复后双方沿用协商的校验和，恢复请求和响应本身不带校验和
+		if this.crc.writing.Load() {
+			pkg = withChecksum(pkg)
+		}
+		buf = append(buf, pkg...)
+	}
+	metrics.add("session.resume.replayed", uint64(len(pkgs)))
+	_, err := this.conn.Write(buf)
+	return err
+}
+
+// parkedSession 服务端等待恢复的会话
+type parkedSession struct {
+	session *Session
+	info    CloseInfo     // 断开的原因，超时后通知处理器
+	closing chan struct{} // 等待期间会话被主动关闭时关闭
+	resumed chan struct{} // 会话恢复后关闭
+}
+
+// resumeRegistry 服务端启用断线恢复的会话，以恢复令牌作为键
+type resumeRegistry struct {
+	lock    sync.Mutex
+	live    map[[resumeTokenSize]byte]*Session       // 协商了断线恢复且还未关闭的会话
+	parked  map[[resumeTokenSize]byte]*parkedSession // 断线后等待恢复的会话
+	changed chan struct{}                            // 有会话开始等待恢复时关闭并替换
+}
+
+// newResumeRegistry 创建一个空的 resumeRegistry
+func newResumeRegistry() *resumeRegistry {
+	return &resumeRegistry{
+		live:    make(map[[resumeTokenSize]byte]*Session),
+		parked:  make(map[[resumeTokenSize]byte]*parkedSession),
+		changed: make(chan struct{}),
+	}
+}
+
+// add 记录协商了断线恢复的会话
+func (this *resumeRegistry) add(s *Session) {
+	this.lock.Lock()
+	this.live[s.resumeState.token] = s
+	this.lock.Unlock()
+}
+
+// remove 会话释放后移除记录
+func (this *resumeRegistry) remove(s *Session) {
+	this.lock.Lock()
+	if this.live[s.resumeState.token] == s {
+		delete(this.live, s.resumeState.token)
+	}
+	this.lock.Unlock()
+}
+
+// park 记录等待恢复的会话并唤醒等待中的恢复请求
+func (this *resumeRegistry) park(entry *parkedSession) {
+	this.lock.Lock()
+	this.parked[entry.session.resumeState.token] = entry
+	close(this.changed)
+	this.changed = make(chan struct{})
+	this.lock.Unlock()
+}
+
+// unpark 取出等待恢复的会话，不存在时返回 nil
+func (this *resumeRegistry) unpark(token [resumeTokenSize]byte) *parkedSession {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	entry := this.parked[token]
+	delete(this.parked, token)
+	return entry
+}
+
+// take 取出令牌对应的会话用于恢复。
+// 服务端可能还没有发现旧连接已经断开，此时关闭旧连接，等待会话进入等待恢复状态后取出。
+func (this *resumeRegistry) take(token [resumeTokenSize]byte) *parkedSession {
+	timer := time.NewTimer(resumeWait)
+	defer timer.Stop()
+	for kicked := false; ; kicked = true {
+		this.lock.Lock()
+		entry := this.parked[token]
+		delete(this.parked, token)
+		s := this.live[token]
+		changed := this.changed
+		this.lock.Unlock()
+
+		if entry != nil || s == nil {
+			return entry
+		}
+		if !kicked {
+			s.closeConn(CLOSE_READ_ERROR, ErrResumeReplaced)
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			return nil
+		}
+	}
+}
+
+// SetResumption 为之后建立的会话启用断线恢复，服务端和客户端都需要设置。
+// 服务端启用后根据新连接的第一个消息判断是否为恢复请求：恢复请求恢复原会话，握手或其他消息按新会话处理。
+// 客户端连接后立即发送握手，因此 Connect 不会被推迟；不发送握手的旧版本客户端在发送第一个消息后才通知处理器。
+func (this *TcpConn) SetResumption(resume Resumption) {
+	if resume.Buffer <= 0 || resume.Timeout <= 0 {
+		log.Error("resumption buffer and timeout must be positive")
+		return
+	}
+	this.resume = &resume
+}
+
+// park 保留断开的会话等待恢复，会话不能恢复时返回 false
+func (this *TcpServer) park(s *Session) bool {
+	if !s.resumable() {
+		return false
+	}
+	info, closing, ok := s.park()
+	if !ok {
+		return false
+	}
+	entry := &parkedSession{session: s, info: info, closing: closing, resumed: make(chan struct{})}
+	this.registry.park(entry)
+
+	metrics.add("session.resume.parked", 1)
+	log.Debug("session parked", s.fd, info)
+	go this.expire(entry)
+	return true
+}
+
+// expire 等待会话恢复，超时或者会话被主动关闭时关闭会话并通知处理器
+func (this *TcpServer) expire(entry *parkedSession) {
+	timer := time.NewTimer(entry.session.resume.Timeout)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-entry.closing:
+	case <-entry.resumed:
+		return
+	}
+	if this.registry.unpark(entry.session.resumeState.token) == nil {
+		// 已经被新连接取出
+		return
+	}
+	metrics.add("session.resume.expired", 1)
+	entry.session.setCloseInfo(entry.info.Reason, entry.info.Err)
+	this.Close(entry.session)
+}
+
+// resumeConn 检查新连接的第一个消息是否为恢复请求，是则恢复对应的会话，返回 false 表示按新会话处理。
+// 客户端连接后的第一个消息总是握手或恢复请求，因此不需要定时等待；
+// 设置了心跳超时时，一直不发送消息的连接在超时后关闭。会话 n 只用于读取恢复请求，不会被启动。
+func (this *TcpServer) resumeConn(n *Session) bool {
+	if n.idle > 0 {
+		if deadline, ok := n.conn.(interface{ SetReadDeadline(time.Time) error }); ok {
+			deadline.SetReadDeadline(time.Now().Add(n.idle))
+			defer deadline.SetReadDeadline(time.Time{})
+		}
+	}
+	head, err := n.reader.Peek(5)
+	if err != nil {
+		n.conn.Close()
+		return true
+	}
+	if head[2] != RESUME {
+		return false
+	}
+
+	pkg, err := n.readPacket()
+	if err != nil {
+		n.conn.Close()
+		return true
+	}
+	defer releaseData(pkg)
+
+	var entry *parkedSession
+	if len(pkg.body) == resumeTokenSize+4 {
+		var token [resumeTokenSize]byte
+		copy(token[:], pkg.body)
+		entry = this.registry.take(token)
+	}
+	if entry == nil {
+		metrics.add("session.resume.rejected", 1)
+		n.conn.Write(n.pack(0, RESUME_RET, nil))
+		n.conn.Close()
+		return true
+	}
+	close(entry.resumed)
+
+	s := entry.session
+	// 新连接认证的身份必须与原会话相同，先检查身份再裁剪待确认的消息
+	var replay [][]byte
+	err = ErrResumeRejected
+	if this.auth == nil || sameIdentity(s.identity, n.identity) {
+		replay, err = s.unacked(decodeUint32(pkg.body[resumeTokenSize:]))
+	}
+	if err != nil {
+		metrics.add("session.resume.rejected", 1)
+		n.conn.Write(n.pack(0, RESUME_RET, nil))
+		n.conn.Close()
+		s.setCloseInfo(entry.info.Reason, entry.info.Err)
+		this.Close(s)
+		return true
+	}
+
+	s.reattach(n.conn, n.reader)
+	s.sockOpts = n.sockOpts
+	if err := s.replay(s.pack(0, RESUME_RET, encodeUint32(s.resumeState.recv.Load())), replay); err != nil {
+		s.setCloseInfo(CLOSE_WRITE_ERROR, err)
+		this.Close(s)
+		return true
+	}
+	metrics.add("session.resume.ok", 1)
+	log.Debug("session resumed", s.fd, len(replay))
+	s.Start()
+	go this.processInData(s)
+	return true
+}
+
+// reconnect 客户端连接断开后重新连接服务器并恢复会话，超时、被拒绝或被主动关闭时通知处理器会话关闭
+func (this *TcpClient) reconnect(s *Session) {
+	info, closing, ok := s.park()
+	if !ok {
+		this.connectionLost(s)
+		return
+	}
+	deadline := time.Now().Add(this.resume.Timeout)
+	delay := resumeRetryMin
+	for this.isOpen.Load() {
+		err := this.resumeSession(s)
+		if err == nil {
+			metrics.add("session.resume.ok", 1)
+			log.Debug("session resumed", s.fd)
+			go this.processInData(s)
+			return
+		}
+		log.Debug("resume session", s.fd, err)
+		wait := time.Until(deadline)
+		if err == ErrResumeRejected || errors.Is(err, ErrAuthFailed) || wait <= 0 {
+			break
+		}
+		if wait > delay {
+			wait = delay
+		}
+		select {
+		case <-time.After(wait):
+		case <-closing:
+			wait = 0
+		}
+		if wait == 0 {
+			break
+		}
+		if delay *= 2; delay > resumeRetryMax {
+			delay = resumeRetryMax
+		}
+	}
+	metrics.add("session.resume.expired", 1)
+	s.setCloseInfo(info.Reason, info.Err)
+	this.connectionLost(s)
+}
+
+// resumeSession 建立新连接并发送恢复请求，服务端接受后补发消息并启动会话
+func (this *TcpClient) resumeSession(s *Session) error {
+	conn, err := this.dial(context.Background(), this.Endpoint())
+	if err != nil {
+		return err
+	}
+	conn, applied := this.prepareConn(conn)
+	if this.cipher != nil {
+		fc, err := this.dialCipher(conn)
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		conn = newCipherConn(conn, fc)
+	}
+	if this.auth != nil {
+		if err := this.authDial(conn); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+	s.reattach(conn, bufio.NewReaderSize(conn, readBufferSize))
+
+	body := append(append([]byte{}, s.resumeState.token[:]...), encodeUint32(s.resumeState.recv.Load())...)
+	if _, err := conn.Write(s.pack(0, RESUME, body)); err != nil {
+		conn.Close()
+		return err
+	}
+
+	// 等待服务端的恢复响应
+	timeout := this.dialTimeout
+	if timeout <= 0 {
+		timeout = DefaultDialTimeout
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	pkg, err := s.readPacket()
+	conn.SetReadDeadline(time.Time{})
+	if err == errFrameDropped {
+		err = ErrResumeRejected
+	}
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer releaseData(pkg)
+	if pkg.dType != RESUME_RET || len(pkg.body) != 4 {
+		conn.Close()
+		return ErrResumeRejected
+	}
+
+	replay, err := s.unacked(decodeUint32(pkg.body))
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	s.sockOpts = applied
+	if err := s.replay(nil, replay); err != nil {
+		conn.Close()
+		return err
+	}
+	s.Start()
+	return nil
+}
@@ -0,0 +1,133 @@
+package network
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// resumePair 启动启用断线恢复的服务器并连接一个客户端，客户端的连接经过 FaultNetwork 包装。
+// 返回前双方交换一次消息，保证握手已经完成。
+func resumePair(t *testing.T, timeout time.Duration) (*FaultNetwork, *TcpServer, *testHandler, *Session, *TcpClient, *testHandler, *Session) {
+	t.Helper()
+	resume := Resumption{Buffer: 64, Timeout: timeout}
+	fn := NewFaultNetwork()
+	sh := newTestHandler()
+	srv := NewTcpServer(sh, memAddress(t))
+	srv.SetResumption(resume)
+	startServer(t, srv, 1)
+
+	ch := newTestHandler()
+	c := NewTcpClient(ch)
+	c.SetResumption(resume)
+	c.SetConnWrapper(fn.Wrapper("client", "server"))
+	cs := dialClient(t, c, ch, memAddress(t))
+	ss := sh.waitConnect(t)
+
+	if err := c.Write(cs, 1, []byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	sh.waitMessage(t)
+	if err := srv.Write(ss, 1, []byte("pong")); err != nil {
+		t.Fatal(err)
+	}
+	ch.waitMessage(t)
+	return fn, srv, sh, ss, c, ch, cs
+}
+
+// TestResumeConnectNotDelayed 服务端启用断线恢复后，不启用恢复的客户端也立即得到 Connect
+func TestResumeConnectNotDelayed(t *testing.T) {
+	sh := newTestHandler()
+	srv := NewTcpServer(sh, memAddress(t))
+	srv.SetResumption(Resumption{Buffer: 16, Timeout: time.Second})
+	startServer(t, srv, 1)
+
+	ch := newTestHandler()
+	c := NewTcpClient(ch)
+	start := time.Now()
+	dialClient(t, c, ch, memAddress(t))
+	sh.waitConnect(t)
+	if elapsed := time.Since(start); elapsed > resumeWait/2 {
+		t.Fatalf("server Connect took %v", elapsed)
+	}
+}
+
+func TestResumeAfterReset(t *testing.T) {
+	fn, srv, sh, ss, c, ch, cs := resumePair(t, 5*time.Second)
+
+	fn.Reset("client", "server")
+	// 断线期间写入的消息在恢复后送达
+	if err := srv.Write(ss, 2, []byte("down")); err != nil {
+		t.Fatal(err)
+	}
+	if m := ch.waitMessage(t); m.head != 2 || string(m.body) != "down" {
+		t.Fatalf("client got %d %q", m.head, m.body)
+	}
+	if err := c.Write(cs, 3, []byte("up")); err != nil {
+		t.Fatal(err)
+	}
+	if m := sh.waitMessage(t); m.fd != ss.fd || m.head != 3 || string(m.body) != "up" {
+		t.Fatalf("server got %d %d %q", m.fd, m.head, m.body)
+	}
+
+	// 恢复对两端的处理器都不可见
+	select {
+	case info := <-sh.close:
+		t.Fatalf("server closed: %v", info)
+	case info := <-ch.close:
+		t.Fatalf("client closed: %v", info)
+	case s := <-sh.connect:
+		t.Fatalf("server got a new session %d", s.fd)
+	default:
+	}
+}
+
+// TestResumeKickWhileParked 断线后被踢出的会话不再等待恢复，立即以踢出的原因关闭
+func TestResumeKickWhileParked(t *testing.T) {
+	fn, _, sh, ss, _, _, _ := resumePair(t, time.Minute)
+
+	fn.Partition("client", "server")
+	t.Cleanup(func() { fn.Heal("client", "server") })
+	ss.closeConn(CLOSE_READ_ERROR, ErrFaultReset)
+	ss.Kick(nil)
+	if info := sh.waitClose(t); info.Reason != CLOSE_KICK {
+		t.Fatalf("server close = %v, want kick", info)
+	}
+}
+
+// TestResumeIdentityMismatch 新连接的身份与原会话不同时拒绝恢复，原会话待确认的消息保持不变
+func TestResumeIdentityMismatch(t *testing.T) {
+	sh := newTestHandler()
+	srv := NewTcpServer(sh, memAddress(t))
+	srv.SetResumption(Resumption{Buffer: 16, Timeout: time.Second})
+	srv.SetAuthenticator(TokenAuthenticator(func([]byte) (interface{}, error) { return nil, nil }), 0)
+
+	s := CreateSession(readerConn{bytes.NewReader(nil)}, func(uint16, uint16, []byte) {})
+	s.identity = "alice"
+	s.resumeState.token = [resumeTokenSize]byte{1, 2, 3}
+	s.resumeState.sent = 3
+	s.resumeState.pending = [][]byte{{1}, {2}, {3}}
+	srv.registry.park(&parkedSession{session: s, info: CloseInfo{Reason: CLOSE_EOF},
+		closing: make(chan struct{}), resumed: make(chan struct{})})
+
+	client, server := net.Pipe()
+	defer client.Close()
+	n := CreateSession(server, func(uint16, uint16, []byte) {})
+	n.identity = "mallory"
+	go func() {
+		// 对端确认收到了前两条消息
+		client.Write(packFrame(0, RESUME, append(s.resumeState.token[:], encodeUint32(2)...)))
+		io.Copy(io.Discard, client)
+	}()
+	if !srv.resumeConn(n) {
+		t.Fatal("resume request not handled")
+	}
+	if n := len(s.resumeState.pending); n != 3 {
+		t.Fatalf("rejected resume trimmed pending to %d messages", n)
+	}
+	if info := sh.waitClose(t); info.Reason != CLOSE_EOF {
+		t.Fatalf("original session closed with %v, want eof", info)
+	}
+}
@@ -4,26 +4,71 @@ import (
 	"github.com/lizhen1412/eegos/log"
 	"github.com/lizhen1412/eegos/util"
 
+	"bufio"
+	"errors"
+	"fmt"
 	"io"
+	"net"
 	"runtime/debug"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// 互斥锁，用于保护写入操作
-var writeLock = &sync.Mutex{}
+// 会话发送队列的长度，队列满时写入返回 ErrQueueFull
+const writeQueueSize = 256
+
+// 消息体的最大长度，受消息头中 16 位长度字段的限制
+const maxBodySize = 65535
 
 // 用于生成唯一会话标识符的计数器
 var sessionCounter = util.Counter{Num: 0}
 
 // Session 结构体表示一个网络会话
 type Session struct {
-	fd        uint16                       // 会话的文件描述符
-	conn      io.ReadWriteCloser           // 会话的连接
-	inData    chan *Data                   // 用于接收输入数据的通道
-	outData   chan []byte                  // 用于发送输出数据的通道
-	cClose    chan bool                    // 关闭通知通道
-	state     int                          // 会话状态
-	msgHandle func(uint16, uint16, []byte) // 处理消息的函数
+	fd          uint16                      // 会话的文件描述符
+	conn        io.ReadWriteCloser          // 会话的连接
+	reader      *bufio.Reader               // 带缓冲的读取器，减少小包的系统调用
+	header      [5]byte                     // 读取消息头的缓冲区，避免每个消息分配
+	inData      chan *Data                  // 用于接收输入数据的通道
+	outQueues   [PRIORITY_COUNT]chan []byte // 各优先级的发送队列
+	schedule    WriteSchedule               // 发送队列的调度方式
+	credits     [PRIORITY_COUNT]int         // 加权调度时本轮剩余的配额
+	cClose      chan bool                   // 关闭通知通道
+	done        chan struct{}               // 会话释放后关闭，用于通知写协程退出
+	state       atomic.Int32                // 会话状态
+	msgHandle   atomic.Pointer[msgHandler]  // 处理消息的函数，Forward 可以在会话运行时替换
+	retainBody  bool                        // 处理函数是否接管消息体，接管后需调用 ReleaseBody 归还
+	ordered     atomic.Bool                 // 是否按顺序逐个调用消息处理函数
+	listener    string                      // 接受该会话的监听地址，客户端会话为空
+	server      bool                        // 是否为服务端接受的会话，在启动前设置
+	closeLock   sync.Mutex                  // 保护 conn 的替换和以下关闭状态，会话等待恢复时会重置关闭状态
+	closeInfo   CloseInfo                   // 会话关闭的原因，只记录第一次
+	closeSet    bool                        // 是否已经记录了关闭原因
+	abandoned   *CloseInfo                  // 主动关闭的原因，断线后被主动关闭的会话不再等待恢复
+	idle        time.Duration               // 读空闲超时，超时未收到任何数据则关闭会话，0 表示不限制
+	hsState     int                         // 握手状态，只在读协程和启动时修改
+	flow        *FlowControl                // 流量控制设置，nil 表示不启用
+	flowState   flowState                   // 流量控制状态
+	sockOpts    SocketOptions               // 连接上实际生效的套接字选项
+	rate        *rateConfig                 // 接收消息的速率限制，nil 表示不限制
+	rateState   rateState                   // 速率限制的令牌桶
+	closing     chan struct{}               // 开始关闭时关闭，用于唤醒读协程中的等待
+	closingSet  bool                        // closing 是否已经关闭
+	writeDone   chan struct{}               // 写协程退出后关闭
+	resume      *Resumption                 // 断线恢复设置，nil 表示不启用
+	resumeState resumeState                 // 断线恢复状态
+	registry    *resumeRegistry             // 服务端记录可恢复会话的位置，客户端会话为 nil
+	direct      bool                        // 连接的写入不会阻塞，消息直接写到连接上，不使用发送队列和写协程
+	mux         *Multiplexing               // 流复用设置，nil 表示不启用
+	streams     *streamSet                  // 握手协商后的流集合
+	streamLock  sync.Mutex                  // 保护 streams
+	groups      *Groups                     // 会话所属连接的分组，释放时离开所有分组
+	identity    interface{}                 // 服务端认证时得到的对端身份
+	checksum    bool                        // 是否在握手中申请或接受校验和
+	crc         checksumState               // 校验和的协商结果
+	policy      *ProtocolPolicy             // 违反协议的消息的处理方式，nil 表示全部忽略
+	clock       clockState                  // 心跳时间戳得到的时钟同步估计
 }
 
 // CreateSession 创建一个新的会话
@@ -34,29 +79,51 @@ func CreateSession(conn io.ReadWriteCloser, msgHandle func(uint16, uint16, []byt
 	session.fd = sessionCounter.GetNum()
 	// 设置会话的连接对象
 	session.conn = conn
+	// 为连接创建带缓冲的读取器
+	session.reader = bufio.NewReaderSize(conn, readBufferSize)
 
 	// 初始化会话的输入和输出通道，用于处理数据的收发
 	session.inData = make(chan *Data, 1)
-	session.outData = make(chan []byte, 1)
+	for p := range session.outQueues {
+		session.outQueues[p] = make(chan []byte, writeQueueSize)
+	}
+	session.schedule = DefaultWriteSchedule
 
 	// 创建一个用于通知关闭的通道
 	session.cClose = make(chan bool)
+	session.done = make(chan struct{})
+	session.closing = make(chan struct{})
 
 	// 设置会话的状态为 NEW_CONNECTION，表示新连接
-	session.state = NEW_CONNECTION
+	session.state.Store(NEW_CONNECTION)
 
 	// 设置消息处理函数，用于处理接收到的消息
-	session.msgHandle = msgHandle
+	session.msgHandle.Store((*msgHandler)(&msgHandle))
 
 	// 返回创建的会话对象
 	return session
 }
 
+// createDirectSession 创建一个由外部驱动读写的会话，例如 epoll 模式。
+// 会话不分配读缓冲区、输入通道和发送队列，也不启动读写协程，消息直接写到 conn 上。
+func createDirectSession(conn io.ReadWriteCloser, msgHandle func(uint16, uint16, []byte)) *Session {
+	session := new(Session)
+	session.fd = sessionCounter.GetNum()
+	session.conn = conn
+	session.done = make(chan struct{})
+	session.closing = make(chan struct{})
+	session.state.Store(WORKING)
+	session.msgHandle.Store((*msgHandler)(&msgHandle))
+	session.direct = true
+	return session
+}
+
 // Start 用于启动会话的工作。一旦启动，会话将进入 WORKING 状态，
 // 并创建独立的 goroutine 来处理读取和写入操作。
 func (this *Session) Start() {
 	// 将会话状态设置为 WORKING，表示会话正在工作中
-	this.state = WORKING
+	this.state.Store(WORKING)
+	this.writeDone = make(chan struct{})
 
 	// 启动一个独立的 goroutine 来处理读取操作
 	go this.handleRead()
@@ -66,45 +133,190 @@ func (this *Session) Start() {
 
 }
 
-// Close 标记会话状态为 CLOSING
+// Close 主动关闭会话，关闭原因为 CLOSE_NORMAL
 func (this *Session) Close() {
+	this.CloseWithReason(CLOSE_NORMAL, nil)
+}
+
+// Kick 由服务端踢出会话，关闭原因为 CLOSE_KICK，err 描述踢出的原因
+func (this *Session) Kick(err error) {
+	this.CloseWithReason(CLOSE_KICK, err)
+}
+
+// CloseWithReason 以指定原因关闭会话。
+// 会话状态被标记为 CLOSING 并关闭底层连接，读协程退出后会通知 Handler.Close；
+// 多次关闭时只有第一次的原因会被记录。
+func (this *Session) CloseWithReason(reason CloseReason, err error) {
+	this.closeLock.Lock()
+	this.recordClose(reason, err)
+	if !resumableReason(reason) && this.abandoned == nil {
+		// 断线后等待恢复之前被主动关闭，会话不再恢复
+		this.abandoned = &CloseInfo{Reason: reason, Err: err}
+	}
 	// 将会话状态设置为 CLOSING，表示会话正在关闭中
-	this.state = CLOSING
+	this.state.CompareAndSwap(WORKING, CLOSING)
+	if !this.closingSet {
+		this.closingSet = true
+		close(this.closing)
+	}
+	conn := this.conn
+	this.closeLock.Unlock()
+	// 关闭连接以唤醒阻塞在读取上的读协程
+	conn.Close()
+}
+
+// closeConn 记录关闭原因并关闭当前连接，不改变会话状态，读协程退出后按断开处理
+func (this *Session) closeConn(reason CloseReason, err error) {
+	this.closeLock.Lock()
+	this.recordClose(reason, err)
+	conn := this.conn
+	this.closeLock.Unlock()
+	conn.Close()
+}
+
+// abort 关闭尚未交给处理器的会话，在读协程退出后释放资源，不通知 Handler
+func (this *Session) abort(reason CloseReason, err error) {
+	this.CloseWithReason(reason, err)
+	metrics.add("session.abort."+reason.String(), 1)
+	go func() {
+		for {
+			select {
+			case data := <-this.inData:
+				releaseData(data)
+			case <-this.cClose:
+				this.Release()
+				return
+			}
+		}
+	}()
+}
+
+// CloseInfo 返回会话关闭的原因，会话未关闭时原因为 CLOSE_UNKNOWN
+func (this *Session) CloseInfo() CloseInfo {
+	this.closeLock.Lock()
+	defer this.closeLock.Unlock()
+	return this.closeInfo
+}
+
+// setCloseInfo 记录会话关闭的原因，只有第一次调用生效
+func (this *Session) setCloseInfo(reason CloseReason, err error) {
+	this.closeLock.Lock()
+	this.recordClose(reason, err)
+	this.closeLock.Unlock()
+}
+
+// recordClose 记录第一次关闭的原因，调用方需持有 closeLock
+func (this *Session) recordClose(reason CloseReason, err error) {
+	if !this.closeSet {
+		this.closeSet = true
+		this.closeInfo = CloseInfo{Reason: reason, Err: err}
+	}
+}
+
+// closingChan 返回会话本次开始关闭时关闭的通道，会话等待恢复后会换成新的通道
+func (this *Session) closingChan() chan struct{} {
+	this.closeLock.Lock()
+	defer this.closeLock.Unlock()
+	return this.closing
 }
 
 // Release 释放会话资源
 func (this *Session) Release() {
 	//log.Debug("release session")
 	// 关闭输入数据通道
-	close(this.inData)
-
-	// 关闭输出数据通道
-	close(this.outData)
+	if this.inData != nil {
+		close(this.inData)
+	}
 
-	// 关闭通知关闭的通道
-	close(this.cClose)
+	// 通知写协程退出，输出通道不关闭，避免并发写入时向已关闭的通道发送数据
+	close(this.done)
 
 	// 将会话状态设置为 CLOSED，表示会话已关闭
-	this.state = CLOSED
+	this.state.Store(CLOSED)
+
+	// 重置会话上所有的流
+	this.closeStreams(ErrClosed)
+
+	// 离开所有分组
+	if this.groups != nil {
+		this.groups.leaveAll(this)
+	}
+
+	// 已关闭的会话不能再被恢复
+	if this.registry != nil && this.resumeState.enabled {
+		this.registry.remove(this)
+	}
 }
 
-// Forward 更改会话的消息处理函数
+// msgHandler 会话的消息处理函数，参数为会话标识、消息头和消息体
+type msgHandler func(uint16, uint16, []byte)
+
+// Forward 更改会话的消息处理函数，可以与消息的处理并发调用，之后分发的消息使用新的处理函数
 func (this *Session) Forward(msgHandle func(uint16, uint16, []byte)) {
 	// 更新会话的消息处理函数为传入的新函数
-	this.msgHandle = msgHandle
+	this.msgHandle.Store((*msgHandler)(&msgHandle))
+}
+
+// Fd 返回会话的唯一标识
+func (this *Session) Fd() uint16 {
+	return this.fd
+}
+
+// SocketOptions 返回连接上实际生效的套接字选项，非 TCP 连接返回设置值
+func (this *Session) SocketOptions() SocketOptions {
+	return this.sockOpts
+}
+
+// Listener 返回接受该会话的监听地址，客户端会话返回空字符串
+func (this *Session) Listener() string {
+	return this.listener
+}
+
+// SetRetainBody 设置消息处理函数是否接管消息体。
+// 默认情况下消息体只在处理函数执行期间有效，返回后缓冲区会被回收复用，
+// 需要保留消息体的处理函数要么自行拷贝，要么设置 retain 为 true，
+// 此时消息体归处理函数所有，用完后调用 ReleaseBody 归还（不归还则交给 GC）。
+func (this *Session) SetRetainBody(retain bool) {
+	this.retainBody = retain
+}
+
+// SetOrdered 设置是否按到达顺序逐个调用消息处理函数，可以在 Handler.Connect 中调用。
+// 默认每个消息在独立的协程中处理，处理函数之间没有顺序保证；设置为 true 后消息在会话的处理协程中依次处理，
+// 处理函数阻塞会推迟该会话后续的消息和心跳。epoll 模式的会话不支持，消息仍然并发处理。
+func (this *Session) SetOrdered(ordered bool) {
+	this.ordered.Store(ordered)
+}
+
+// dispatchData 按会话的分发方式处理数据消息
+func (this *Session) dispatchData(data *Data) {
+	if this.ordered.Load() && !this.direct {
+		this.dispatch(data)
+		return
+	}
+	go this.dispatch(data)
+}
+
+// dispatch 调用消息处理函数，并在返回后按所有权约定回收数据包
+func (this *Session) dispatch(data *Data) {
+	(*this.msgHandle.Load())(this.fd, data.head, data.body)
+	// 处理函数消费完消息后累计流量控制额度
+	this.consumeCredit()
+	if this.retainBody {
+		detachData(data)
+	} else {
+		releaseData(data)
+	}
 }
 
 // pack 将数据打包成特定格式
 func (this *Session) pack(head uint16, dType uint8, body []byte) (pkg []byte) {
-	// 计算消息体的长度
-	length := len(body)
+	return packFrame(head, dType, body)
+}
 
-	// 如果消息体长度超过 65535，则警告并将长度限制为 65535
-	if length > 65535 {
-		log.Warn("package too big, limit 65535!!!!", length)
-		length = 0
-		body = []byte{}
-	}
+// packFrame 将数据打包成消息包，打包后的消息包只读，可以在多个会话的发送队列间共享
+func packFrame(head uint16, dType uint8, body []byte) (pkg []byte) {
+	// 计算消息体的长度，调用方保证不超过 maxBodySize
+	length := len(body)
 
 	// 初始化一个消息包切片，预分配足够的容量以减少内存分配
 	pkg = make([]byte, 0, length+5)
@@ -118,28 +330,47 @@ func (this *Session) pack(head uint16, dType uint8, body []byte) (pkg []byte) {
 	return pkg
 }
 
-// Reader 从连接中读取数据并解析成消息
-func (this *Session) Reader() (err error) {
-	// 创建一个长度为 5 的字节数组 b，用于存储消息包的头部信息
-	var b [5]byte
+// Reader 从连接中读取数据并解析成消息。
+// 数据包和消息体均取自池中，由消费方处理完后回收。
+func (this *Session) Reader() error {
+	pkg, err := this.readPacket()
+	if err == errFrameDropped {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
 
-	// 从连接中读取 5 个字节的数据，存储到字节数组 b 中
-	if _, err = io.ReadFull(this.conn, b[:]); err != nil {
-		return
+	// 协商了校验和时校验消息包，不匹配说明数据已损坏，后续的消息边界也不可信
+	if this.crc.reading {
+		if err := this.readChecksum(pkg); err != nil {
+			releaseData(pkg)
+			return err
+		}
 	}
 
-	// 解析头部信息，获取消息包的长度、数据类型和头部字段
-	pkgLen := uint16(b[0]) + uint16(b[1])<<8
-	pkg := &Data{}
-	pkg.dType = b[2]
-	pkg.head = uint16(b[3]) + uint16(b[4])<<8
+	// 按协议策略丢弃违规的消息或断开会话
+	if ok, err := this.checkFrame(pkg); !ok {
+		this.dropData(pkg)
+		return err
+	}
 
-	// 如果消息包长度大于 0，则创建一个相应长度的字节数组并读取消息体
-	if pkgLen > 0 {
-		pkg.body = make([]byte, pkgLen)
-		if _, err = io.ReadFull(this.conn, pkg.body); err != nil {
-			return
-		}
+	// 会话层的控制消息在读协程中直接处理，不计入速率限制：
+	// 控制消息的数量受协议约束，流复用的数据由流的窗口限制，丢弃会破坏流的状态
+	if this.handleControl(pkg) {
+		releaseData(pkg)
+		return nil
+	}
+
+	// 断线恢复需要对收到的数据消息计数
+	if pkg.dType == DATA {
+		this.countReceived()
+	}
+
+	// 按速率限制延迟、丢弃消息或断开会话
+	if ok, err := this.limitRate(pkg); !ok {
+		this.dropData(pkg)
+		return err
 	}
 
 	// 将解析得到的消息包发送到会话的输入通道
@@ -149,6 +380,50 @@ func (this *Session) Reader() (err error) {
 	return nil
 }
 
+// readPacket 从连接中读取一个完整的消息包
+func (this *Session) readPacket() (pkg *Data, err error) {
+	// 从缓冲读取器中读取 5 个字节的消息头
+	b := this.header[:]
+	if _, err = io.ReadFull(this.reader, b); err != nil {
+		return
+	}
+
+	// 解析头部信息，获取消息包的长度、数据类型和头部字段
+	pkgLen := int(b[0]) + int(b[1])<<8
+
+	// 超长的消息在分配缓冲区之前处理，丢弃时跳过消息体和校验和，数据消息同样归还流量控制额度
+	if ok, err := this.checkLength(pkgLen); !ok {
+		if err != nil {
+			return nil, err
+		}
+		if this.crc.reading {
+			pkgLen += checksumSize
+		}
+		if _, err = this.reader.Discard(pkgLen); err != nil {
+			return nil, err
+		}
+		if b[2] == DATA {
+			this.consumeCredit()
+		}
+		return nil, errFrameDropped
+	}
+
+	pkg = newData()
+	pkg.dType = b[2]
+	pkg.head = uint16(b[3]) + uint16(b[4])<<8
+
+	// 如果消息包长度大于 0，则从池中取出缓冲区并读取消息体
+	if pkgLen > 0 {
+		pkg.buf = getBuffer(pkgLen)
+		pkg.body = *pkg.buf
+		if _, err = io.ReadFull(this.reader, pkg.body); err != nil {
+			releaseData(pkg)
+			return nil, err
+		}
+	}
+	return pkg, nil
+}
+
 // handleRead 处理数据的读取
 func (this *Session) handleRead() {
 	//log.Debug("handleRead start")
@@ -156,24 +431,30 @@ func (this *Session) handleRead() {
 	// 在函数执行完成后关闭连接和通知关闭通道
 	defer func() {
 		//log.Debug("connection close")
-		this.conn.Close()
-		this.cClose <- true
 		if err := recover(); err != nil {
 			log.Error(err, string(debug.Stack()))
+			this.setCloseInfo(CLOSE_UNKNOWN, fmt.Errorf("%v", err))
 		}
+		this.conn.Close()
+		close(this.cClose)
 	}()
 
+	// 支持设置读超时的连接才能检测读空闲
+	deadline, _ := this.conn.(interface{ SetReadDeadline(time.Time) error })
+
 	// 循环读取数据，直到会话状态不再为 WORKING
 	for {
-		if this.state != WORKING {
+		if this.state.Load() != WORKING {
 			break
 		}
 
-		// 调用 Reader 方法读取数据，并处理可能的错误
+		if this.idle > 0 && deadline != nil {
+			deadline.SetReadDeadline(time.Now().Add(this.idle))
+		}
+
+		// 调用 Reader 方法读取数据，并根据错误记录关闭原因
 		if err := this.Reader(); err != nil {
-			if err != io.EOF && err != io.ErrUnexpectedEOF {
-				log.Error(err)
-			}
+			this.setCloseInfo(readCloseReason(err, this.idle > 0), err)
 			break
 		}
 	}
@@ -181,43 +462,151 @@ func (this *Session) handleRead() {
 	//log.Debug("handleRead stop")
 }
 
+// readCloseReason 根据读取错误判断会话关闭的原因，idle 表示是否设置了读空闲超时。
+// 只有读空闲超时设置的读截止时间到期才是心跳超时，连接包装内部的写入或拨号超时是读取错误。
+func readCloseReason(err error, idle bool) CloseReason {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return CLOSE_EOF
+	}
+	if err == ErrCorruptFrame || err == ErrDecryptFailed {
+		return CLOSE_CORRUPT_FRAME
+	}
+	if err == ErrRateLimited {
+		return CLOSE_RATE_LIMITED
+	}
+	if errors.Is(err, ErrProtocolViolation) {
+		return CLOSE_PROTOCOL_ERROR
+	}
+	if idle && isReadTimeout(err) {
+		return CLOSE_HEARTBEAT_TIMEOUT
+	}
+	return CLOSE_READ_ERROR
+}
+
+// isReadTimeout 判断错误是否为读截止时间到期，其他操作的超时返回 false
+func isReadTimeout(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op != "read" {
+		return false
+	}
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
 // handleWrite 处理数据的写入
 func (this *Session) handleWrite() {
 	//log.Debug("handleWrite start")
 	//defer log.Debug("handleWrite stop")
 
-	// 循环写入数据，直到会话状态不再为 WORKING
+	defer close(this.writeDone)
+
+	// 循环按优先级调度写入数据，直到连接断开或会话被释放
 	for {
-		if this.state != WORKING {
-			break
+		pkg, ok := this.nextPacket()
+		if !ok {
+			// 关闭连接
+			this.conn.Close()
+			return
 		}
-
-		select {
-		case pkg, ok := <-this.outData:
-			if ok {
-				// 将消息包写入连接
-				this.conn.Write(pkg)
-			}
+		// 将消息包写入连接，写入失败时关闭连接，由读协程完成后续清理
+		this.recordSent(pkg)
+		if err := this.writePacket(pkg); err != nil {
+			this.CloseWithReason(CLOSE_WRITE_ERROR, err)
+			return
 		}
+		this.markWritten(pkg)
 	}
-	// 关闭连接
-	this.conn.Close()
 }
 
-// doWrite 发送数据给客户端
-func (this *Session) doWrite(head uint16, dType uint8, data []byte) {
-	// 如果会话状态不再为 WORKING，则记录错误并不发送消息包
-	if this.state != WORKING {
-		log.Error("session not working state=", this.state, "pkg not send", head, dType)
-		return
+// SetWriteSchedule 设置发送队列的调度方式，需要在会话开始收发前设置
+func (this *Session) SetWriteSchedule(schedule WriteSchedule) {
+	this.schedule = schedule
+	this.credits = schedule.Weights
+}
+
+// doWrite 以指定优先级发送数据给对端。
+// 会话不在工作状态时返回 ErrClosed，消息体过大时返回 ErrTooLarge，
+// 对应优先级的发送队列已满时返回 ErrQueueFull，
+// 启用流量控制后数据消息没有发送额度时返回 ErrNoCredit（或按设置阻塞等待）。
+func (this *Session) doWrite(head uint16, dType uint8, data []byte, priority Priority) error {
+	// 如果会话状态不再为 WORKING，则不发送消息包
+	if this.state.Load() != WORKING {
+		return ErrClosed
 	}
 
-	// 如果数据为空，则创建一个空的数据切片
-	if data == nil {
-		data = []byte{}
+	// 消息体长度受消息头长度字段限制
+	if len(data) > maxBodySize {
+		return ErrTooLarge
 	}
 
 	// 调用 pack 方法将数据打包成消息包，并将消息包写入输出通道
-	pkg := this.pack(head, dType, data)
-	this.outData <- pkg
+	return this.writeFrame(this.pack(head, dType, data), priority)
+}
+
+// writeFrame 以指定优先级发送已打包的消息包，数据消息消耗流量控制额度，返回值与 doWrite 相同
+func (this *Session) writeFrame(pkg []byte, priority Priority) error {
+	return this.sendFrame(pkg, priority, true)
+}
+
+// offerFrame 与 writeFrame 相同，但流量控制额度用完时立即返回 ErrNoCredit，不会阻塞
+func (this *Session) offerFrame(pkg []byte, priority Priority) error {
+	return this.sendFrame(pkg, priority, false)
+}
+
+// sendFrame 发送已打包的消息包，wait 表示额度用完时是否按流量控制设置等待
+func (this *Session) sendFrame(pkg []byte, priority Priority, wait bool) error {
+	if this.state.Load() != WORKING {
+		return ErrClosed
+	}
+
+	// 数据消息需要消耗流量控制额度
+	dType := pkg[2]
+	if dType == DATA {
+		if err := this.acquireCredit(wait); err != nil {
+			return err
+		}
+	}
+
+	err := this.enqueue(pkg, priority)
+	if err != nil && dType == DATA {
+		this.refundCredit()
+	}
+	return err
+}
+
+// enqueueWait 与 enqueue 相同，但发送队列已满时等待队列有空位，直到会话释放
+func (this *Session) enqueueWait(pkg []byte, priority Priority) error {
+	if this.direct {
+		return this.enqueue(pkg, priority)
+	}
+	if priority >= PRIORITY_COUNT {
+		priority = PRIORITY_LOW
+	}
+	select {
+	case this.outQueues[priority] <- pkg:
+		return nil
+	case <-this.done:
+		return ErrClosed
+	}
+}
+
+// enqueue 将打包好的消息包放入指定优先级的发送队列
+func (this *Session) enqueue(pkg []byte, priority Priority) error {
+	select {
+	case <-this.done:
+		return ErrClosed
+	default:
+	}
+	if this.direct {
+		return this.writePacket(pkg)
+	}
+	if priority >= PRIORITY_COUNT {
+		priority = PRIORITY_LOW
+	}
+	select {
+	case this.outQueues[priority] <- pkg:
+		return nil
+	default:
+		return ErrQueueFull
+	}
 }
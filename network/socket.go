@@ -0,0 +1,104 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// ErrUnsupportedOption 表示当前平台不支持某个套接字选项
+var ErrUnsupportedOption = errors.New("network: socket option not supported on this platform")
+
+// SocketOptions 描述 TCP 连接的套接字选项，由 TcpServer 和 TcpClient 应用到每个新连接上。
+// 零值与 Go 标准库的默认行为一致，只需要设置要修改的选项。
+type SocketOptions struct {
+	Nagle       bool          // 是否启用 Nagle 算法，默认设置 TCP_NODELAY 关闭 Nagle 算法以降低延迟
+	KeepAlive   time.Duration // TCP keepalive 的探测间隔，0 使用系统默认值，负数关闭 keepalive
+	ReadBuffer  int           // 接收缓冲区大小（SO_RCVBUF），0 使用系统默认值
+	WriteBuffer int           // 发送缓冲区大小（SO_SNDBUF），0 使用系统默认值
+	Linger      *int          // SO_LINGER 秒数，nil 使用系统默认行为，0 表示关闭时丢弃未发送数据并发送 RST，参见 LingerSeconds
+	UserTimeout time.Duration // TCP_USER_TIMEOUT，已发送数据超过该时间未被确认时断开连接，0 使用系统默认值，仅 Linux 支持
+}
+
+// DefaultSocketOptions 返回与 Go 标准库默认行为一致的套接字选项，即零值
+func DefaultSocketOptions() SocketOptions {
+	return SocketOptions{}
+}
+
+// LingerSeconds 返回用于 SocketOptions.Linger 的秒数
+func LingerSeconds(seconds int) *int {
+	return &seconds
+}
+
+// clone 复制选项，Linger 指向的值不与调用方共享
+func (this SocketOptions) clone() SocketOptions {
+	if this.Linger != nil {
+		this.Linger = LingerSeconds(*this.Linger)
+	}
+	return this
+}
+
+// Validate 检查套接字选项是否合法
+func (this SocketOptions) Validate() error {
+	if this.ReadBuffer < 0 {
+		return fmt.Errorf("network: invalid read buffer %d", this.ReadBuffer)
+	}
+	if this.WriteBuffer < 0 {
+		return fmt.Errorf("network: invalid write buffer %d", this.WriteBuffer)
+	}
+	if this.KeepAlive > 0 && this.KeepAlive < time.Second {
+		return fmt.Errorf("network: keepalive period %v less than 1s", this.KeepAlive)
+	}
+	if this.Linger != nil && *this.Linger < 0 {
+		return fmt.Errorf("network: invalid linger %d", *this.Linger)
+	}
+	if this.UserTimeout < 0 {
+		return fmt.Errorf("network: invalid user timeout %v", this.UserTimeout)
+	}
+	if this.UserTimeout > 0 && !supportUserTimeout {
+		return ErrUnsupportedOption
+	}
+	return nil
+}
+
+// applySocketOptions 把套接字选项应用到连接上，返回从套接字读回的实际生效值。
+// 内核可能会调整缓冲区大小（例如 Linux 会翻倍），因此实际值可能与设置值不同。
+func applySocketOptions(conn *net.TCPConn, opts SocketOptions) (SocketOptions, error) {
+	if err := conn.SetNoDelay(!opts.Nagle); err != nil {
+		return opts, err
+	}
+	if opts.KeepAlive > 0 {
+		if err := conn.SetKeepAlive(true); err != nil {
+			return opts, err
+		}
+		if err := conn.SetKeepAlivePeriod(opts.KeepAlive); err != nil {
+			return opts, err
+		}
+	} else if opts.KeepAlive < 0 {
+		if err := conn.SetKeepAlive(false); err != nil {
+			return opts, err
+		}
+	}
+	if opts.ReadBuffer > 0 {
+		if err := conn.SetReadBuffer(opts.ReadBuffer); err != nil {
+			return opts, err
+		}
+	}
+	if opts.WriteBuffer > 0 {
+		if err := conn.SetWriteBuffer(opts.WriteBuffer); err != nil {
+			return opts, err
+		}
+	}
+	if opts.Linger != nil {
+		if err := conn.SetLinger(*opts.Linger); err != nil {
+			return opts, err
+		}
+	}
+	if opts.UserTimeout > 0 {
+		if err := setUserTimeout(conn, opts.UserTimeout); err != nil {
+			return opts, err
+		}
+	}
+	return readSocketOptions(conn, opts)
+}
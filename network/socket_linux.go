@@ -0,0 +1,81 @@
+//go:build linux
+
+package network
+
+import (
+	"net"
+	"syscall"
+	"time"
+)
+
+// TCP_USER_TIMEOUT 的选项值，syscall 包中没有定义
+const tcpUserTimeout = 0x12
+
+// 当前平台是否支持 TCP_USER_TIMEOUT
+const supportUserTimeout = true
+
+// SO_REUSEPORT 的选项值，syscall 包中没有定义
+const soReusePort = 0xf
+
+// 当前平台是否支持多个监听器共享端口并由内核分配新连接
+const supportReusePort = true
+
+// setReusePort 在监听之前为套接字设置 SO_REUSEPORT，用作 net.ListenConfig.Control
+func setReusePort(network, address string, c syscall.RawConn) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// setUserTimeout 设置 TCP_USER_TIMEOUT
+func setUserTimeout(conn *net.TCPConn, timeout time.Duration) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpUserTimeout, int(timeout/time.Millisecond))
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// readSocketOptions 从套接字读回实际生效的选项，无法读取的选项（如 SO_LINGER）保留设置值
+func readSocketOptions(conn *net.TCPConn, opts SocketOptions) (SocketOptions, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return opts, err
+	}
+	applied := opts
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		get := func(level, name int) int {
+			v, err := syscall.GetsockoptInt(int(fd), level, name)
+			if err != nil && serr == nil {
+				serr = err
+			}
+			return v
+		}
+		applied.Nagle = get(syscall.IPPROTO_TCP, syscall.TCP_NODELAY) == 0
+		applied.ReadBuffer = get(syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+		applied.WriteBuffer = get(syscall.SOL_SOCKET, syscall.SO_SNDBUF)
+		applied.UserTimeout = time.Duration(get(syscall.IPPROTO_TCP, tcpUserTimeout)) * time.Millisecond
+		if get(syscall.SOL_SOCKET, syscall.SO_KEEPALIVE) != 0 {
+			applied.KeepAlive = time.Duration(get(syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE)) * time.Second
+		} else {
+			applied.KeepAlive = -1
+		}
+	})
+	if err != nil {
+		return opts, err
+	}
+	return applied, serr
+}
@@ -0,0 +1,30 @@
+//go:build !linux
+
+package network
+
+import (
+	"net"
+	"syscall"
+	"time"
+)
+
+// 当前平台是否支持 TCP_USER_TIMEOUT
+const supportUserTimeout = false
+
+// 当前平台的 SO_REUSEPORT 不会在监听器之间分配新连接，不支持分片监听
+const supportReusePort = false
+
+// setReusePort 当前平台不支持分片监听
+func setReusePort(network, address string, c syscall.RawConn) error {
+	return ErrUnsupportedOption
+}
+
+// setUserTimeout 当前平台不支持 TCP_USER_TIMEOUT
+func setUserTimeout(conn *net.TCPConn, timeout time.Duration) error {
+	return ErrUnsupportedOption
+}
+
+// readSocketOptions 当前平台不读回套接字选项，返回设置值
+func readSocketOptions(conn *net.TCPConn, opts SocketOptions) (SocketOptions, error) {
+	return opts, nil
+}
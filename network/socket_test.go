@@ -0,0 +1,91 @@
+package network
+
+import (
+	"io"
+	"net"
+	"runtime"
+	"testing"
+)
+
+// tcpPair 建立一对本地 TCP 连接
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	client, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := lis.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return server.(*net.TCPConn), client.(*net.TCPConn)
+}
+
+// TestZeroSocketOptions 只设置缓冲区时其他选项保持标准库的默认行为：关闭 Nagle 算法、正常关闭连接。
+// 只有 Linux 读回实际生效的选项
+func TestZeroSocketOptions(t *testing.T) {
+	server, client := tcpPair(t)
+	applied, err := applySocketOptions(server, SocketOptions{ReadBuffer: 64 * 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if applied.Nagle {
+		t.Fatal("zero options enabled Nagle")
+	}
+	if applied.Linger != nil {
+		t.Fatalf("zero options set linger %d", *applied.Linger)
+	}
+	if runtime.GOOS == "linux" && applied.ReadBuffer < 64*1024 {
+		t.Fatalf("read buffer = %d, want at least 64KB", applied.ReadBuffer)
+	}
+
+	// 没有设置 SO_LINGER 时关闭连接不会发送 RST，对端读到全部数据后收到 EOF
+	server.Write([]byte("bye"))
+	server.Close()
+	data, err := io.ReadAll(client)
+	if err != nil || string(data) != "bye" {
+		t.Fatalf("read after close = %q, %v", data, err)
+	}
+}
+
+func TestNagleOption(t *testing.T) {
+	server, _ := tcpPair(t)
+	applied, err := applySocketOptions(server, SocketOptions{Nagle: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS == "linux" && !applied.Nagle {
+		t.Fatal("Nagle not enabled")
+	}
+}
+
+func TestSocketOptionsLinger(t *testing.T) {
+	if err := (SocketOptions{Linger: LingerSeconds(-1)}).Validate(); err == nil {
+		t.Fatal("negative linger accepted")
+	}
+	opts := SocketOptions{Linger: LingerSeconds(0)}
+	if err := opts.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 服务器保存选项的副本，之后修改调用方的值不会影响新连接
+	srv := NewTcpServerWithOptions(newTestHandler(), opts, "127.0.0.1:0")
+	*opts.Linger = 5
+	if *srv.sockOpts.Linger != 0 {
+		t.Fatalf("server linger = %d, want 0", *srv.sockOpts.Linger)
+	}
+
+	server, _ := tcpPair(t)
+	if _, err := applySocketOptions(server, srv.sockOpts); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,474 @@
+package network
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// 流相关的错误
+var (
+	ErrStreamReset       = errors.New("network: stream reset")                    // 流被对端或本端重置
+	ErrStreamClosed      = errors.New("network: stream closed for writing")       // 本端已经关闭流的写入
+	ErrStreamUnsupported = errors.New("network: stream multiplexing not enabled") // 握手没有协商流复用
+	ErrStreamExhausted   = errors.New("network: no free stream id")               // 没有可用的流标识
+)
+
+// 流消息的类型，位于 STREAM 消息体的第一个字节，消息头为流标识
+const (
+	STREAM_SYN    = iota + 1 // 打开流
+	STREAM_DATA              // 流上的数据
+	STREAM_WINDOW            // 增加发送方的窗口，值为 4 字节的字节数
+	STREAM_FIN               // 关闭发送方向，对端读完缓冲的数据后得到 io.EOF
+	STREAM_RST               // 重置流，双方的读写都立即失败
+)
+
+// 默认的流接收窗口
+const DefaultStreamWindow = 256 * 1024
+
+// 默认的等待接受的流数量
+const DefaultStreamBacklog = 64
+
+// Multiplexing 描述在一个会话上复用多个逻辑流。
+// 每个流有独立的标识、按字节计算的流量控制窗口和关闭语义，一个流上的大量数据不会阻塞其他流和普通消息。
+// 双方都需要启用，在握手中协商；断线恢复时所有流都会被重置。
+type Multiplexing struct {
+	Window  uint32 // 每个流的接收窗口字节数，0 使用 DefaultStreamWindow
+	Backlog int    // 等待 AcceptStream 接受的流数量，超出后新流被重置，0 使用 DefaultStreamBacklog
+}
+
+// streamSet 会话上的所有流
+type streamSet struct {
+	lock       sync.Mutex
+	streams    map[uint16]*Stream // 以流标识作为键
+	next       uint16             // 下一个尝试分配的流标识，客户端使用奇数，服务端使用偶数
+	window     uint32             // 本端每个流的接收窗口
+	peerWindow uint32             // 对端每个流的接收窗口，即新流的初始发送窗口
+	accept     chan *Stream       // 对端打开的流，等待 AcceptStream 接受
+}
+
+// SetMultiplexing 为之后建立的会话启用流复用，需要双方都启用才生效
+func (this *TcpConn) SetMultiplexing(mux Multiplexing) {
+	if mux.Window == 0 {
+		mux.Window = DefaultStreamWindow
+	}
+	if mux.Backlog <= 0 {
+		mux.Backlog = DefaultStreamBacklog
+	}
+	this.mux = &mux
+}
+
+// offerStreams 客户端在握手请求中申请流复用
+func (this *Session) offerStreams(offer hsOptions) {
+	if this.mux != nil {
+		offer[HS_STREAM] = encodeUint32(this.mux.Window)
+	}
+}
+
+// acceptStreams 服务端处理握手请求中的流复用申请
+func (this *Session) acceptStreams(offer, ret hsOptions) {
+	if value, ok := offer[HS_STREAM]; ok && this.mux != nil && len(value) == 4 {
+		ret[HS_STREAM] = encodeUint32(this.mux.Window)
+		this.enableStreams(decodeUint32(value), 2)
+	}
+}
+
+// finishStreams 客户端处理握手响应中的流复用
+func (this *Session) finishStreams(ret hsOptions) {
+	if value, ok := ret[HS_STREAM]; ok && this.mux != nil && len(value) == 4 {
+		this.enableStreams(decodeUint32(value), 1)
+	}
+}
+
+// enableStreams 启用流复用，first 是本端分配的第一个流标识
+func (this *Session) enableStreams(peerWindow uint32, first uint16) {
+	this.streamLock.Lock()
+	this.streams = &streamSet{
+		streams:    make(map[uint16]*Stream),
+		next:       first,
+		window:     this.mux.Window,
+		peerWindow: peerWindow,
+		accept:     make(chan *Stream, this.mux.Backlog),
+	}
+	this.streamLock.Unlock()
+}
+
+// muxStreams 返回会话的流集合，没有协商流复用时返回 nil
+func (this *Session) muxStreams() *streamSet {
+	this.streamLock.Lock()
+	defer this.streamLock.Unlock()
+	return this.streams
+}
+
+// OpenStream 在会话上打开一个新的流，对端通过 AcceptStream 得到该流。
+// 握手没有协商流复用时返回 ErrStreamUnsupported。
+func (this *Session) OpenStream() (*Stream, error) {
+	set := this.muxStreams()
+	if set == nil {
+		return nil, ErrStreamUnsupported
+	}
+
+	set.lock.Lock()
+	var id uint16
+	for i := 0; i < 1<<15; i++ {
+		candidate := set.next
+		// 回绕时跳过 0
+		if set.next += 2; set.next == 0 {
+			set.next = 2
+		}
+		if _, used := set.streams[candidate]; !used {
+			id = candidate
+			break
+		}
+	}
+	if id == 0 {
+		set.lock.Unlock()
+		return nil, ErrStreamExhausted
+	}
+	stream := newStream(this, id, set.window, set.peerWindow)
+	set.streams[id] = stream
+	set.lock.Unlock()
+
+	if err := stream.send(STREAM_SYN, nil); err != nil {
+		this.removeStream(stream)
+		return nil, err
+	}
+	return stream, nil
+}
+
+// AcceptStream 等待并返回对端打开的流，会话关闭后返回 ErrClosed
+func (this *Session) AcceptStream() (*Stream, error) {
+	set := this.muxStreams()
+	if set == nil {
+		return nil, ErrStreamUnsupported
+	}
+	select {
+	case stream := <-set.accept:
+		return stream, nil
+	case <-this.done:
+		return nil, ErrClosed
+	}
+}
+
+// handleStream 在读协程中处理流消息，数据拷贝到流的接收缓冲区
+func (this *Session) handleStream(data *Data) {
+	set := this.muxStreams()
+	if set == nil || len(data.body) == 0 {
+		return
+	}
+	kind, payload := data.body[0], data.body[1:]
+
+	set.lock.Lock()
+	stream := set.streams[data.head]
+	if kind == STREAM_SYN {
+		if stream != nil || data.head == 0 {
+			set.lock.Unlock()
+			this.doWrite(data.head, STREAM, []byte{STREAM_RST}, PRIORITY_HIGH)
+			return
+		}
+		stream = newStream(this, data.head, set.window, set.peerWindow)
+		select {
+		case set.accept <- stream:
+			set.streams[data.head] = stream
+		default:
+			// 等待接受的流太多
+			set.lock.Unlock()
+			metrics.add("session.stream.rejected", 1)
+			this.doWrite(data.head, STREAM, []byte{STREAM_RST}, PRIORITY_HIGH)
+			return
+		}
+	}
+	set.lock.Unlock()
+
+	if stream == nil {
+		if kind != STREAM_RST {
+			this.doWrite(data.head, STREAM, []byte{STREAM_RST}, PRIORITY_HIGH)
+		}
+		return
+	}
+
+	switch kind {
+	case STREAM_DATA:
+		if !stream.receive(payload) {
+			// 对端超出了窗口
+			stream.Reset()
+		}
+	case STREAM_WINDOW:
+		if len(payload) == 4 {
+			stream.grant(decodeUint32(payload))
+		}
+	case STREAM_FIN:
+		stream.remoteClose()
+	case STREAM_RST:
+		stream.reset(ErrStreamReset)
+	}
+}
+
+// removeStream 移除已经关闭的流
+func (this *Session) removeStream(stream *Stream) {
+	set := this.muxStreams()
+	if set == nil {
+		return
+	}
+	set.lock.Lock()
+	if set.streams[stream.id] == stream {
+		delete(set.streams, stream.id)
+	}
+	set.lock.Unlock()
+}
+
+// closeStreams 会话关闭或断线时重置所有的流
+func (this *Session) closeStreams(err error) {
+	set := this.muxStreams()
+	if set == nil {
+		return
+	}
+	set.lock.Lock()
+	streams := make([]*Stream, 0, len(set.streams))
+	for _, stream := range set.streams {
+		streams = append(streams, stream)
+	}
+	set.streams = make(map[uint16]*Stream)
+	set.lock.Unlock()
+
+	for _, stream := range streams {
+		stream.reset(err)
+	}
+}
+
+// Stream 会话上的一个逻辑流，实现 io.ReadWriteCloser，可以在多个协程中分别读写。
+// Close 只关闭写入方向，对端读完后得到 io.EOF；Reset 立即中止双方的读写。
+type Stream struct {
+	id         uint16
+	session    *Session
+	priority   Priority      // 流上数据的发送优先级，默认为 PRIORITY_LOW
+	lock       sync.Mutex    // 保护以下字段
+	buf        []byte        // 已收到还未读取的数据
+	window     uint32        // 本端的接收窗口
+	received   uint32        // 窗口内已收到的字节数
+	consumed   uint32        // 已读取但还未授予对端的字节数
+	sendWindow uint32        // 剩余的发送窗口
+	localFin   bool          // 本端已关闭写入
+	remoteFin  bool          // 对端已关闭写入
+	err        error         // 流被重置的原因
+	readable   chan struct{} // 收到数据、关闭或重置时通知读取方
+	writable   chan struct{} // 窗口增加或重置时通知写入方
+}
+
+// newStream 创建一个流
+func newStream(session *Session, id uint16, window, peerWindow uint32) *Stream {
+	return &Stream{
+		id:         id,
+		session:    session,
+		priority:   PRIORITY_LOW,
+		window:     window,
+		sendWindow: peerWindow,
+		readable:   make(chan struct{}, 1),
+		writable:   make(chan struct{}, 1),
+	}
+}
+
+// ID 返回流的标识
+func (this *Stream) ID() uint16 {
+	return this.id
+}
+
+// SetPriority 设置流上数据的发送优先级，默认为 PRIORITY_LOW，流上的大量数据不会占满普通消息和 rpc 使用的队列。
+// 同一个流的消息需要按顺序到达，应在打开流后、写入数据之前设置。
+func (this *Stream) SetPriority(priority Priority) {
+	this.lock.Lock()
+	this.priority = priority
+	this.lock.Unlock()
+}
+
+// Read 读取流上的数据，没有数据时阻塞；对端关闭写入且数据读完后返回 io.EOF
+func (this *Stream) Read(b []byte) (int, error) {
+	for {
+		this.lock.Lock()
+		if len(this.buf) > 0 {
+			n := copy(b, this.buf)
+			this.buf = this.buf[n:]
+			if len(this.buf) == 0 {
+				this.buf = nil
+			}
+			grant := this.consume(uint32(n))
+			this.lock.Unlock()
+			if grant > 0 {
+				this.send(STREAM_WINDOW, encodeUint32(grant))
+			}
+			return n, nil
+		}
+		err := this.err
+		if err == nil && this.remoteFin {
+			err = io.EOF
+		}
+		this.lock.Unlock()
+		if err != nil {
+			return 0, err
+		}
+
+		select {
+		case <-this.readable:
+		case <-this.session.done:
+			return 0, ErrClosed
+		}
+	}
+}
+
+// consume 累计已读取的字节数，累计到窗口的一半时返回需要授予对端的字节数，调用方持有锁
+func (this *Stream) consume(n uint32) uint32 {
+	this.received -= n
+	this.consumed += n
+	if this.consumed < this.window/2 || this.remoteFin {
+		return 0
+	}
+	grant := this.consumed
+	this.consumed = 0
+	return grant
+}
+
+// Write 向流写入数据，发送窗口用完时阻塞等待对端读取
+func (this *Stream) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		this.lock.Lock()
+		if this.err != nil {
+			err := this.err
+			this.lock.Unlock()
+			return written, err
+		}
+		if this.localFin {
+			this.lock.Unlock()
+			return written, ErrStreamClosed
+		}
+		if this.sendWindow == 0 {
+			this.lock.Unlock()
+			select {
+			case <-this.writable:
+			case <-this.session.done:
+				return written, ErrClosed
+			}
+			continue
+		}
+		n := len(b) - written
+		if n > maxBodySize-1 {
+			n = maxBodySize - 1
+		}
+		if uint32(n) > this.sendWindow {
+			n = int(this.sendWindow)
+		}
+		this.sendWindow -= uint32(n)
+		this.lock.Unlock()
+
+		if err := this.send(STREAM_DATA, b[written:written+n]); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// Close 关闭流的写入方向，对端读完缓冲的数据后得到 io.EOF
+func (this *Stream) Close() error {
+	this.lock.Lock()
+	if this.localFin || this.err != nil {
+		this.lock.Unlock()
+		return nil
+	}
+	this.localFin = true
+	done := this.remoteFin
+	this.lock.Unlock()
+
+	err := this.send(STREAM_FIN, nil)
+	if done {
+		this.session.removeStream(this)
+	}
+	return err
+}
+
+// Reset 重置流，双方的读写立即失败
+func (this *Stream) Reset() error {
+	if !this.reset(ErrStreamReset) {
+		return nil
+	}
+	return this.send(STREAM_RST, nil)
+}
+
+// send 发送一个流消息，发送队列已满时等待队列有空位
+func (this *Stream) send(kind uint8, payload []byte) error {
+	body := make([]byte, 0, 1+len(payload))
+	body = append(body, kind)
+	body = append(body, payload...)
+
+	this.lock.Lock()
+	priority := this.priority
+	this.lock.Unlock()
+	// 打开、数据和关闭消息必须按顺序到达，使用流的优先级；窗口和重置与顺序无关，优先发送
+	if kind == STREAM_WINDOW || kind == STREAM_RST {
+		priority = PRIORITY_HIGH
+	}
+	if this.session.state.Load() != WORKING {
+		return ErrClosed
+	}
+	return this.session.enqueueWait(this.session.pack(this.id, STREAM, body), priority)
+}
+
+// receive 把收到的数据放入接收缓冲区，超出窗口时返回 false
+func (this *Stream) receive(payload []byte) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.err != nil || this.remoteFin {
+		return true
+	}
+	if this.received+uint32(len(payload)) > this.window {
+		return false
+	}
+	this.received += uint32(len(payload))
+	this.buf = append(this.buf, payload...)
+	notify(this.readable)
+	return true
+}
+
+// grant 处理对端授予的发送窗口
+func (this *Stream) grant(n uint32) {
+	this.lock.Lock()
+	this.sendWindow += n
+	this.lock.Unlock()
+	notify(this.writable)
+}
+
+// remoteClose 处理对端关闭写入，双方都关闭后移除流
+func (this *Stream) remoteClose() {
+	this.lock.Lock()
+	this.remoteFin = true
+	done := this.localFin
+	this.lock.Unlock()
+	notify(this.readable)
+	if done {
+		this.session.removeStream(this)
+	}
+}
+
+// reset 以 err 重置流并唤醒读写方，已经重置过时返回 false
+func (this *Stream) reset(err error) bool {
+	this.lock.Lock()
+	if this.err != nil {
+		this.lock.Unlock()
+		return false
+	}
+	this.err = err
+	this.buf = nil
+	this.lock.Unlock()
+	notify(this.readable)
+	notify(this.writable)
+	this.session.removeStream(this)
+	return true
+}
+
+// notify 非阻塞地发送通知
+func notify(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,240 @@
+package network
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+// streamPair 连接启用流复用的服务端和客户端，window 为双方每个流的接收窗口
+func streamPair(t *testing.T, window uint32) (*TcpClient, *Session, *Session) {
+	t.Helper()
+	sh := newTestHandler()
+	srv := NewTcpServer(sh, memAddress(t))
+	srv.SetMultiplexing(Multiplexing{Window: window})
+	startServer(t, srv, 1)
+
+	ch := newTestHandler()
+	c := NewTcpClient(ch)
+	c.SetMultiplexing(Multiplexing{Window: window})
+	cs := dialClient(t, c, ch, memAddress(t))
+	ss := sh.waitConnect(t)
+	waitFor(t, "stream negotiation", func() bool { return cs.muxStreams() != nil && ss.muxStreams() != nil })
+	return c, cs, ss
+}
+
+// openPair 在客户端打开一个流并在服务端接受
+func openPair(t *testing.T, cs, ss *Session) (*Stream, *Stream) {
+	t.Helper()
+	client, err := cs.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := ss.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.ID() != client.ID() {
+		t.Fatalf("accepted stream %d, opened %d", server.ID(), client.ID())
+	}
+	return client, server
+}
+
+// asyncErr 在后台运行 fn，返回接收结果的通道
+func asyncErr(fn func() error) chan error {
+	done := make(chan error, 1)
+	go func() { done <- fn() }()
+	return done
+}
+
+// waitErr 等待后台操作的结果
+func waitErr(t *testing.T, done chan error) error {
+	t.Helper()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(testTimeout):
+		t.Fatal("operation did not return")
+		return nil
+	}
+}
+
+func TestStreamOpenAccept(t *testing.T) {
+	_, cs, ss := streamPair(t, 0)
+	client, server := openPair(t, cs, ss)
+	if client.ID()%2 != 1 {
+		t.Fatalf("client stream id %d is not odd", client.ID())
+	}
+
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(server, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("server read %q %v", buf, err)
+	}
+	if _, err := server.Write([]byte("pong")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(client, buf); err != nil || string(buf) != "pong" {
+		t.Fatalf("client read %q %v", buf, err)
+	}
+}
+
+func TestStreamUnsupported(t *testing.T) {
+	sh := newTestHandler()
+	startServer(t, NewTcpServer(sh, memAddress(t)), 1)
+	ch := newTestHandler()
+	c := NewTcpClient(ch)
+	c.SetMultiplexing(Multiplexing{})
+	cs := dialClient(t, c, ch, memAddress(t))
+	if _, err := cs.OpenStream(); err != ErrStreamUnsupported {
+		t.Fatalf("OpenStream = %v, want ErrStreamUnsupported", err)
+	}
+}
+
+// TestStreamWindow 发送窗口用完时写入阻塞，对端读取后授予窗口，写入继续
+func TestStreamWindow(t *testing.T) {
+	const window = 1024
+	_, cs, ss := streamPair(t, window)
+	client, server := openPair(t, cs, ss)
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 4*window/16)
+	done := asyncErr(func() error {
+		_, err := client.Write(data)
+		return err
+	})
+	waitFor(t, "send window exhausted", func() bool {
+		client.lock.Lock()
+		defer client.lock.Unlock()
+		return client.sendWindow == 0
+	})
+	select {
+	case err := <-done:
+		t.Fatalf("write returned %v before the peer read", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(server, got); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitErr(t, done); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("stream data corrupted")
+	}
+}
+
+// TestStreamFinEOF 关闭写入后对端读完缓冲的数据得到 io.EOF，本端不能再写入
+func TestStreamFinEOF(t *testing.T) {
+	_, cs, ss := streamPair(t, 0)
+	client, server := openPair(t, cs, ss)
+
+	client.Write([]byte("last"))
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(server)
+	if err != nil || string(got) != "last" {
+		t.Fatalf("ReadAll = %q %v", got, err)
+	}
+	if _, err := client.Write([]byte("more")); err != ErrStreamClosed {
+		t.Fatalf("write after Close = %v, want ErrStreamClosed", err)
+	}
+	// 另一个方向仍然可以写入
+	if _, err := server.Write([]byte("reply")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(client, buf); err != nil || string(buf) != "reply" {
+		t.Fatalf("client read %q %v", buf, err)
+	}
+}
+
+// TestStreamReset 重置后双方的读写立即失败
+func TestStreamReset(t *testing.T) {
+	_, cs, ss := streamPair(t, 0)
+	client, server := openPair(t, cs, ss)
+
+	read := asyncErr(func() error {
+		_, err := server.Read(make([]byte, 1))
+		return err
+	})
+	if err := client.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitErr(t, read); err != ErrStreamReset {
+		t.Fatalf("server read = %v, want ErrStreamReset", err)
+	}
+	if _, err := server.Write([]byte("x")); err != ErrStreamReset {
+		t.Fatalf("server write = %v, want ErrStreamReset", err)
+	}
+	if _, err := client.Read(make([]byte, 1)); err != ErrStreamReset {
+		t.Fatalf("client read = %v, want ErrStreamReset", err)
+	}
+}
+
+// TestStreamSessionClose 会话关闭时流的读写和 AcceptStream 都返回错误
+func TestStreamSessionClose(t *testing.T) {
+	c, cs, ss := streamPair(t, 0)
+	client, server := openPair(t, cs, ss)
+
+	read := asyncErr(func() error {
+		_, err := server.Read(make([]byte, 1))
+		return err
+	})
+	accept := asyncErr(func() error {
+		_, err := ss.AcceptStream()
+		return err
+	})
+	c.Close()
+	if err := waitErr(t, read); err == nil {
+		t.Fatal("server read succeeded after the session closed")
+	}
+	if err := waitErr(t, accept); err != ErrClosed {
+		t.Fatalf("AcceptStream = %v, want ErrClosed", err)
+	}
+	if _, err := client.Write([]byte("x")); err == nil {
+		t.Fatal("client write succeeded after the session closed")
+	}
+}
+
+// TestStreamQueueLane 流默认使用低优先级队列，队列满时写入等待空位，普通消息不受影响
+func TestStreamQueueLane(t *testing.T) {
+	// 没有启动写协程的会话，发送队列不会被取出
+	s := CreateSession(readerConn{bytes.NewReader(nil)}, func(uint16, uint16, []byte) {})
+	s.mux = &Multiplexing{Window: DefaultStreamWindow, Backlog: DefaultStreamBacklog}
+	s.enableStreams(DefaultStreamWindow, 1)
+	s.state.Store(WORKING)
+	stream, err := s.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 打开流的消息占用了一个位置
+	done := asyncErr(func() error {
+		for i := 0; i < writeQueueSize; i++ {
+			if _, err := stream.Write([]byte{byte(i)}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	waitFor(t, "low queue full", func() bool { return len(s.outQueues[PRIORITY_LOW]) == writeQueueSize })
+	if err := s.doWrite(1, DATA, []byte("rpc"), PRIORITY_NORMAL); err != nil {
+		t.Fatalf("normal write with a full stream lane = %v", err)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("stream write returned %v with a full queue", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	<-s.outQueues[PRIORITY_LOW]
+	if err := waitErr(t, done); err != nil {
+		t.Fatal(err)
+	}
+}
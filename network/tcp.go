@@ -4,81 +4,376 @@ import (
 	"github.com/lizhen1412/eegos/log"
 	"github.com/lizhen1412/eegos/util"
 
+	"context"
+	"fmt"
 	"net"
+	"runtime"
 	"runtime/debug"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // Handler 定义了RPC网络处理器的接口，包括连接、消息、心跳和关闭事件的处理方法。
+// Close 的第二个参数描述会话关闭的原因和底层错误。
 type Handler interface {
 	Connect(uint16, *Session)
 	Message(uint16, uint16, []byte)
 	Heartbeat(uint16, uint16)
-	Close(uint16)
+	Close(uint16, CloseInfo)
 }
 
 // TcpServer 表示RPC服务器，处理网络连接和消息传递。
+// 一个服务器可以同时监听多个地址，所有监听器共用同一个 Handler。
 type TcpServer struct {
 	TcpConn
-	addr *net.TCPAddr
+	addrs     []*net.TCPAddr     // 需要监听的地址列表
+	listeners []*net.TCPListener // 已经打开的监听器
+	lisLock   sync.Mutex         // 保护 listeners
+	registry  *resumeRegistry    // 启用断线恢复的会话
+	loops     int                // epoll 事件循环的数量，0 表示使用协程模式
+	epoll     *epollGroup        // epoll 模式的事件循环
+	handoff   string             // 平滑重启时继承监听器的 unix 套接字路径
+	stopped   bool               // 已停止接受新连接
+	live      sync.Map           // 已建立的会话，用于 Drain
+	shards    int                // 每个地址的监听器数量，大于 1 时使用 SO_REUSEPORT
+	endpoints []string           // 通过其他传输方式监听的地址，形如 "scheme://地址"
+	others    []net.Listener     // 其他传输方式已经打开的监听器
 }
 
-// NewTcpServer 创建一个新的TCP服务器实例，监听指定地址。
-func NewTcpServer(handle Handler, addr string) *TcpServer {
-	// 解析TCP地址
-	tcpAddr, err := net.ResolveTCPAddr("tcp4", addr)
-	if err != nil {
-		log.Error("gateserver.Open: net.ResolveTCPAddr: ", err)
+// NewTcpServer 创建一个新的TCP服务器实例，监听指定的一个或多个地址，使用默认的套接字选项。
+// 地址支持 IPv4 和 IPv6，例如 "0.0.0.0:8080"、"[::1]:8080"，
+// 只写端口（":8080"）时同时监听 IPv4 和 IPv6。
+// 地址也可以是 "scheme://地址" 的形式，按 scheme 使用注册的传输方式监听，例如 "unix:///tmp/game.sock"、
+// "ws://:8081/game"、"mem://lobby"，参见 Transport。
+func NewTcpServer(handle Handler, addrs ...string) *TcpServer {
+	return NewTcpServerWithOptions(handle, DefaultSocketOptions(), addrs...)
+}
+
+// NewTcpServerWithOptions 创建一个新的TCP服务器实例，接受的连接会应用 opts 中的套接字选项。
+// 选项不合法或地址无法解析时返回 nil。
+func NewTcpServerWithOptions(handle Handler, opts SocketOptions, addrs ...string) *TcpServer {
+	if len(addrs) == 0 {
+		log.Error("gateserver.Open: no listen address")
 		return nil
 	}
+	if err := opts.Validate(); err != nil {
+		log.Error("gateserver.Open: socket options: ", err)
+		return nil
+	}
+
+	tcpAddrs := make([]*net.TCPAddr, 0, len(addrs))
+	endpoints := make([]string, 0)
+	for _, addr := range addrs {
+		// 其他传输方式的地址在 Start 时才查找传输方式，以便之后调用 SetTransport
+		scheme, host := splitScheme(addr)
+		if scheme != "tcp" {
+			endpoints = append(endpoints, addr)
+			continue
+		}
+		// 解析TCP地址，"tcp" 同时支持 IPv4 和 IPv6
+		tcpAddr, err := net.ResolveTCPAddr("tcp", host)
+		if err != nil {
+			log.Error("gateserver.Open: net.ResolveTCPAddr: ", err)
+			return nil
+		}
+		tcpAddrs = append(tcpAddrs, tcpAddr)
+	}
 	// 创建TCP服务器实例
-	newServer := &TcpServer{TcpConn{isOpen: true, handle: handle},
-		tcpAddr,
+	newServer := &TcpServer{TcpConn: TcpConn{handle: handle, sockOpts: opts.clone(), groups: newGroups()},
+		addrs:     tcpAddrs,
+		endpoints: endpoints,
+		registry:  newResumeRegistry(),
 	}
+	newServer.isOpen.Store(true)
 	return newServer
 }
 
-// Start 启动TCP服务器，监听指定地址并接受客户端连接。
-func (this *TcpServer) Start() {
-	// 监听指定地址
-	lis, err := net.ListenTCP("tcp", this.addr)
+// SetEventLoops 让服务器使用 epoll 模式，仅支持 Linux，需要在 Start 之前调用。
+// epoll 模式下由 loops 个事件循环协程以非阻塞方式读取所有连接并解析消息，
+// 每个连接不再占用读、写和处理协程，适合大量空闲连接的场景；loops 小于等于 0 时使用 CPU 核数。
+// 处理器接口和写入方式不变，但消息直接写到连接上，写不完的数据按顺序积压，不区分优先级。
+// epoll 模式不支持连接包装（SetConnWrapper）和断线恢复（SetResumption）。
+func (this *TcpServer) SetEventLoops(loops int) error {
+	if !supportEpoll {
+		return ErrUnsupportedOption
+	}
+	if loops <= 0 {
+		loops = runtime.NumCPU()
+	}
+	this.loops = loops
+	return nil
+}
+
+// SetAcceptShards 让服务器在每个地址上打开 shards 个设置了 SO_REUSEPORT 的监听器，仅支持 Linux，需要在 Start 之前调用。
+// 每个监听器有独立的接收协程，由内核在监听器之间分配新连接，避免大量登录时单个接收循环成为瓶颈；
+// shards 小于等于 0 时使用 CPU 核数。每个监听器接受的连接数统计到 "server.accept.<地址>.<序号>"。
+// 地址的端口为 0 时所有分片共享第一个分片绑定的端口。
+func (this *TcpServer) SetAcceptShards(shards int) error {
+	if !supportReusePort {
+		return ErrUnsupportedOption
+	}
+	if shards <= 0 {
+		shards = runtime.NumCPU()
+	}
+	this.shards = shards
+	return nil
+}
 
-	log.Info("gateserver.Open: listening", this.addr)
+// listen 在地址上打开一个监听器，分片监听时设置 SO_REUSEPORT
+func (this *TcpServer) listen(addr *net.TCPAddr) (*net.TCPListener, error) {
+	if this.shards <= 1 {
+		return net.ListenTCP("tcp", addr)
+	}
+	lc := net.ListenConfig{Control: setReusePort}
+	lis, err := lc.Listen(context.Background(), "tcp", addr.String())
 	if err != nil {
-		log.Error("gateserver.Open: net.ListenTCP: ", err)
-		return
+		return nil, err
 	}
+	return lis.(*net.TCPListener), nil
+}
 
-	// 处理新连接
-	func(l *net.TCPListener) {
-		//defer log.Debug("listen stop")
-		for {
-			conn, err := l.Accept()
+// Start 启动TCP服务器，监听所有地址并接受客户端连接。
+// 任意一个地址监听失败时关闭已打开的监听器并返回；
+// 否则阻塞直到所有监听器停止。
+func (this *TcpServer) Start() {
+	// 创建 epoll 模式的事件循环
+	if this.loops > 0 {
+		if this.wrap != nil || this.resume != nil {
+			log.Warn("connection wrapper and resumption are ignored in epoll mode")
+		}
+		group, err := newEpollGroup(this, this.loops)
+		if err != nil {
+			log.Error("gateserver.Open: epoll: ", err)
+			return
+		}
+		this.epoll = group
+	}
+
+	// 设置了交接路径时先从旧进程继承监听器
+	var inherited []*net.TCPListener
+	if this.handoff != "" {
+		var err error
+		if inherited, err = inheritListeners(this.handoff); err != nil {
+			log.Info("gateserver.Open: no listener to inherit: ", err)
+		}
+	}
+
+	// 监听所有地址，优先使用继承的监听器；分片监听时每个地址打开多个监听器
+	shards := this.shards
+	if shards < 1 {
+		shards = 1
+	}
+	listeners := make([]*net.TCPListener, 0, len(this.addrs)*shards)
+	for _, addr := range this.addrs {
+		for shard := 0; shard < shards; shard++ {
+			if lis := takeListener(&inherited, addr); lis != nil {
+				log.Info("gateserver.Open: inherited", lis.Addr())
+				listeners = append(listeners, lis)
+				continue
+			}
+			lis, err := this.listen(addr)
 			if err != nil {
-				log.Error("gateserver.Open: lis.Accept: ", err)
+				// 第一个之后的分片失败时少用几个分片，例如继承的监听器没有设置 SO_REUSEPORT
+				if shard > 0 {
+					log.Warn("gateserver.Open: accept shard", addr, shard, err)
+					break
+				}
+				log.Error("gateserver.Open: net.ListenTCP: ", err)
+				for _, l := range append(listeners, inherited...) {
+					l.Close()
+				}
 				return
 			}
-			//conn.SetKeepAlive(true)
-			//conn.SetKeepAlivePeriod(5 * time.Second)
-			go this.handleNewConn(conn)
+			log.Info("gateserver.Open: listening", lis.Addr())
+			listeners = append(listeners, lis)
+			// 其余分片监听第一个分片实际绑定的端口，配置的端口为 0 时同样共享
+			if shard == 0 && addr.Port == 0 {
+				bound := *addr
+				bound.Port = lis.Addr().(*net.TCPAddr).Port
+				addr = &bound
+			}
+		}
+	}
+	// 没有用到的继承监听器
+	for _, l := range inherited {
+		l.Close()
+	}
+
+	// 其他传输方式的监听器
+	others := make([]net.Listener, 0, len(this.endpoints))
+	for _, endpoint := range this.endpoints {
+		lis, err := this.listenEndpoint(endpoint)
+		if err != nil {
+			log.Error("gateserver.Open: listen", endpoint, err)
+			for _, l := range listeners {
+				l.Close()
+			}
+			for _, l := range others {
+				l.Close()
+			}
+			return
+		}
+		log.Info("gateserver.Open: listening", endpoint)
+		others = append(others, lis)
+	}
+
+	this.lisLock.Lock()
+	if this.stopped {
+		this.lisLock.Unlock()
+		for _, l := range listeners {
+			l.Close()
+		}
+		for _, l := range others {
+			l.Close()
+		}
+		return
+	}
+	this.listeners = listeners
+	this.others = others
+	this.lisLock.Unlock()
+
+	// 每个监听器一个接收协程，同一地址的监听器按顺序编号
+	wg := sync.WaitGroup{}
+	shardIndex := make(map[string]int)
+	for _, lis := range listeners {
+		name := lis.Addr().String()
+		metric := fmt.Sprintf("server.accept.%s.%d", name, shardIndex[name])
+		shardIndex[name]++
+		wg.Add(1)
+		go func(l *net.TCPListener) {
+			defer wg.Done()
+			this.accept(l, metric)
+		}(lis)
+	}
+	for i, lis := range others {
+		metric := fmt.Sprintf("server.accept.%s.0", this.endpoints[i])
+		wg.Add(1)
+		go func(l net.Listener) {
+			defer wg.Done()
+			this.accept(l, metric)
+		}(lis)
+	}
+	wg.Wait()
+}
+
+// listenEndpoint 按 scheme 对应的传输方式在地址上监听
+func (this *TcpServer) listenEndpoint(endpoint string) (net.Listener, error) {
+	scheme, addr := splitScheme(endpoint)
+	transport, err := this.transport(scheme)
+	if err != nil {
+		return nil, err
+	}
+	return transport.Listen(addr)
+}
+
+// accept 在指定监听器上循环接受新连接，接受的连接数统计到 metric
+func (this *TcpServer) accept(l net.Listener, metric string) {
+	//defer log.Debug("listen stop")
+	listener := l.Addr().String()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			// StopAccept 关闭监听器时正常退出
+			this.lisLock.Lock()
+			stopped := this.stopped
+			this.lisLock.Unlock()
+			if stopped {
+				log.Info("gateserver.Open: stop accepting", listener)
+			} else {
+				log.Error("gateserver.Open: lis.Accept: ", err)
+			}
+			return
 		}
-	}(lis)
+		metrics.add(metric, 1)
+		go this.handleNewConn(conn, listener)
+	}
+}
+
+// Addrs 返回服务器正在监听的地址，未启动时返回空
+func (this *TcpServer) Addrs() []net.Addr {
+	this.lisLock.Lock()
+	defer this.lisLock.Unlock()
+
+	addrs := make([]net.Addr, 0, len(this.listeners)+len(this.others))
+	for _, l := range this.listeners {
+		addrs = append(addrs, l.Addr())
+	}
+	for _, l := range this.others {
+		addrs = append(addrs, l.Addr())
+	}
+	return addrs
 }
 
 // handleNewConn 处理新的客户端连接，创建并启动会话。
-func (this *TcpServer) handleNewConn(conn net.Conn) {
-	// 创建一个新的会话对象，并传入连接对象
-	s := this.NewSession(conn)
+// 参数 listener 是接受该连接的监听地址，会记录在会话中。
+func (this *TcpServer) handleNewConn(conn net.Conn, listener string) {
+	// epoll 模式下完成密钥交换和认证后交给事件循环处理，其他传输方式的连接仍使用协程模式
+	if _, ok := conn.(*net.TCPConn); ok && this.epoll != nil {
+		var fc *frameCipher
+		var rw net.Conn = conn
+		if this.cipher != nil {
+			var err error
+			if fc, err = this.acceptCipher(conn); err != nil {
+				rejectCipher(conn, conn.RemoteAddr().String(), err)
+				return
+			}
+			rw = newCipherConn(conn, fc)
+		}
+		var identity interface{}
+		if this.auth != nil {
+			var err error
+			if identity, err = this.authAccept(rw); err != nil {
+				rejectAuth(conn, conn.RemoteAddr().String(), err)
+				return
+			}
+		}
+		this.epoll.add(conn, listener, identity, fc)
+		return
+	}
+
+	// 创建一个新的会话对象，并传入连接对象；设置了加密和认证器时先完成密钥交换和认证
+	s := this.newSession(conn)
+	s.server = true
+	s.listener = listener
+	if this.cipher != nil {
+		fc, err := this.acceptCipher(s.conn)
+		if err == nil {
+			err = s.setCipher(fc)
+		}
+		if err != nil {
+			rejectCipher(s.conn, conn.RemoteAddr().String(), err)
+			return
+		}
+	}
+	if this.auth != nil {
+		identity, err := this.authAccept(s.conn)
+		if err != nil {
+			s.setCloseInfo(CLOSE_AUTH_FAILED, err)
+			rejectAuth(s.conn, conn.RemoteAddr().String(), err)
+			return
+		}
+		s.identity = identity
+	}
+	// 启用断线恢复时先检查是否为恢复请求
+	if this.resume != nil {
+		s.registry = this.registry
+		if this.resumeConn(s) {
+			return
+		}
+	}
+	s.Start()
 
 	// 在函数执行完成后，处理可能的恢复错误，并关闭会话
 	defer func() {
 		if err := recover(); err != nil {
 			log.Error(err, string(debug.Stack()))
-			s.Close()
+			s.CloseWithReason(CLOSE_UNKNOWN, fmt.Errorf("%v", err))
 		}
 	}()
 
 	// 调用 handle 的 Connect 方法建立客户端会话
+	this.live.Store(s, struct{}{})
 	this.handle.Connect(s.fd, s)
 	// 启动一个独立的 goroutine 处理会话的输入数据
 	go this.processInData(s)
@@ -92,74 +387,156 @@ func (this *TcpServer) handleNewConn(conn net.Conn) {
 func (this *TcpServer) processInData(s *Session) {
 	//defer log.Debug("processInData stop")
 	// 处理传入数据
-	for this.isOpen {
+	for this.isOpen.Load() {
 		select {
 		case data, ok := <-s.inData:
 			if !ok {
 				continue
 			}
-			switch data.dType {
-			case HEARTBEAT:
-				// 如果会话状态不是工作中，不处理心跳消息
-				if s.state != WORKING {
-					break
-				}
-				// 发送心跳响应并通知处理器处理心跳事件
-				go s.doWrite(data.head, HEARTBEAT_RET, []byte{})
-				go this.handle.Heartbeat(s.fd, data.head)
-			case DATA:
-				// 将普通数据消息传递给消息处理器进行处理
-				go s.msgHandle(s.fd, data.head, data.body)
-			}
+			this.process(s, data)
 		case <-s.cClose:
-			// 如果会话关闭，触发关闭事件并处理
-			this.Close(s)
+			// 如果会话关闭，可以恢复的会话等待重连，否则触发关闭事件并处理
+			if !this.park(s) {
+				this.Close(s)
+			}
 			return
 		}
 	}
 }
 
+// process 按数据类型处理会话收到的消息，消息处理完后回收数据包。
+// 如果接收到心跳消息（HEARTBEAT），会响应并通知处理器进行心跳处理。
+// 如果接收到普通数据消息（DATA），会将消息传递给消息处理器进行处理。
+func (this *TcpServer) process(s *Session, data *Data) {
+	switch data.dType {
+	case HEARTBEAT:
+		// 如果会话状态不是工作中，不处理心跳消息
+		if s.state.Load() != WORKING {
+			break
+		}
+		// 发送带有时间戳的心跳响应并通知处理器处理心跳事件
+		go s.doWrite(data.head, HEARTBEAT_RET, s.clock.heartbeatRet(data.body, time.Now()), PRIORITY_HIGH)
+		go this.handle.Heartbeat(s.fd, data.head)
+	case DATA:
+		// 将普通数据消息传递给消息处理器进行处理，处理完后回收数据包
+		s.dispatchData(data)
+		return
+	}
+	releaseData(data)
+}
+
 // TcpClient 表示RPC客户端，用于建立与服务器的连接并处理网络通信。
 type TcpClient struct {
-	TcpConn                  // 嵌入TcpConn以复用网络连接和关闭方法
-	msgCounter *util.Counter // 用于生成会话ID的计数器
-	cHeartbeat chan uint16   // 用于接收心跳响应的通道
-	ticker     *time.Timer   // 用于发送心跳消息的定时器
-	session    *Session      // 客户端会话实例
+	TcpConn                    // 嵌入TcpConn以复用网络连接和关闭方法
+	msgCounter  *util.Counter  // 用于生成会话ID的计数器
+	cHeartbeat  chan uint16    // 用于接收心跳响应的通道
+	ticker      *time.Timer    // 用于发送心跳消息的定时器
+	lock        sync.Mutex     // 保护 session 和 addr，故障转移时在后台协程中替换
+	session     *Session       // 客户端会话实例
+	dialTimeout time.Duration  // 建立连接的超时时间
+	addr        string         // 服务器地址，断线恢复时重新连接
+	failover    *failoverState // 多地址故障转移的状态，nil 表示只连接一个地址
+	proxy       *proxyConfig   // 代理服务器设置，nil 表示直接连接
 }
 
-// NewTcpClient 创建一个新的TCP客户端实例。
+// 默认的建立连接超时时间
+const DefaultDialTimeout = 5 * time.Second
+
+// NewTcpClient 创建一个新的TCP客户端实例，使用默认的套接字选项。
 // 参数 handle 是一个实现了Handler接口的对象，用于处理网络连接事件和消息。
 // 返回一个新的TcpClient实例，用于建立与服务器的连接和处理通信。
 func NewTcpClient(handle Handler) *TcpClient {
+	return NewTcpClientWithOptions(handle, DefaultSocketOptions())
+}
+
+// NewTcpClientWithOptions 创建一个新的TCP客户端实例，建立的连接会应用 opts 中的套接字选项。
+// 选项不合法时返回 nil。
+func NewTcpClientWithOptions(handle Handler, opts SocketOptions) *TcpClient {
+	if err := opts.Validate(); err != nil {
+		log.Error("TcpClient socket options: ", err)
+		return nil
+	}
 	// 创建一个新的TcpClient实例，初始化网络连接、会话ID计数器、心跳响应通道、定时器等属性
-	newClient := &TcpClient{TcpConn{isOpen: true, handle: handle},
+	newClient := &TcpClient{TcpConn{handle: handle, sockOpts: opts.clone(), groups: newGroups()},
 		&util.Counter{Num: 0},
 		make(chan uint16),
 		time.NewTimer(5 * time.Second),
+		sync.Mutex{},
+		nil,
+		DefaultDialTimeout,
+		"",
+		nil,
 		nil}
+	newClient.isOpen.Store(true)
 	return newClient
 }
 
+// SetDialTimeout 设置建立连接的超时时间，小于等于 0 表示不设置超时
+func (this *TcpClient) SetDialTimeout(timeout time.Duration) {
+	this.dialTimeout = timeout
+}
+
 // Dial 建立与指定地址的TCP连接并初始化客户端会话。
 // 参数 addr 是服务器的网络地址，如"host:port"。
-func (this *TcpClient) Dial(addr string) {
-	// 使用net.Dial函数建立TCP连接
-	conn, err := net.Dial("tcp", addr)
+func (this *TcpClient) Dial(addr string) error {
+	return this.DialContext(context.Background(), addr)
+}
+
+// DialContext 在 ctx 的控制下建立与指定地址的TCP连接并初始化客户端会话。
+// 连接受 ctx 和拨号超时时间共同限制，失败时返回错误。
+func (this *TcpClient) DialContext(ctx context.Context, addr string) error {
+	// 使用带超时的 Dialer 建立TCP连接，设置了代理时经过代理服务器
+	conn, err := this.dial(ctx, addr)
 	if err != nil {
 		log.Error("net.Dial: ", err)
-		return
+		return err
 	}
 
-	// 创建一个新的会话实例，并将其与连接关联
-	s := this.NewSession(conn)
+	// 创建一个新的会话实例，并将其与连接关联；设置了加密和认证器时先完成密钥交换和认证
+	s := this.newSession(conn)
+	if this.cipher != nil {
+		fc, err := this.dialCipher(s.conn)
+		if err == nil {
+			err = s.setCipher(fc)
+		}
+		if err != nil {
+			log.Error("cipher: ", err)
+			s.conn.Close()
+			return err
+		}
+	}
+	if this.auth != nil {
+		if err := this.authDial(s.conn); err != nil {
+			log.Error("auth: ", err)
+			s.setCloseInfo(CLOSE_AUTH_FAILED, err)
+			s.conn.Close()
+			return err
+		}
+	}
+	s.Start()
+	// 发起握手，协商可选功能
+	if err := s.startHandshake(); err != nil {
+		s.abort(CLOSE_NORMAL, err)
+		return err
+	}
 	// 调用处理器的Connect方法，通知连接建立事件
 	this.handle.Connect(s.fd, s)
 	// 设置客户端的会话实例
+	this.lock.Lock()
 	this.session = s
+	this.addr = addr
+	this.lock.Unlock()
 	// 启动处理客户端传入数据和心跳的协程
-	go this.processInData()
-	go this.heartbeat()
+	go this.processInData(s)
+	go this.heartbeat(s)
+	return nil
+}
+
+// currentSession 返回客户端当前的会话，故障转移时会话在锁内被替换
+func (this *TcpClient) currentSession() *Session {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.session
 }
 
 // GetSessionID 获取当前客户端会话的唯一标识符（会话ID）。
@@ -170,12 +547,11 @@ func (this *TcpClient) GetSessionID() uint16 {
 }
 
 // processInData 处理从服务器接收的数据流，包括心跳响应和普通数据。
-func (this *TcpClient) processInData() {
+// 会话 s 由调用方传入，故障转移时 this.session 可能已经被新的连接替换。
+func (this *TcpClient) processInData(s *Session) {
 	//defer log.Debug("processInData stop")
-	// 获取客户端会话实例
-	s := this.session
 	// 循环处理数据，直到客户端连接关闭
-	for this.isOpen {
+	for {
 		select {
 		case data, ok := <-s.inData:
 			if !ok {
@@ -184,36 +560,47 @@ func (this *TcpClient) processInData() {
 			switch data.dType {
 			// 处理心跳响应消息
 			case HEARTBEAT_RET:
+				s.clock.heartbeatAck(data.body, time.Now())
 				go this.handleHeartbeatRet(s.fd, data.head)
-			// 处理普通数据消息
+				releaseData(data)
+			// 处理普通数据消息，处理完后回收数据包
 			case DATA:
-				go s.msgHandle(s.fd, data.head, data.body)
+				s.dispatchData(data)
+			default:
+				releaseData(data)
 			}
 			// 重置心跳定时器，以保持定时发送心跳消息
 			go this.ticker.Reset(5 * time.Second)
 		case <-s.cClose:
-			// 当客户端连接关闭时，执行关闭操作并返回
-			this.Close()
+			// 可以恢复的会话在后台重连，恢复后重新处理传入数据
+			if s.resumable() {
+				go this.reconnect(s)
+				return
+			}
+			// 当客户端连接关闭时，停止心跳并通知处理器，设置了故障转移时连接下一个地址
+			this.connectionLost(s)
 			return
 		}
 	}
 }
 
-// heartbeat 定期发送心跳消息以维持与服务器的连接。
-func (this *TcpClient) heartbeat() {
+// heartbeat 定期发送心跳消息以维持与服务器的连接，会话 s 释放后退出。
+func (this *TcpClient) heartbeat(s *Session) {
 	//defer log.Debug("heartbeat stop")
-	// 获取客户端会话实例
-	s := this.session
 	// 循环发送心跳消息，直到客户端连接关闭
-	for this.isOpen {
-		// 等待定时器的触发
-		<-this.ticker.C
+	for this.isOpen.Load() {
+		// 等待定时器的触发，会话释放后退出
+		select {
+		case <-this.ticker.C:
+		case <-s.done:
+			return
+		}
 		//log.Debug("heartbeat ticker")
 		// 获取当前会话的唯一标识符（会话ID）
 		sessionID := this.msgCounter.GetNum()
 
-		// 发送心跳消息到服务器
-		go s.doWrite(sessionID, HEARTBEAT, []byte{})
+		// 发送带有时间戳的心跳消息到服务器，用于时钟同步
+		go s.doWrite(sessionID, HEARTBEAT, s.clock.heartbeatBody(time.Now()), PRIORITY_HIGH)
 
 		// 监听心跳响应或超时
 		select {
@@ -224,6 +611,8 @@ func (this *TcpClient) heartbeat() {
 			// 超时未收到心跳响应，记录警告信息，并重新设置心跳定时器
 			log.Warn("heartbeat Timed out", sessionID)
 			this.ticker.Reset(5 * time.Second)
+		case <-s.done:
+			return
 		}
 
 	}
@@ -232,67 +621,213 @@ func (this *TcpClient) heartbeat() {
 // handleHeartbeatRet 处理收到的心跳响应消息，并将会话ID发送到心跳响应通道。
 // 参数 fd 是会话的唯一标识符，sessionID 是心跳消息中包含的会话ID。
 func (this *TcpClient) handleHeartbeatRet(fd uint16, sessionID uint16) {
-	// 将会话ID发送到心跳响应通道，以表示成功接收到心跳响应
-	this.cHeartbeat <- sessionID
+	// 将会话ID发送到心跳响应通道，没有协程等待时丢弃
+	select {
+	case this.cHeartbeat <- sessionID:
+	default:
+	}
 }
 
 // WriteData 向服务器发送自定义数据消息，并返回分配的会话ID。
 // 参数 s 是会话实例，buff 是要发送的数据内容。
-// 返回一个uint16类型的值，表示分配的会话ID。
-func (this *TcpClient) WriteData(s *Session, buff []byte) uint16 {
+// 返回分配的会话ID，以及写入失败时的错误。
+func (this *TcpClient) WriteData(s *Session, buff []byte) (uint16, error) {
 	// 获取新的会话ID
 	sessionID := this.msgCounter.GetNum()
-	// 使用会话实例的doWrite方法发送数据消息
-	s.doWrite(sessionID, DATA, buff)
+	// 使用Write方法发送数据消息
+	err := this.Write(s, sessionID, buff)
 	// 返回分配的会话ID
-	return sessionID
+	return sessionID, err
 }
 
-// Close 关闭TCP客户端连接，停止心跳定时器和清理资源。
+// Close 关闭TCP客户端连接，停止心跳定时器。
+// 会话资源在读协程退出后释放，处理器会收到关闭原因为 CLOSE_NORMAL 的通知。
 func (this *TcpClient) Close() {
 	//log.Debug("TcpClient Close()")
-	// 关闭客户端连接标志
-	this.isOpen = false
+	// 关闭客户端连接标志，停止故障转移
+	this.isOpen.Store(false)
+	if this.failover != nil {
+		this.failover.stop()
+	}
 	// 停止心跳定时器
 	this.ticker.Stop()
-	// 关闭心跳响应通道
-	close(this.cHeartbeat)
-	// 关闭与服务器的连接并释放会话资源
-	this.TcpConn.Close(this.session)
+	// 关闭与服务器的连接
+	if s := this.currentSession(); s != nil {
+		s.Close()
+	}
 }
 
 // TcpConn 包含TCP连接相关的通用操作和处理器接口。
 type TcpConn struct {
-	isOpen bool    // TCP连接状态标志
-	handle Handler // 处理器接口，用于处理网络连接事件和消息
+	isOpen     atomic.Bool             // TCP连接状态标志
+	handle     Handler                 // 处理器接口，用于处理网络连接事件和消息
+	idle       time.Duration           // 会话读空闲超时，0 表示不限制
+	wrap       func(net.Conn) net.Conn // 创建会话前包装连接，例如注入故障
+	schedule   *WriteSchedule          // 会话发送队列的调度方式，nil 使用 DefaultWriteSchedule
+	flow       *FlowControl            // 流量控制设置，nil 表示不启用
+	sockOpts   SocketOptions           // 应用到新连接上的套接字选项
+	rate       *rateConfig             // 接收消息的速率限制，nil 表示不限制
+	resume     *Resumption             // 断线恢复设置，nil 表示不启用
+	mux        *Multiplexing           // 流复用设置，nil 表示不启用
+	groups     *Groups                 // 会话的分组
+	auth       *authConfig             // 会话启动前的认证设置，nil 表示不认证
+	checksum   bool                    // 是否协商消息包校验和
+	policy     *ProtocolPolicy         // 违反协议的消息的处理方式，nil 表示全部忽略
+	cipher     *cipherConfig           // 会话加密设置，nil 表示不加密
+	transports map[string]Transport    // 只在当前服务器或客户端使用的传输方式，优先于全局注册
+}
+
+// Groups 返回连接上会话的分组管理器，用于房间、场景等的加入、离开和广播
+func (this *TcpConn) Groups() *Groups {
+	return this.groups
+}
+
+// SetRateLimit 设置之后建立的会话接收消息的默认速率限制，作用于数据消息和心跳。
+// 握手、额度、恢复确认等会话层控制消息和流复用的 STREAM 消息不计入限制，流的数据量由流的窗口控制。
+// 丢弃的数据消息仍会归还流量控制额度。
+// 每个会话有独立的令牌桶，违规次数按处理方式统计到 "session.ratelimit.<action>"。
+func (this *TcpConn) SetRateLimit(limit RateLimit) {
+	if limit.Messages < 0 || limit.Bytes < 0 {
+		log.Error("rate limit must not be negative")
+		return
+	}
+	heads := make(map[uint16]RateLimit)
+	if this.rate != nil {
+		heads = this.rate.heads
+	}
+	this.rate = &rateConfig{limit: limit, heads: heads}
+}
+
+// SetHeadRateLimit 为消息头为 head 的数据消息设置单独的速率限制，
+// 匹配的消息使用独立的令牌桶，不再计入默认限制。
+func (this *TcpConn) SetHeadRateLimit(head uint16, limit RateLimit) {
+	if limit.Messages < 0 || limit.Bytes < 0 {
+		log.Error("rate limit must not be negative")
+		return
+	}
+	rate := &rateConfig{heads: make(map[uint16]RateLimit)}
+	if this.rate != nil {
+		rate.limit = this.rate.limit
+		for h, l := range this.rate.heads {
+			rate.heads[h] = l
+		}
+	}
+	rate.heads[head] = limit
+	this.rate = rate
+}
+
+// SetFlowControl 为之后建立的会话启用基于额度的流量控制。
+// 客户端在连接时发起协商，只有服务端也启用时才生效。
+func (this *TcpConn) SetFlowControl(flow FlowControl) {
+	if flow.Window == 0 {
+		log.Error("flow control window must be positive")
+		return
+	}
+	this.flow = &flow
+}
+
+// SetWriteSchedule 设置之后建立的会话在各优先级发送队列之间的调度方式
+func (this *TcpConn) SetWriteSchedule(schedule WriteSchedule) {
+	this.schedule = &schedule
+}
+
+// SetConnWrapper 设置连接包装函数，新连接在创建会话前会经过 wrap 包装，
+// 例如使用 FaultNetwork.Wrapper 注入网络故障。只影响之后建立的会话。
+func (this *TcpConn) SetConnWrapper(wrap func(net.Conn) net.Conn) {
+	this.wrap = wrap
+}
+
+// SetHeartbeatTimeout 设置会话的读空闲超时。
+// 超过 timeout 没有收到对端的任何数据（包括心跳）时关闭会话，
+// 关闭原因为 CLOSE_HEARTBEAT_TIMEOUT；0 表示不限制。只影响之后建立的会话。
+func (this *TcpConn) SetHeartbeatTimeout(timeout time.Duration) {
+	this.idle = timeout
 }
 
 // NewSession 创建一个新的会话实例，关联到指定的TCP连接。
 // 参数 conn 是网络连接实例，msgHandler 是消息处理器接口。
 // 返回一个新的会话实例。
 func (this *TcpConn) NewSession(conn net.Conn) *Session {
+	session := this.newSession(conn)
+	session.Start()
+	// 返回新的会话实例
+	return session
+}
+
+// newSession 创建并初始化会话，但不启动读写协程
+func (this *TcpConn) newSession(conn net.Conn) *Session {
 	// 输出新连接的调试信息
 	log.Debug("new connection from ", conn.RemoteAddr())
+	conn, applied := this.prepareConn(conn)
 	// 创建并初始化会话实例，设置消息处理器
 	session := CreateSession(conn, this.handle.Message)
-	session.Start()
-	// 返回新的会话实例
+	session.sockOpts = applied
+	session.idle = this.idle
+	session.flow = this.flow
+	session.rate = this.rate
+	session.resume = this.resume
+	session.mux = this.mux
+	session.groups = this.groups
+	session.checksum = this.checksum
+	session.policy = this.policy
+	if this.schedule != nil {
+		session.SetWriteSchedule(*this.schedule)
+	}
 	return session
 }
 
+// prepareConn 应用套接字选项并按设置包装连接，返回包装后的连接和实际生效的套接字选项
+func (this *TcpConn) prepareConn(conn net.Conn) (net.Conn, SocketOptions) {
+	// 应用套接字选项并记录实际生效的值，经过 HTTP 代理的连接可能被 bufferedConn 包装
+	applied := this.sockOpts
+	raw := conn
+	if buffered, ok := conn.(*bufferedConn); ok {
+		raw = buffered.Conn
+	}
+	if tcpConn, ok := raw.(*net.TCPConn); ok {
+		var err error
+		if applied, err = applySocketOptions(tcpConn, this.sockOpts); err != nil {
+			log.Warn("apply socket options", conn.RemoteAddr(), err)
+		}
+		log.Debug("socket options", conn.RemoteAddr(), applied)
+	}
+	// 按设置包装连接
+	if this.wrap != nil {
+		conn = this.wrap(conn)
+	}
+	return conn, applied
+}
+
 // Close 关闭指定会话并释放相关资源。
-// 参数 s 是会话的唯一标识符。
+// 参数 s 是会话实例，关闭原因会记录到日志和统计中并通知处理器。
 func (this *TcpConn) Close(s *Session) {
 	//log.Debug("session close")
+	info := s.CloseInfo()
+	metrics.add("session.close."+info.Reason.String(), 1)
+	switch info.Reason {
+	case CLOSE_NORMAL, CLOSE_EOF:
+		log.Debug("session close", s.fd, info)
+	default:
+		log.Warn("session close", s.fd, info)
+	}
 	// 调用处理器的Close方法，通知会话关闭事件
-	this.handle.Close(s.fd)
+	this.handle.Close(s.fd, info)
 	// 释放会话资源
 	s.Release()
 }
 
-// Write 向指定会话发送数据消息。
+// Write 以普通优先级向指定会话发送数据消息。
 // 参数 s 是会话实例，sID 是会话的唯一标识符，buff 是要发送的数据内容。
-func (this *TcpConn) Write(s *Session, sID uint16, buff []byte) {
+// 返回 ErrClosed、ErrTooLarge 或 ErrQueueFull 表示消息没有进入发送队列。
+func (this *TcpConn) Write(s *Session, sID uint16, buff []byte) error {
+	return this.WritePriority(s, sID, buff, PRIORITY_NORMAL)
+}
+
+// WritePriority 以指定优先级向指定会话发送数据消息，返回值与 Write 相同。
+func (this *TcpConn) WritePriority(s *Session, sID uint16, buff []byte, priority Priority) error {
+	if s == nil {
+		return ErrClosed
+	}
 	// 使用会话实例的doWrite方法发送数据消息
-	s.doWrite(sID, DATA, buff)
+	return s.doWrite(sID, DATA, buff, priority)
 }
@@ -0,0 +1,179 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestAcceptShards 每个地址打开多个 SO_REUSEPORT 监听器，内核在分片之间分配连接，每个分片单独统计
+func TestAcceptShards(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("SO_REUSEPORT accept shards are only supported on Linux")
+	}
+	const shards, conns = 4, 64
+	sh := newTestHandler()
+	srv := NewTcpServer(sh, "127.0.0.1:0")
+	if err := srv.SetAcceptShards(shards); err != nil {
+		t.Fatal(err)
+	}
+	startServer(t, srv, shards)
+
+	addrs := srv.Addrs()
+	addr := addrs[0].String()
+	for _, a := range addrs {
+		if a.String() != addr {
+			t.Fatalf("shards listen on different addresses: %v", addrs)
+		}
+	}
+
+	for i := 0; i < conns; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		sh.waitConnect(t)
+	}
+	total, used := uint64(0), 0
+	metrics := Metrics()
+	for shard := 0; shard < shards; shard++ {
+		n := metrics[fmt.Sprintf("server.accept.%s.%d", addr, shard)]
+		total += n
+		if n > 0 {
+			used++
+		}
+	}
+	if total != conns {
+		t.Fatalf("shards accepted %d connections, want %d", total, conns)
+	}
+	if used < 2 {
+		t.Fatalf("all connections accepted by one shard")
+	}
+}
+
+// listenerHandler 在 Connect 和 Message 中读取会话的监听地址
+type listenerHandler struct {
+	*testHandler
+	sessions  sync.Map // fd -> *Session
+	listeners chan string
+}
+
+func newListenerHandler() *listenerHandler {
+	return &listenerHandler{testHandler: newTestHandler(), listeners: make(chan string, 64)}
+}
+
+func (this *listenerHandler) Connect(fd uint16, s *Session) {
+	this.sessions.Store(fd, s)
+	this.listeners <- s.Listener()
+	this.testHandler.Connect(fd, s)
+}
+
+func (this *listenerHandler) Message(fd, head uint16, body []byte) {
+	if s, ok := this.sessions.Load(fd); ok {
+		this.listeners <- s.(*Session).Listener()
+	}
+	this.testHandler.Message(fd, head, body)
+}
+
+// waitListener 等待处理器读到的下一个监听地址
+func (this *listenerHandler) waitListener(t *testing.T) string {
+	t.Helper()
+	select {
+	case l := <-this.listeners:
+		return l
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting for Listener")
+		return ""
+	}
+}
+
+// TestMultipleListeners 服务器同时监听多个地址，会话记录接受它的监听地址
+func TestMultipleListeners(t *testing.T) {
+	h := newListenerHandler()
+	srv := NewTcpServer(h, "127.0.0.1:0", "127.0.0.1:0")
+	startServer(t, srv, 2)
+	addrs := srv.Addrs()
+	if len(addrs) != 2 || addrs[0].String() == addrs[1].String() {
+		t.Fatalf("listening on %v, want two addresses", addrs)
+	}
+	for _, addr := range addrs {
+		ch := newTestHandler()
+		c := NewTcpClient(ch)
+		cs := dialClient(t, c, ch, addr.String())
+		if l := h.waitListener(t); l != addr.String() {
+			t.Fatalf("Connect saw listener %q, want %q", l, addr)
+		}
+		if err := c.Write(cs, 1, nil); err != nil {
+			t.Fatal(err)
+		}
+		if l := h.waitListener(t); l != addr.String() {
+			t.Fatalf("Message saw listener %q, want %q", l, addr)
+		}
+	}
+}
+
+// TestDualStackListener 没有指定主机的地址同时接受 IPv4 和 IPv6 连接
+func TestDualStackListener(t *testing.T) {
+	if lis, err := net.Listen("tcp6", "[::1]:0"); err != nil {
+		t.Skip("IPv6 is unavailable: ", err)
+	} else {
+		lis.Close()
+	}
+	h := newListenerHandler()
+	srv := NewTcpServer(h, ":0", "[::1]:0")
+	startServer(t, srv, 2)
+	addrs := srv.Addrs()
+	_, port, _ := net.SplitHostPort(addrs[0].String())
+	for _, target := range []struct{ dial, listener string }{
+		{net.JoinHostPort("127.0.0.1", port), addrs[0].String()},
+		{net.JoinHostPort("::1", port), addrs[0].String()},
+		{addrs[1].String(), addrs[1].String()},
+	} {
+		conn, err := net.Dial("tcp", target.dial)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if l := h.waitListener(t); l != target.listener {
+			t.Fatalf("dial %s: Connect saw listener %q, want %q", target.dial, l, target.listener)
+		}
+	}
+}
+
+// TestListenerBeforeStart 监听地址在会话对处理器可见之前设置，Connect 和其他协程中的消息处理都读到接受连接的地址
+func TestListenerBeforeStart(t *testing.T) {
+	setups := map[string]func(*TcpServer){"goroutine": nil}
+	if supportEpoll {
+		setups["epoll"] = func(srv *TcpServer) { srv.SetEventLoops(1) }
+	}
+	for name, setup := range setups {
+		t.Run(name, func(t *testing.T) {
+			h := newListenerHandler()
+			srv := NewTcpServer(h, "127.0.0.1:0")
+			if setup != nil {
+				setup(srv)
+			}
+			startServer(t, srv, 1)
+			addr := srv.Addrs()[0].String()
+
+			// 连接建立后立即发送消息，消息处理可能和接受连接的协程并发
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if _, err := conn.Write(packFrame(1, DATA, []byte("first"))); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 2; i++ {
+				if l := h.waitListener(t); l != addr {
+					t.Fatalf("handler saw listener %q, want %q", l, addr)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,247 @@
+package network
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// 传输方式的错误
+var (
+	ErrUnknownTransport = errors.New("network: unknown transport")               // 地址的 scheme 没有对应的传输方式
+	ErrNoCertificate    = errors.New("network: tls listener has no certificate") // TLS 传输方式的 config 没有设置服务器证书
+)
+
+// Listener 在地址上监听连接，接受的连接由服务器创建会话
+type Listener interface {
+	Listen(addr string) (net.Listener, error)
+}
+
+// Dialer 建立到地址的连接，建立的连接由客户端创建会话
+type Dialer interface {
+	Dial(ctx context.Context, addr string) (net.Conn, error)
+}
+
+// Transport 一种传输方式，服务器和客户端的地址按 "scheme://地址" 选择传输方式，
+// 没有 scheme 或 scheme 为 "tcp" 时使用 TCP。
+// 会话的协议、加密、认证等功能与传输方式无关；只有 TCP 支持套接字选项、epoll 模式、分片监听和平滑重启的交接。
+type Transport interface {
+	Listener
+	Dialer
+}
+
+// transports 全局注册的传输方式，以 scheme 作为键
+var (
+	transportLock sync.RWMutex
+	transports    = map[string]Transport{
+		"tcp":  tcpTransport{},
+		"tls":  TLSTransport(nil),
+		"unix": unixTransport{},
+		"mem":  MemTransport(),
+		"ws":   WebSocketTransport(),
+	}
+)
+
+// RegisterTransport 注册 scheme 对应的传输方式，替换已有的注册，影响之后启动的服务器和建立的连接。
+// 默认注册了 "tcp"、"tls"（没有证书，只能用于连接验证系统根证书的服务器，监听时返回 ErrNoCertificate）、"unix"、"mem" 和 "ws"。
+func RegisterTransport(scheme string, transport Transport) {
+	transportLock.Lock()
+	defer transportLock.Unlock()
+	transports[scheme] = transport
+}
+
+// SetTransport 为 scheme 设置只在当前服务器或客户端使用的传输方式，优先于全局注册，
+// 例如为 "tls" 设置带证书的 TLSTransport。需要在 Start 或 Dial 之前调用，transport 为 nil 时取消设置。
+func (this *TcpConn) SetTransport(scheme string, transport Transport) {
+	if transport == nil {
+		delete(this.transports, scheme)
+		return
+	}
+	if this.transports == nil {
+		this.transports = make(map[string]Transport)
+	}
+	this.transports[scheme] = transport
+}
+
+// transport 返回 scheme 对应的传输方式
+func (this *TcpConn) transport(scheme string) (Transport, error) {
+	if t, ok := this.transports[scheme]; ok {
+		return t, nil
+	}
+	transportLock.RLock()
+	defer transportLock.RUnlock()
+	if t, ok := transports[scheme]; ok {
+		return t, nil
+	}
+	return nil, fmt.Errorf("%w: %q", ErrUnknownTransport, scheme)
+}
+
+// splitScheme 把 "scheme://地址" 拆分为 scheme 和地址，没有 scheme 时为 "tcp"
+func splitScheme(raw string) (string, string) {
+	if i := strings.Index(raw, "://"); i > 0 {
+		return raw[:i], raw[i+3:]
+	}
+	return "tcp", raw
+}
+
+// tcpTransport TCP 传输方式
+type tcpTransport struct{}
+
+// Listen 监听 TCP 地址
+func (tcpTransport) Listen(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
+
+// Dial 建立 TCP 连接
+func (tcpTransport) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "tcp", addr)
+}
+
+// unixTransport unix 域套接字传输方式，地址为套接字文件的路径
+type unixTransport struct{}
+
+// Listen 监听 unix 域套接字
+func (unixTransport) Listen(addr string) (net.Listener, error) {
+	return net.Listen("unix", addr)
+}
+
+// Dial 连接 unix 域套接字
+func (unixTransport) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "unix", addr)
+}
+
+// tlsTransport TLS 传输方式
+type tlsTransport struct {
+	config *tls.Config
+}
+
+// TLSTransport 返回使用 config 的 TLS 传输方式，服务器的 config 需要设置证书，否则监听时返回 ErrNoCertificate。
+// 客户端的 config 没有设置 ServerName 时使用地址中的主机名。
+func TLSTransport(config *tls.Config) Transport {
+	return &tlsTransport{config: config}
+}
+
+// Listen 在 TCP 地址上监听 TLS 连接，config 没有证书时直接失败，而不是让每个连接的 TLS 握手失败
+func (this *tlsTransport) Listen(addr string) (net.Listener, error) {
+	config := this.config
+	if config == nil || len(config.Certificates) == 0 && config.GetCertificate == nil && config.GetConfigForClient == nil {
+		return nil, ErrNoCertificate
+	}
+	return tls.Listen("tcp", addr, config)
+}
+
+// Dial 建立 TLS 连接并完成 TLS 握手
+func (this *tlsTransport) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	dialer := tls.Dialer{Config: this.config}
+	return dialer.DialContext(ctx, "tcp", addr)
+}
+
+// memTransport 进程内的传输方式，地址为任意名称，连接为 net.Pipe，用于测试和同进程内的服务
+type memTransport struct {
+	lock      sync.Mutex
+	listeners map[string]*memListener
+}
+
+// MemTransport 返回一个新的进程内传输方式，只有同一个实例上的监听和连接可以互通
+func MemTransport() Transport {
+	return &memTransport{listeners: make(map[string]*memListener)}
+}
+
+// Listen 以 addr 为名称监听，同名的监听器关闭前不能重复监听
+func (this *memTransport) Listen(addr string) (net.Listener, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if _, ok := this.listeners[addr]; ok {
+		return nil, fmt.Errorf("network: mem address %q in use", addr)
+	}
+	l := &memListener{transport: this, addr: memAddr(addr), conns: make(chan net.Conn), done: make(chan struct{})}
+	this.listeners[addr] = l
+	return l, nil
+}
+
+// Dial 连接名称为 addr 的监听器
+func (this *memTransport) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	this.lock.Lock()
+	l := this.listeners[addr]
+	this.lock.Unlock()
+	if l == nil {
+		return nil, fmt.Errorf("network: mem address %q: connection refused", addr)
+	}
+	server, client := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.done:
+		return nil, fmt.Errorf("network: mem address %q: connection refused", addr)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// memListener 进程内的监听器
+type memListener struct {
+	transport *memTransport
+	addr      memAddr
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Accept 等待下一个连接
+func (this *memListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-this.conns:
+		return conn, nil
+	case <-this.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close 关闭监听器并释放名称
+func (this *memListener) Close() error {
+	this.closeOnce.Do(func() {
+		close(this.done)
+		this.transport.lock.Lock()
+		delete(this.transport.listeners, string(this.addr))
+		this.transport.lock.Unlock()
+	})
+	return nil
+}
+
+// Addr 返回监听的名称
+func (this *memListener) Addr() net.Addr {
+	return this.addr
+}
+
+// memAddr 进程内传输方式的地址
+type memAddr string
+
+// Network 返回 "mem"
+func (this memAddr) Network() string {
+	return "mem"
+}
+
+// String 返回地址的名称
+func (this memAddr) String() string {
+	return string(this)
+}
+
+// dialTransport 使用 scheme 对应的传输方式建立连接，连接受 ctx 和拨号超时时间共同限制，不经过代理服务器
+func (this *TcpClient) dialTransport(ctx context.Context, scheme, addr string) (net.Conn, error) {
+	transport, err := this.transport(scheme)
+	if err != nil {
+		return nil, err
+	}
+	if this.dialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, this.dialTimeout)
+		defer cancel()
+	}
+	return transport.Dial(ctx, addr)
+}
@@ -0,0 +1,72 @@
+package network
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestTransportRoundTrip 通过各种传输方式建立会话，双向收发消息
+func TestTransportRoundTrip(t *testing.T) {
+	cases := []struct {
+		name   string
+		listen func(t *testing.T) string // 服务器监听的地址
+		dial   func(srv *TcpServer) string
+	}{
+		{"mem", func(t *testing.T) string { return memAddress(t) },
+			func(srv *TcpServer) string { return "mem://" + srv.Addrs()[0].String() }},
+		{"unix", func(t *testing.T) string { return "unix://" + filepath.Join(t.TempDir(), "game.sock") },
+			func(srv *TcpServer) string { return "unix://" + srv.Addrs()[0].String() }},
+		{"ws", func(t *testing.T) string { return "ws://127.0.0.1:0/game" },
+			func(srv *TcpServer) string { return "ws://" + srv.Addrs()[0].String() + "/game" }},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			sh := newTestHandler()
+			srv := NewTcpServer(sh, c.listen(t))
+			startServer(t, srv, 1)
+
+			ch := newTestHandler()
+			client := NewTcpClient(ch)
+			cs := dialClient(t, client, ch, c.dial(srv))
+			ss := sh.waitConnect(t)
+
+			if err := client.Write(cs, 1, []byte("ping")); err != nil {
+				t.Fatal(err)
+			}
+			if m := sh.waitMessage(t); m.head != 1 || string(m.body) != "ping" {
+				t.Fatalf("server got %d %q", m.head, m.body)
+			}
+			big := make([]byte, maxBodySize)
+			if err := srv.Write(ss, 2, big); err != nil {
+				t.Fatal(err)
+			}
+			if m := ch.waitMessage(t); m.head != 2 || len(m.body) != len(big) {
+				t.Fatalf("client got head %d with %d bytes", m.head, len(m.body))
+			}
+		})
+	}
+}
+
+// TestTLSWithoutCertificate 默认的 "tls" 传输方式没有证书，服务器启动时失败而不是接受无法握手的连接
+func TestTLSWithoutCertificate(t *testing.T) {
+	if _, err := TLSTransport(nil).Listen("127.0.0.1:0"); !errors.Is(err, ErrNoCertificate) {
+		t.Fatalf("Listen = %v, want ErrNoCertificate", err)
+	}
+	srv := NewTcpServer(newTestHandler(), "tls://127.0.0.1:0")
+	done := make(chan struct{})
+	go func() {
+		srv.Start()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(testTimeout):
+		srv.StopAccept()
+		t.Fatal("Start did not fail")
+	}
+	if addrs := srv.Addrs(); len(addrs) != 0 {
+		t.Fatalf("listening on %v", addrs)
+	}
+}
@@ -0,0 +1,317 @@
+package network
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrWebSocket 表示 WebSocket 握手失败或收到不合法的帧
+var ErrWebSocket = errors.New("network: websocket error")
+
+// WebSocket 握手中计算 Sec-WebSocket-Accept 使用的 GUID
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket 帧的操作码
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+// wsTransport WebSocket 传输方式，地址为 "host:port/path"，路径省略时为 "/"。
+// 每个消息包作为二进制帧发送，接收时忽略帧的边界，所以浏览器等客户端可以按任意方式分帧。
+type wsTransport struct{}
+
+// WebSocketTransport 返回不加密的 WebSocket 传输方式
+func WebSocketTransport() Transport {
+	return wsTransport{}
+}
+
+// splitWsAddr 把 "host:port/path" 拆分为主机和路径
+func splitWsAddr(addr string) (string, string) {
+	if i := strings.Index(addr, "/"); i >= 0 {
+		return addr[:i], addr[i:]
+	}
+	return addr, "/"
+}
+
+// Listen 在主机地址上启动 HTTP 服务，升级到路径上的请求成为连接
+func (wsTransport) Listen(addr string) (net.Listener, error) {
+	host, path := splitWsAddr(addr)
+	lis, err := net.Listen("tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	l := &wsListener{Listener: lis, conns: make(chan net.Conn), done: make(chan struct{})}
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, l.upgrade)
+	l.server = &http.Server{Handler: mux}
+	go l.server.Serve(lis)
+	return l, nil
+}
+
+// Dial 建立 TCP 连接并完成 WebSocket 握手
+func (wsTransport) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	host, path := splitWsAddr(addr)
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	key := base64.StdEncoding.EncodeToString(nonce)
+	req := "GET " + path + " HTTP/1.1\r\nHost: " + host +
+		"\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: " + key +
+		"\r\nSec-WebSocket-Version: 13\r\n\r\n"
+	if _, err := io.WriteString(conn, req); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodGet})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != wsAccept(key) {
+		conn.Close()
+		return nil, fmt.Errorf("%w: handshake: %s", ErrWebSocket, resp.Status)
+	}
+	return &wsConn{Conn: conn, reader: reader, client: true}, nil
+}
+
+// wsAccept 计算握手响应中的 Sec-WebSocket-Accept
+func wsAccept(key string) string {
+	sum := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// wsListener 接受 WebSocket 连接的监听器
+type wsListener struct {
+	net.Listener
+	server    *http.Server
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// upgrade 完成服务端的 WebSocket 握手并把连接交给 Accept
+func (this *wsListener) upgrade(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || key == "" ||
+		!strings.EqualFold(r.Header.Get("Upgrade"), "websocket") ||
+		r.Header.Get("Sec-WebSocket-Version") != "13" {
+		http.Error(w, "websocket upgrade required", http.StatusBadRequest)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket upgrade unsupported", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	resp := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: " +
+		wsAccept(key) + "\r\n\r\n"
+	if _, err := io.WriteString(conn, resp); err != nil {
+		conn.Close()
+		return
+	}
+	select {
+	case this.conns <- &wsConn{Conn: conn, reader: rw.Reader}:
+	case <-this.done:
+		conn.Close()
+	}
+}
+
+// Accept 等待下一个完成握手的连接
+func (this *wsListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-this.conns:
+		return conn, nil
+	case <-this.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close 停止 HTTP 服务，已建立的连接不受影响
+func (this *wsListener) Close() error {
+	var err error
+	this.closeOnce.Do(func() {
+		close(this.done)
+		err = this.server.Close()
+	})
+	return err
+}
+
+// wsConn WebSocket 连接，写入的数据作为一个二进制帧发送，读取时返回数据帧的负载
+type wsConn struct {
+	net.Conn
+	reader    *bufio.Reader
+	client    bool       // 客户端发送的帧需要掩码
+	lock      sync.Mutex // 保护写入，读取方回复控制帧时也会写入
+	remaining uint64     // 当前数据帧未读取的负载长度
+	mask      [4]byte
+	masked    bool
+	offset    int // 当前帧已读取的负载长度，用于掩码
+	closed    bool
+}
+
+// Read 读取数据帧的负载，自动回复 ping 和 close
+func (this *wsConn) Read(b []byte) (int, error) {
+	for this.remaining == 0 {
+		if this.closed {
+			return 0, io.EOF
+		}
+		if err := this.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+	if uint64(len(b)) > this.remaining {
+		b = b[:this.remaining]
+	}
+	n, err := this.reader.Read(b)
+	if this.masked {
+		for i := 0; i < n; i++ {
+			b[i] ^= this.mask[(this.offset+i)%4]
+		}
+	}
+	this.offset += n
+	this.remaining -= uint64(n)
+	return n, err
+}
+
+// nextFrame 读取下一个帧的帧头，处理控制帧，数据帧的负载留给 Read
+func (this *wsConn) nextFrame() error {
+	var head [2]byte
+	if _, err := io.ReadFull(this.reader, head[:]); err != nil {
+		return err
+	}
+	opcode := head[0] & 0x0f
+	size := uint64(head[1] & 0x7f)
+	switch size {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(this.reader, ext[:]); err != nil {
+			return err
+		}
+		size = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(this.reader, ext[:]); err != nil {
+			return err
+		}
+		size = binary.BigEndian.Uint64(ext[:])
+	}
+	this.masked = head[1]&0x80 != 0
+	if this.masked {
+		if _, err := io.ReadFull(this.reader, this.mask[:]); err != nil {
+			return err
+		}
+	}
+	this.offset = 0
+
+	switch opcode {
+	case wsContinuation, wsText, wsBinary:
+		this.remaining = size
+		return nil
+	case wsClose, wsPing, wsPong:
+		if size > 125 {
+			return fmt.Errorf("%w: control frame too large", ErrWebSocket)
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(this.reader, payload); err != nil {
+			return err
+		}
+		if this.masked {
+			for i := range payload {
+				payload[i] ^= this.mask[i%4]
+			}
+		}
+		switch opcode {
+		case wsPing:
+			return this.writeFrame(wsPong, payload)
+		case wsClose:
+			this.closed = true
+			this.writeFrame(wsClose, payload)
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: unknown opcode %d", ErrWebSocket, opcode)
+}
+
+// Write 把 b 作为一个二进制帧发送
+func (this *wsConn) Write(b []byte) (int, error) {
+	if err := this.writeFrame(wsBinary, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// writeFrame 发送一个完整的帧，客户端按协议使用随机掩码
+func (this *wsConn) writeFrame(opcode byte, payload []byte) error {
+	frame := make([]byte, 0, len(payload)+14)
+	frame = append(frame, 0x80|opcode)
+	var maskBit byte
+	if this.client {
+		maskBit = 0x80
+	}
+	switch size := len(payload); {
+	case size < 126:
+		frame = append(frame, maskBit|byte(size))
+	case size <= 0xffff:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(size))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(size))
+	}
+	if this.client {
+		var mask [4]byte
+		rand.Read(mask[:])
+		frame = append(frame, mask[:]...)
+		start := len(frame)
+		frame = append(frame, payload...)
+		for i := range payload {
+			frame[start+i] ^= mask[i%4]
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	_, err := this.Conn.Write(frame)
+	return err
+}
+
+// Close 发送 close 帧后关闭连接
+func (this *wsConn) Close() error {
+	this.writeFrame(wsClose, nil)
+	return this.Conn.Close()
+}
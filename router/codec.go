@@ -0,0 +1,27 @@
+package router
+
+import (
+	"encoding/json"
+)
+
+// Codec 消息体的编解码器，路由用它把消息体解码为注册的类型，以及把发送的消息编码为消息体。
+// 实现需要可以被多个会话的读协程并发调用。
+// Unmarshal 的 data 引用会话池化的读缓冲区，只在调用期间有效，解码结果不能引用它，需要保留时先拷贝。
+// 消息体为空时路由不调用 Unmarshal，处理函数收到零值消息。
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// JSONCodec 使用 encoding/json 编解码消息体，是路由的默认编解码器
+type JSONCodec struct{}
+
+// Marshal 把消息编码为 JSON
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal 把 JSON 消息体解码到 v
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
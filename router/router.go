@@ -0,0 +1,377 @@
+package router
+
+import (
+	"github.com/lizhen1412/eegos/log"
+	"github.com/lizhen1412/eegos/network"
+
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// 路由的错误
+var (
+	ErrUnknownMessage = errors.New("router: unknown message id")
+	ErrDuplicateID    = errors.New("router: message id already registered")
+	ErrDuplicateType  = errors.New("router: message type already registered")
+	ErrBadHandler     = errors.New("router: bad handler signature")
+	ErrBadMessage     = errors.New("router: message type must be a struct")
+	ErrUnregistered   = errors.New("router: message type not registered")
+	ErrNoWriter       = errors.New("router: writer not set")
+	ErrNoSession      = errors.New("router: session not found")
+)
+
+// RejectCode 表示消息被拒绝的原因
+type RejectCode uint8
+
+// 消息被拒绝的原因
+const (
+	REJECT_UNKNOWN RejectCode = iota + 1 // 消息ID未注册
+	REJECT_DECODE                        // 消息体解码失败
+	REJECT_HANDLER                       // 处理函数返回错误或发生 panic
+)
+
+// Reject 描述一条被拒绝的消息，传给拒绝处理函数；
+// 通过 SetRejectMessage 设置了消息ID时，也会编码后以该消息ID发给对端
+type Reject struct {
+	MsgID uint16     `json:"msg_id"` // 被拒绝的消息ID
+	Code  RejectCode `json:"code"`   // 拒绝的原因
+	Error string     `json:"error"`  // 错误描述
+}
+
+// Writer 路由发送消息使用的连接，*network.TcpServer 和 *network.TcpClient 都满足该接口
+type Writer interface {
+	WritePriority(s *network.Session, sID uint16, buff []byte, priority network.Priority) error
+}
+
+var (
+	contextType = reflect.TypeOf((*Context)(nil))
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// route 一个消息ID的处理函数
+type route struct {
+	fn    reflect.Value // 处理函数
+	typ   reflect.Type  // 消息的结构体类型
+	reply bool          // 处理函数是否返回响应消息
+}
+
+// Context 一条消息的处理上下文，只在处理函数执行期间有效
+type Context struct {
+	router  *Router
+	session *network.Session
+	fd      uint16
+	msgID   uint16
+}
+
+// Session 返回消息所属的会话
+func (this *Context) Session() *network.Session {
+	return this.session
+}
+
+// Fd 返回消息所属会话的 fd
+func (this *Context) Fd() uint16 {
+	return this.fd
+}
+
+// MsgID 返回消息ID
+func (this *Context) MsgID() uint16 {
+	return this.msgID
+}
+
+// Reply 向消息所属的会话发送一条已注册类型的消息
+func (this *Context) Reply(msg interface{}) error {
+	return this.router.Send(this.session, msg)
+}
+
+// Router 按消息头中的消息ID把数据消息解码为注册的结构体，并调用对应的类型化处理函数。
+// Router 实现了 network.Handler，用它创建 TcpServer 或 TcpClient 后需要调用 SetWriter 设置发送消息的连接：
+//
+//	r := router.New(router.JSONCodec{})
+//	server := network.NewTcpServer(r, ":9000")
+//	r.SetWriter(server)
+//
+// 未注册的消息ID、解码失败和处理函数的错误都通过同一个拒绝流程处理，见 SetRejectHandler。
+type Router struct {
+	codec    Codec                       // 消息体编解码器
+	writer   Writer                      // 发送消息使用的连接
+	lock     sync.RWMutex                // 保护以下字段
+	routes   map[uint16]*route           // 消息ID到处理函数
+	ids      map[reflect.Type]uint16     // 消息类型到消息ID，用于发送
+	sessions map[uint16]*network.Session // 会话映射，以 fd 作为键
+
+	onConnect func(*network.Session)          // 会话建立的回调
+	onClose   func(uint16, network.CloseInfo) // 会话关闭的回调
+	onReject  func(*Context, Reject)          // 消息被拒绝的回调
+	rejectID  uint16                          // 拒绝通知的消息ID
+	notify    bool                            // 是否向对端发送拒绝通知
+	kick      bool                            // 拒绝消息后是否踢掉会话
+}
+
+// New 创建一个路由，codec 为 nil 时使用 JSONCodec
+func New(codec Codec) *Router {
+	if codec == nil {
+		codec = JSONCodec{}
+	}
+	return &Router{
+		codec:    codec,
+		routes:   make(map[uint16]*route),
+		ids:      make(map[reflect.Type]uint16),
+		sessions: make(map[uint16]*network.Session),
+	}
+}
+
+// SetWriter 设置发送消息使用的连接，需要在启动连接之前调用
+func (this *Router) SetWriter(w Writer) {
+	this.writer = w
+}
+
+// SetConnectHandler 设置会话建立时的回调
+func (this *Router) SetConnectHandler(fn func(s *network.Session)) {
+	this.onConnect = fn
+}
+
+// SetCloseHandler 设置会话关闭时的回调
+func (this *Router) SetCloseHandler(fn func(fd uint16, info network.CloseInfo)) {
+	this.onClose = fn
+}
+
+// SetRejectHandler 设置消息被拒绝时的回调，未设置时记录一条警告日志
+func (this *Router) SetRejectHandler(fn func(ctx *Context, reject Reject)) {
+	this.onReject = fn
+}
+
+// SetRejectMessage 设置拒绝通知的消息ID，设置后被拒绝的消息会以该消息ID向对端回复编码后的 Reject
+func (this *Router) SetRejectMessage(id uint16) error {
+	if err := this.RegisterMessage(id, Reject{}); err != nil {
+		return err
+	}
+	this.rejectID = id
+	this.notify = true
+	return nil
+}
+
+// SetKickOnReject 设置拒绝消息后是否踢掉会话，关闭原因为 CLOSE_KICK
+func (this *Router) SetKickOnReject(kick bool) {
+	this.kick = kick
+}
+
+// Register 注册消息ID的处理函数，处理函数可以是以下形式之一，T 为结构体类型：
+//
+//	func(*Context, *T)
+//	func(*Context, *T) error
+//	func(*Context, *T) (*R, error)
+//
+// 返回非 nil 的 *R 时作为响应发给对端，R 必须通过 Register 或 RegisterMessage 注册过；
+// 返回的错误按 REJECT_HANDLER 拒绝。T 同时注册为该消息ID的类型，可以用于发送。
+func (this *Router) Register(id uint16, fn interface{}) error {
+	v := reflect.ValueOf(fn)
+	t := v.Type()
+	if t.Kind() != reflect.Func || t.NumIn() != 2 || t.In(0) != contextType || t.In(1).Kind() != reflect.Ptr {
+		return ErrBadHandler
+	}
+	r := &route{fn: v, typ: t.In(1).Elem()}
+	switch t.NumOut() {
+	case 0:
+	case 1:
+		if t.Out(0) != errorType {
+			return ErrBadHandler
+		}
+	case 2:
+		if t.Out(0).Kind() != reflect.Ptr || t.Out(1) != errorType {
+			return ErrBadHandler
+		}
+		r.reply = true
+	default:
+		return ErrBadHandler
+	}
+	if r.typ.Kind() != reflect.Struct {
+		return ErrBadMessage
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if _, ok := this.routes[id]; ok {
+		return ErrDuplicateID
+	}
+	if err := this.addType(id, r.typ); err != nil {
+		return err
+	}
+	this.routes[id] = r
+	return nil
+}
+
+// RegisterMessage 注册只用于发送的消息类型，proto 为该类型的值或指针，例如推送和响应消息
+func (this *Router) RegisterMessage(id uint16, proto interface{}) error {
+	t := messageType(proto)
+	if t == nil || t.Kind() != reflect.Struct {
+		return ErrBadMessage
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.addType(id, t)
+}
+
+// addType 记录消息ID和类型的对应关系，调用方持有锁
+func (this *Router) addType(id uint16, t reflect.Type) error {
+	for typ, tid := range this.ids {
+		if tid == id && typ != t {
+			return ErrDuplicateID
+		}
+	}
+	if tid, ok := this.ids[t]; ok && tid != id {
+		return ErrDuplicateType
+	}
+	this.ids[t] = id
+	return nil
+}
+
+// messageType 返回消息的结构体类型，指针取其指向的类型
+func messageType(msg interface{}) reflect.Type {
+	t := reflect.TypeOf(msg)
+	if t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
+
+// Encode 按消息类型查找消息ID，并编码消息体
+func (this *Router) Encode(msg interface{}) (uint16, []byte, error) {
+	this.lock.RLock()
+	id, ok := this.ids[messageType(msg)]
+	this.lock.RUnlock()
+	if !ok {
+		return 0, nil, ErrUnregistered
+	}
+	body, err := this.codec.Marshal(msg)
+	if err != nil {
+		return 0, nil, err
+	}
+	return id, body, nil
+}
+
+// Send 向会话发送一条已注册类型的消息
+func (this *Router) Send(s *network.Session, msg interface{}) error {
+	return this.SendPriority(s, msg, network.PRIORITY_NORMAL)
+}
+
+// SendPriority 以指定优先级向会话发送一条已注册类型的消息
+func (this *Router) SendPriority(s *network.Session, msg interface{}, priority network.Priority) error {
+	if this.writer == nil {
+		return ErrNoWriter
+	}
+	id, body, err := this.Encode(msg)
+	if err != nil {
+		return err
+	}
+	return this.writer.WritePriority(s, id, body, priority)
+}
+
+// Push 向 fd 对应的会话推送一条已注册类型的消息
+func (this *Router) Push(fd uint16, msg interface{}) error {
+	this.lock.RLock()
+	s := this.sessions[fd]
+	this.lock.RUnlock()
+	if s == nil {
+		return ErrNoSession
+	}
+	return this.Send(s, msg)
+}
+
+// Connect 处理会话建立
+func (this *Router) Connect(fd uint16, s *network.Session) {
+	this.lock.Lock()
+	this.sessions[fd] = s
+	this.lock.Unlock()
+	if this.onConnect != nil {
+		this.onConnect(s)
+	}
+}
+
+// Message 按消息ID解码消息体并调用处理函数
+func (this *Router) Message(fd uint16, msgID uint16, body []byte) {
+	this.lock.RLock()
+	s := this.sessions[fd]
+	r := this.routes[msgID]
+	this.lock.RUnlock()
+
+	ctx := &Context{router: this, session: s, fd: fd, msgID: msgID}
+	if r == nil {
+		this.reject(ctx, REJECT_UNKNOWN, ErrUnknownMessage)
+		return
+	}
+
+	// 空的消息体表示零值消息，JSON 等编解码器无法解码空数据
+	msg := reflect.New(r.typ)
+	if len(body) > 0 {
+		if err := this.codec.Unmarshal(body, msg.Interface()); err != nil {
+			this.reject(ctx, REJECT_DECODE, err)
+			return
+		}
+	}
+
+	if err := this.call(ctx, r, msg); err != nil {
+		this.reject(ctx, REJECT_HANDLER, err)
+	}
+}
+
+// call 调用处理函数，发送返回的响应，处理函数的 panic 转为错误
+func (this *Router) call(ctx *Context, r *route, msg reflect.Value) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("router: handler panic: %v", e)
+		}
+	}()
+
+	out := r.fn.Call([]reflect.Value{reflect.ValueOf(ctx), msg})
+	if len(out) == 0 {
+		return nil
+	}
+	if e := out[len(out)-1]; !e.IsNil() {
+		return e.Interface().(error)
+	}
+	if r.reply && !out[0].IsNil() {
+		if err := ctx.Reply(out[0].Interface()); err != nil {
+			log.Error("router reply", ctx.fd, ctx.msgID, err)
+		}
+	}
+	return nil
+}
+
+// reject 统一处理被拒绝的消息：回调或记录日志，按设置通知对端并踢掉会话
+func (this *Router) reject(ctx *Context, code RejectCode, err error) {
+	reject := Reject{MsgID: ctx.msgID, Code: code, Error: err.Error()}
+	if this.onReject != nil {
+		this.onReject(ctx, reject)
+	} else {
+		log.Warn("router reject", ctx.fd, ctx.msgID, code, err)
+	}
+
+	if ctx.session == nil {
+		return
+	}
+	if this.notify && this.writer != nil {
+		if body, err := this.codec.Marshal(&reject); err == nil {
+			this.writer.WritePriority(ctx.session, this.rejectID, body, network.PRIORITY_HIGH)
+		}
+	}
+	if this.kick {
+		ctx.session.Kick(err)
+	}
+}
+
+// Heartbeat 处理心跳消息
+func (this *Router) Heartbeat(fd uint16, sessionID uint16) {
+}
+
+// Close 处理会话关闭
+func (this *Router) Close(fd uint16, info network.CloseInfo) {
+	this.lock.Lock()
+	delete(this.sessions, fd)
+	this.lock.Unlock()
+	if this.onClose != nil {
+		this.onClose(fd, info)
+	}
+}
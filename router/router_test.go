@@ -0,0 +1,110 @@
+package router
+
+import (
+	"github.com/lizhen1412/eegos/network"
+
+	"errors"
+	"testing"
+	"time"
+)
+
+type Ping struct {
+	Seq int `json:"seq"`
+}
+
+type Pong struct {
+	Seq int `json:"seq"`
+}
+
+// newTestRouter 创建一个注册了 Ping 的路由，处理函数收到的消息和拒绝都转发到通道
+func newTestRouter(t *testing.T) (*Router, chan Ping, chan Reject) {
+	t.Helper()
+	pings := make(chan Ping, 8)
+	rejects := make(chan Reject, 8)
+	r := New(nil)
+	err := r.Register(1, func(ctx *Context, p *Ping) (*Pong, error) {
+		if p.Seq < 0 {
+			return nil, errors.New("negative seq")
+		}
+		pings <- *p
+		return &Pong{Seq: p.Seq + 1}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetRejectHandler(func(ctx *Context, reject Reject) { rejects <- reject })
+	return r, pings, rejects
+}
+
+func TestMessageEmptyBody(t *testing.T) {
+	r, pings, rejects := newTestRouter(t)
+	r.Message(1, 1, nil)
+	select {
+	case p := <-pings:
+		if p.Seq != 0 {
+			t.Fatalf("empty body decoded as %+v", p)
+		}
+	case reject := <-rejects:
+		t.Fatalf("empty body rejected: %+v", reject)
+	}
+}
+
+func TestMessageReject(t *testing.T) {
+	r, _, rejects := newTestRouter(t)
+	cases := []struct {
+		msgID uint16
+		body  string
+		code  RejectCode
+	}{
+		{2, `{}`, REJECT_UNKNOWN},
+		{1, `{"seq":`, REJECT_DECODE},
+		{1, `{"seq":-1}`, REJECT_HANDLER},
+	}
+	for _, c := range cases {
+		r.Message(1, c.msgID, []byte(c.body))
+		if reject := <-rejects; reject.Code != c.code || reject.MsgID != c.msgID {
+			t.Errorf("Message(%d, %s) rejected as %+v, want code %d", c.msgID, c.body, reject, c.code)
+		}
+	}
+}
+
+// TestReply 通过进程内连接发送请求，处理函数返回的响应发回客户端
+func TestReply(t *testing.T) {
+	r, _, _ := newTestRouter(t)
+	if err := r.RegisterMessage(2, Pong{}); err != nil {
+		t.Fatal(err)
+	}
+	server := network.NewTcpServer(r, "mem://router-test")
+	r.SetWriter(server)
+	go server.Start()
+	t.Cleanup(server.StopAccept)
+
+	replies := make(chan Pong, 1)
+	cr := New(nil)
+	cr.Register(2, func(ctx *Context, p *Pong) { replies <- *p })
+	cr.RegisterMessage(1, Ping{})
+	sessions := make(chan *network.Session, 1)
+	cr.SetConnectHandler(func(s *network.Session) { sessions <- s })
+	client := network.NewTcpClient(cr)
+	cr.SetWriter(client)
+	deadline := time.Now().Add(5 * time.Second)
+	for client.Dial("mem://router-test") != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("server did not start")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Cleanup(client.Close)
+
+	if err := cr.Send(<-sessions, &Ping{Seq: 41}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case p := <-replies:
+		if p.Seq != 42 {
+			t.Fatalf("reply = %+v, want seq 42", p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("reply not delivered")
+	}
+}
@@ -4,11 +4,24 @@ import (
 	"github.com/lizhen1412/eegos/log"
 	"github.com/lizhen1412/eegos/network"
 
+	"context"
 	"encoding/json"
+	"errors"
+	"net"
 	"sync"
 	"time"
 )
 
+// 远程调用相关的错误
+var (
+	ErrTimeout    = errors.New("rpc: call timed out")           // 等待响应超时
+	ErrNoResponse = errors.New("rpc: connection closed")        // 等待期间连接关闭
+	ErrMarshal    = errors.New("rpc: cannot marshal arguments") // 参数无法编码
+)
+
+// 默认的调用超时时间
+const DefaultCallTimeout = 3 * time.Second
+
 // Client 表示与远程服务进行通信的客户端
 type Client struct {
 	callRet   map[uint16](chan []interface{}) // 存储调用结果的映射
@@ -33,10 +46,61 @@ func NewClient() *Client {
 	return newClient
 }
 
-// Dial 连接到远程服务器
-func (this *Client) Dial(addr string) {
+// Dial 连接到远程服务器，失败时返回错误。
+// addr 可以是 "scheme://地址" 形式的其他传输方式，例如 "ws://127.0.0.1:8081/rpc"，参见 network.Transport。
+func (this *Client) Dial(addr string) error {
 	// 调用 TCP 客户端的 Dial 方法来与指定地址建立连接
-	this.tcpClient.Dial(addr)
+	return this.tcpClient.Dial(addr)
+}
+
+// DialContext 在 ctx 的控制下连接到远程服务器，失败时返回错误
+func (this *Client) DialContext(ctx context.Context, addr string) error {
+	return this.tcpClient.DialContext(ctx, addr)
+}
+
+// DialEndpoints 按故障转移设置连接服务器，参见 network.TcpClient.DialEndpoints
+func (this *Client) DialEndpoints(ctx context.Context, failover network.Failover) error {
+	return this.tcpClient.DialEndpoints(ctx, failover)
+}
+
+// Endpoint 返回当前连接的服务器地址
+func (this *Client) Endpoint() string {
+	return this.tcpClient.Endpoint()
+}
+
+// Clock 返回与服务器的时钟同步估计
+func (this *Client) Clock() network.ClockSync {
+	return this.tcpClient.Clock()
+}
+
+// ServerTime 按时钟同步估计返回服务器当前的时间
+func (this *Client) ServerTime() time.Time {
+	return this.tcpClient.ServerTime()
+}
+
+// SetProxy 设置通过代理服务器连接，在 Dial 之前调用，参见 network.TcpClient.SetProxy
+func (this *Client) SetProxy(rawURL string) error {
+	return this.tcpClient.SetProxy(rawURL)
+}
+
+// SetConnWrapper 设置连接包装函数，在 Dial 之前调用，参见 network.TcpConn.SetConnWrapper
+func (this *Client) SetConnWrapper(wrap func(net.Conn) net.Conn) {
+	this.tcpClient.SetConnWrapper(wrap)
+}
+
+// SetAuthenticator 设置会话启动前的认证器，在 Dial 之前调用，参见 network.TcpConn.SetAuthenticator
+func (this *Client) SetAuthenticator(auth network.Authenticator, timeout time.Duration) {
+	this.tcpClient.SetAuthenticator(auth, timeout)
+}
+
+// SetTransport 设置只在该客户端使用的传输方式，在 Dial 之前调用，参见 network.TcpConn.SetTransport
+func (this *Client) SetTransport(scheme string, transport network.Transport) {
+	this.tcpClient.SetTransport(scheme, transport)
+}
+
+// SetCipher 设置预共享密钥加密，在 Dial 之前调用，参见 network.TcpConn.SetCipher
+func (this *Client) SetCipher(psk []byte) error {
+	return this.tcpClient.SetCipher(psk)
 }
 
 // Connect 建立客户端会话
@@ -47,34 +111,32 @@ func (this *Client) Connect(fd uint16, s *network.Session) {
 
 // Message 处理从服务器接收到的消息
 func (this *Client) Message(fd uint16, sessionID uint16, body []byte) {
-	// 使用读取锁来保护对调用结果映射的并发访问
-	this.mapLocker.RLock()
+	// 使用写锁取出并删除与会话ID关联的等待通道，避免与超时和关闭并发处理同一个通道
+	this.mapLocker.Lock()
 	waitRet, ok := this.callRet[sessionID]
-	this.mapLocker.RUnlock()
+	delete(this.callRet, sessionID)
+	this.mapLocker.Unlock()
 
 	// 如果未找到与会话ID关联的等待通道，则退出函数
 	if !ok {
 		return
 	}
+	defer close(waitRet)
 
 	// 创建一个空的接口切片用于解码消息体
 	args := []interface{}{}
 
-	// 将接收到的消息体解析为接口切片
-	err := json.Unmarshal(body, &args)
-	if err != nil {
-		log.Error(err)
-		return
+	// 将接收到的消息体解析为接口切片，空消息体表示没有返回值
+	if len(body) > 0 {
+		err := json.Unmarshal(body, &args)
+		if err != nil {
+			log.Error(err)
+			return
+		}
 	}
 
 	// 将解析后的消息体发送到等待通道
 	waitRet <- args
-
-	// 使用写锁来删除映射中的对应条目，并关闭等待通道
-	this.mapLocker.Lock()
-	delete(this.callRet, sessionID)
-	this.mapLocker.Unlock()
-	close(waitRet)
 }
 
 // Heartbeat 心跳处理
@@ -83,8 +145,9 @@ func (this *Client) Heartbeat(fd uint16, sessionID uint16) {
 	log.Debug("Client Heartbeat", fd, sessionID)
 }
 
-// Close 关闭客户端
-func (this *Client) Close(uint16) {
+// Close 处理连接关闭，结束所有等待中的调用
+func (this *Client) Close(fd uint16, info network.CloseInfo) {
+	log.Debug("rpc client connection closed", fd, info)
 	// 使用写锁来保护对调用结果映射的并发访问
 	this.mapLocker.Lock()
 
@@ -99,20 +162,35 @@ func (this *Client) Close(uint16) {
 	//this.tcpClient.Close()
 }
 
-// Call 发起远程调用并等待结果
+// Call 发起远程调用并等待结果，失败或超时返回 nil
 func (this *Client) Call(v []interface{}) []interface{} {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultCallTimeout)
+	defer cancel()
+
+	ret, err := this.CallContext(ctx, v)
+	if err != nil {
+		log.Debug("call failed", err)
+		return nil
+	}
+	return ret
+}
+
+// CallContext 发起远程调用并在 ctx 的控制下等待结果。
+// 发送失败时返回网络层的错误（如 network.ErrClosed、network.ErrQueueFull），
+// ctx 超时返回 ErrTimeout，等待期间连接关闭返回 ErrNoResponse。
+func (this *Client) CallContext(ctx context.Context, v []interface{}) ([]interface{}, error) {
 
 	// 获取一个唯一的会话ID，通常用于标识远程调用
 	sessionID := this.tcpClient.GetSessionID()
 	//TODO make a channel list pool
 
 	// 创建一个等待通道，用于接收远程调用的结果
-	waitRet := make(chan []interface{})
+	waitRet := make(chan []interface{}, 1)
 
 	// 将传入的参数 v 编码为 JSON 格式的消息体
 	body, err := json.Marshal(v)
 	if err != nil {
-		return nil
+		return nil, ErrMarshal
 	}
 
 	//log.Debug("call", sessionID)
@@ -122,42 +200,52 @@ func (this *Client) Call(v []interface{}) []interface{} {
 	this.callRet[sessionID] = waitRet
 	this.mapLocker.Unlock()
 
-	//this.outData <- &network.Data{Head: sessionID, Body: body}
-	//sessionID := this.tcpClient.WriteData(this.session, body)
-
 	// 使用 TCP 客户端向服务器发送请求消息，包括会话ID和消息体
-	this.tcpClient.Write(this.session, sessionID, body)
+	if err := this.tcpClient.Write(this.session, sessionID, body); err != nil {
+		this.removeCall(sessionID)
+		return nil, err
+	}
 
 	// 使用 select 语句监听等待通道和超时条件
 	select {
 	case ret, ok := <-waitRet:
 		// 如果成功从等待通道中接收到结果，则返回结果
 		if ok {
-			return ret
+			return ret, nil
 		}
+		return nil, ErrNoResponse
 
-	case <-time.After(3 * time.Second):
-		// 如果超时，则记录超时信息
+	case <-ctx.Done():
+		// 如果超时，则记录超时信息并移除等待通道
 		log.Debug("Timed out", sessionID)
+		this.removeCall(sessionID)
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, ErrTimeout
+		}
+		return nil, ctx.Err()
 	}
-	// 如果出现服务器问题或超时，返回 nil 或其他适当的错误信息
-	log.Debug("some problems on server")
-	return nil
 }
 
-// Send 发送数据到服务器，无需等待响应
-func (this *Client) Send(v []interface{}) {
+// removeCall 移除等待中的调用
+func (this *Client) removeCall(sessionID uint16) {
+	this.mapLocker.Lock()
+	delete(this.callRet, sessionID)
+	this.mapLocker.Unlock()
+}
+
+// Send 发送数据到服务器，无需等待响应，发送失败时返回错误
+func (this *Client) Send(v []interface{}) error {
 	//sessionID := this.tcpClient.GetSessionID()
 	// 将传入的参数 v 编码为 JSON 格式的消息体
 	body, err := json.Marshal(v)
 	if err != nil {
-		return
+		return ErrMarshal
 	}
 
-	//this.outData <- &network.Data{Head: sessionID, Body: body}
 	// 使用 TCP 客户端向服务器发送消息体
-	this.tcpClient.WriteData(this.session, body)
+	_, err = this.tcpClient.WriteData(this.session, body)
 	//log.Debug("send", sessionID)
+	return err
 }
 
 // SendCallBack 发送数据到服务器，并在收到响应后执行回调函数
@@ -5,8 +5,10 @@ import (
 	"github.com/lizhen1412/eegos/network"
 
 	"encoding/json"
+	"net"
 	"reflect"
 	"strings"
+	"time"
 )
 
 // methodType 表示服务方法的类型，包括方法本身以及其参数类型。
@@ -35,16 +37,17 @@ type Server struct {
 }
 
 // NewServer 创建一个新的RPC服务器实例。
-// 参数 addr 是服务器监听的地址，通常是 IP 地址和端口号，例如 "localhost:8080"。
+// 参数 addrs 是服务器监听的一个或多个地址，通常是 IP 地址和端口号，例如 "localhost:8080"、"[::]:8081"，
+// 也可以是 "scheme://地址" 形式的其他传输方式，例如 "unix:///tmp/rpc.sock"，参见 network.Transport。
 // 该函数会初始化一个服务映射(serviceMap)，一个TCP服务器(tcpServer)，以及一个会话映射(sessions)。
 // 返回一个指向新服务器实例的指针。
-func NewServer(addr string) *Server {
+func NewServer(addrs ...string) *Server {
 	// 创建一个空的服务映射
 	services := make(map[string]*Service)
 	// 创建一个新的服务器实例并初始化
 	newServer := Server{serviceMap: services}
 	// 创建一个新的TCP服务器实例并初始化
-	newServer.tcpServer = network.NewTcpServer(&newServer, addr)
+	newServer.tcpServer = network.NewTcpServer(&newServer, addrs...)
 	// 创建一个空的会话映射
 	newServer.sessions = make(map[uint16]*network.Session)
 	// 返回服务器实例的指针
@@ -57,6 +60,26 @@ func (this *Server) Start() {
 	this.tcpServer.Start()
 }
 
+// SetConnWrapper 设置连接包装函数，在 Start 之前调用，参见 network.TcpConn.SetConnWrapper
+func (this *Server) SetConnWrapper(wrap func(net.Conn) net.Conn) {
+	this.tcpServer.SetConnWrapper(wrap)
+}
+
+// SetAuthenticator 设置会话启动前的认证器，在 Start 之前调用，参见 network.TcpConn.SetAuthenticator
+func (this *Server) SetAuthenticator(auth network.Authenticator, timeout time.Duration) {
+	this.tcpServer.SetAuthenticator(auth, timeout)
+}
+
+// SetTransport 设置只在该服务器使用的传输方式，在 Start 之前调用，参见 network.TcpConn.SetTransport
+func (this *Server) SetTransport(scheme string, transport network.Transport) {
+	this.tcpServer.SetTransport(scheme, transport)
+}
+
+// SetCipher 设置预共享密钥加密，在 Start 之前调用，参见 network.TcpConn.SetCipher
+func (this *Server) SetCipher(psk []byte) error {
+	return this.tcpServer.SetCipher(psk)
+}
+
 // Connect 处理新连接。
 func (this *Server) Connect(fd uint16, session *network.Session) {
 	log.Debug("rpc server new connection", fd)
@@ -133,17 +156,17 @@ func (this *Server) Message(fd uint16, sessionID uint16, body []byte) {
 	// 调用方法并获取返回值
 	ret := this.RunFunc(mInfo, callArgs)
 	// 将返回值序列化为JSON并发送给客户端
+	var retBody []byte
 	if ret != nil {
-		retBody, err := json.Marshal(ret)
+		retBody, err = json.Marshal(ret)
 		if err != nil {
 			log.Error(err)
 			return
 		}
-		// 使用 TCP 服务器的 Write 方法将处理后的响应数据 retBody 发送回客户端
-		this.tcpServer.Write(s, sessionID, retBody)
-	} else {
-		// 如果没有返回值，发送空响应
-		this.tcpServer.Write(s, sessionID, nil)
+	}
+	// 以高优先级将处理后的响应数据 retBody 发送回客户端，没有返回值时发送空响应
+	if err := this.tcpServer.WritePriority(s, sessionID, retBody, network.PRIORITY_HIGH); err != nil {
+		log.Error("rpc server write response", fd, sessionID, err)
 	}
 	//retPkg := &network.Data{Head: sessionID, Body: retBody}
 	//log.Debug("return", sessionID, args[0])
@@ -157,8 +180,8 @@ func (this *Server) Heartbeat(fd uint16, sessionID uint16) {
 }
 
 // Close 处理连接关闭。
-func (this *Server) Close(fd uint16) {
-	log.Debug("need close session", fd)
+func (this *Server) Close(fd uint16, info network.CloseInfo) {
+	log.Debug("need close session", fd, info)
 }
 
 /*